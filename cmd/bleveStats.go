@@ -0,0 +1,127 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"io"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+// bleveStatsCmd represents the bleve command
+var bleveStatsCmd = &cobra.Command{
+	Use:   "bleve",
+	Short: "Dumps the stats of a bleve upsidedown index",
+	Long: `This command decodes the rows of the bleve "upsidedown" index
+held in the store, and dumps the number of terms, postings and stored
+fields per field along with their sizes, the number of documents and
+the largest posting lists. In the record output formats, such as the
+table and csv, these are rows of the kinds field, docs and posting.
+	./mossScope stats bleve <path_to_store>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return usageErrorf("at least one path is required")
+		}
+		if bleveTop < 0 {
+			return usageErrorf("top must not be negative")
+		}
+		return nil
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeBleveStats(cmd.OutOrStdout(), dirs)
+	},
+}
+
+var bleveTop int
+
+func invokeBleveStats(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, tableOutput)
+	if err != nil {
+		return err
+	}
+
+	var failures storeFailures
+
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return scope.FetchBleveStats(store, bleveTop)
+	}, func(dir string, val interface{}) error {
+		return r.section(dir, val, bleveStatsRecords(val.(*scope.BleveStats)))
+	}, failures.report(r))
+	if err != nil {
+		return err
+	}
+
+	err = r.close()
+	if err != nil {
+		return err
+	}
+
+	return failures.err()
+}
+
+// bleveStatsRecords returns a record per field, the number of documents
+// and a record per posting list, which share the same columns, so that
+// they can be emitted together in the record output formats. The
+// columns that do not apply to a kind of row are left empty (nil).
+func bleveStatsRecords(stats *scope.BleveStats) []*record {
+	recs := make([]*record, 0,
+		len(stats.Fields)+1+len(stats.LargestPostings))
+
+	row := func(kind string, field, name, term, count interface{}) *record {
+		return (&record{}).add("kind", kind).
+			add("field", field).
+			add("name", name).
+			add("term", term).
+			add("count", count)
+	}
+
+	for _, f := range stats.Fields {
+		recs = append(recs, row("field", f.Field, f.Name, nil, nil).
+			add("terms", f.Terms).
+			add("dictionary_bytes", f.DictionaryBytes).
+			add("postings", f.Postings).
+			add("postings_bytes", f.PostingsBytes).
+			add("stored_fields", f.StoredFields).
+			add("stored_bytes", f.StoredBytes))
+	}
+
+	fieldCols := func(rec *record) *record {
+		return rec.add("terms", nil).
+			add("dictionary_bytes", nil).
+			add("postings", nil).
+			add("postings_bytes", nil).
+			add("stored_fields", nil).
+			add("stored_bytes", nil)
+	}
+
+	recs = append(recs, fieldCols(row("docs", nil, nil, nil, stats.Docs)))
+	for _, p := range stats.LargestPostings {
+		recs = append(recs,
+			fieldCols(row("posting", p.Field, p.Name, p.Term, p.Count)))
+	}
+
+	return recs
+}
+
+func init() {
+	statsCmd.AddCommand(bleveStatsCmd)
+
+	// Local flag that is intended to work with stats bleve
+	bleveStatsCmd.Flags().IntVar(&bleveTop, "top", 10,
+		"Number of the largest posting lists to emit")
+}
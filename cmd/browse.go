@@ -0,0 +1,593 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// browseCmd represents the browse command
+var browseCmd = &cobra.Command{
+	Use:   "browse",
+	Short: "Opens a full-screen browser for the store",
+	Long: `Opens a full-screen terminal UI with panes for the list of
+footers, the segments of the selected footer, and a paged list of the
+key-values in the snapshot of the selected footer.
+	Tab / Shift-Tab   Switches between the panes
+	Up / Down         Moves the selection within the pane
+	PgUp / PgDn       Pages through the key-values
+	/                 Seeks to the first key >= the typed key
+	h                 Toggles between hex and text values
+	p                 Toggles pretty-printing of JSON values
+	q                 Quits
+For example:
+	./mossScope browse <path_to_store>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return usageErrorf("exactly one path is required")
+		}
+		return nil
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return invokeBrowse(cmd.InOrStdin(), cmd.OutOrStdout(), args[0])
+	},
+}
+
+const (
+	paneFooters = iota
+	paneSegments
+	paneKeys
+	numPanes
+)
+
+// Keys decoded from the terminal's escape sequences.
+const (
+	keyUp rune = iota + utf8.MaxRune + 1
+	keyDown
+	keyPgUp
+	keyPgDn
+	keyBackTab
+)
+
+// browseFooter caches what's displayed of every footer of the store.
+type browseFooter struct {
+	stats scope.FooterStats
+	segs  moss.SegmentLocs
+}
+
+// browser holds the state of the browse UI, independent of the
+// terminal that it is rendered onto.
+type browser struct {
+	dir   string
+	store *moss.Store
+
+	footers   []browseFooter // Latest footer first.
+	footerIdx int
+	snap      moss.Snapshot // Snapshot of the selected footer.
+	segIdx    int
+
+	pageSize  int
+	pageStart []byte   // First key of the current page.
+	prevPages [][]byte // First keys of the preceding pages.
+	keys      [][]byte
+	vals      [][]byte
+	more      bool // Whether there are keys beyond the current page.
+	keyIdx    int
+
+	focus     int
+	hex       bool
+	pretty    bool
+	searching bool
+	search    string
+	status    string
+}
+
+func invokeBrowse(in io.Reader, out io.Writer, dir string) error {
+	f, ok := in.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return fmt.Errorf("browse requires a terminal")
+	}
+	fd := int(f.Fd())
+
+	_, height, err := term.GetSize(fd)
+	if err != nil {
+		return fmt.Errorf("Terminal-GetSize() failed, err: %v", err)
+	}
+
+	b, err := newBrowser(dir, keysPageSize(height))
+	if err != nil {
+		return err
+	}
+	defer b.close()
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("Terminal-MakeRaw() failed, err: %v", err)
+	}
+	defer term.Restore(fd, oldState)
+
+	// Switch to the alternate screen, and hide the cursor
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+
+	buf := make([]byte, 64)
+	for {
+		width, height, err := term.GetSize(fd)
+		if err != nil {
+			return fmt.Errorf("Terminal-GetSize() failed, err: %v", err)
+		}
+
+		lines := b.render(width, height)
+		fmt.Fprint(out, "\x1b[H"+strings.Join(lines, "\r\n"))
+
+		n, err := in.Read(buf)
+		if err != nil {
+			return err
+		}
+
+		for _, k := range decodeKeys(buf[:n]) {
+			if !b.handleKey(k) {
+				return nil
+			}
+		}
+	}
+}
+
+func newBrowser(dir string, pageSize int) (*browser, error) {
+	store, err := scope.OpenStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &browser{dir: dir, store: store, pageSize: pageSize, pretty: true}
+
+	err = scope.WalkFooters(store, true, func(id int, footer *moss.Footer) error {
+		b.footers = append(b.footers, browseFooter{
+			stats: scope.GetFooterStats(footer),
+			segs:  append(moss.SegmentLocs(nil), footer.SegmentLocs...)})
+		return nil
+	})
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	err = b.selectFooter(0)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+func (b *browser) close() {
+	if b.snap != nil {
+		b.snap.Close()
+	}
+	b.store.Close()
+}
+
+// selectFooter opens the snapshot of the i'th footer (0 is latest),
+// and loads the first page of its key-values.
+func (b *browser) selectFooter(i int) error {
+	snap, err := scope.SnapshotAt(b.store, i+1)
+	if err != nil {
+		return err
+	}
+
+	if b.snap != nil {
+		b.snap.Close()
+	}
+	b.snap, b.footerIdx, b.segIdx = snap, i, 0
+	b.pageStart, b.prevPages = nil, nil
+
+	return b.loadPage()
+}
+
+// loadPage loads a page of key-values beginning at pageStart.
+func (b *browser) loadPage() error {
+	// One more than a page is loaded, to find out if there are more
+	d, err := scope.DumpSnapshot(b.snap, scope.DumpOptions{Start: b.pageStart,
+		Limit: b.pageSize + 1})
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	b.keys, b.vals, b.more, b.keyIdx = nil, nil, false, 0
+
+	for d.Next() {
+		if len(b.keys) == b.pageSize {
+			b.more = true
+			break
+		}
+
+		rec := d.Record()
+		b.keys = append(b.keys, append([]byte(nil), rec.Key...))
+		b.vals = append(b.vals, append([]byte(nil), rec.Val...))
+	}
+
+	return d.Err()
+}
+
+// resizePage reloads the current page with pageSize keys, keeping the
+// selected key selected, on a page of its own if it would not fit.
+func (b *browser) resizePage(pageSize int) error {
+	keyIdx := b.keyIdx
+	if keyIdx >= pageSize && keyIdx < len(b.keys) {
+		b.prevPages = append(b.prevPages, b.pageStart)
+		b.pageStart, keyIdx = b.keys[keyIdx], 0
+	}
+	b.pageSize = pageSize
+
+	err := b.loadPage()
+	if err != nil {
+		return err
+	}
+	if keyIdx < len(b.keys) {
+		b.keyIdx = keyIdx
+	}
+	return nil
+}
+
+func (b *browser) nextPage() error {
+	if !b.more || len(b.keys) == 0 {
+		return nil
+	}
+	b.prevPages = append(b.prevPages, b.pageStart)
+	// The first key past the current page
+	b.pageStart = append(append([]byte(nil), b.keys[len(b.keys)-1]...), 0)
+	return b.loadPage()
+}
+
+func (b *browser) prevPage() error {
+	if len(b.prevPages) == 0 {
+		return nil
+	}
+	b.pageStart = b.prevPages[len(b.prevPages)-1]
+	b.prevPages = b.prevPages[:len(b.prevPages)-1]
+	return b.loadPage()
+}
+
+// seek loads the page beginning at the first key >= key.
+func (b *browser) seek(key string) error {
+	b.prevPages = append(b.prevPages, b.pageStart)
+	b.pageStart = []byte(key)
+	return b.loadPage()
+}
+
+// handleKey applies a key press, and returns false to quit.
+func (b *browser) handleKey(k rune) bool {
+	var err error
+
+	b.status = ""
+
+	if b.searching {
+		switch k {
+		case '\r', '\n':
+			b.searching = false
+			err = b.seek(b.search)
+			b.focus = paneKeys
+		case 27: // Esc
+			b.searching = false
+		case 127, 8: // Backspace
+			if len(b.search) > 0 {
+				_, size := utf8.DecodeLastRuneInString(b.search)
+				b.search = b.search[:len(b.search)-size]
+			}
+		default:
+			if k >= ' ' && k <= utf8.MaxRune {
+				b.search += string(k)
+			}
+		}
+	} else {
+		switch k {
+		case 'q', 3: // Ctrl-C
+			return false
+		case '\t':
+			b.focus = (b.focus + 1) % numPanes
+		case keyBackTab:
+			b.focus = (b.focus + numPanes - 1) % numPanes
+		case keyUp:
+			err = b.move(-1)
+		case keyDown:
+			err = b.move(1)
+		case keyPgDn:
+			err = b.nextPage()
+		case keyPgUp:
+			err = b.prevPage()
+		case '/':
+			b.searching, b.search = true, ""
+		case 'h':
+			b.hex = !b.hex
+		case 'p':
+			b.pretty = !b.pretty
+		}
+	}
+
+	if err != nil {
+		b.status = err.Error()
+	}
+
+	return true
+}
+
+// move moves the selection of the focused pane by delta.
+func (b *browser) move(delta int) error {
+	switch b.focus {
+	case paneFooters:
+		i := b.footerIdx + delta
+		if i >= 0 && i < len(b.footers) {
+			return b.selectFooter(i)
+		}
+	case paneSegments:
+		i := b.segIdx + delta
+		if i >= 0 && i < len(b.footers[b.footerIdx].segs) {
+			b.segIdx = i
+		}
+	case paneKeys:
+		i := b.keyIdx + delta
+		if i >= 0 && i < len(b.keys) {
+			b.keyIdx = i
+		} else if i >= len(b.keys) && b.more {
+			return b.nextPage()
+		} else if i < 0 && len(b.prevPages) > 0 {
+			err := b.prevPage()
+			if err == nil && len(b.keys) > 0 {
+				b.keyIdx = len(b.keys) - 1
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// render returns the lines of the screen, which are exactly height
+// lines of width (visible) characters each.
+func (b *browser) render(width, height int) []string {
+	if width < 40 || height < 10 {
+		lines := []string{fit("terminal too small", width)}
+		for len(lines) < height {
+			lines = append(lines, fit("", width))
+		}
+		return lines
+	}
+
+	leftWidth := width / 3
+	rightWidth := width - leftWidth - 1
+	bodyHeight := height - 2
+
+	footersHeight := bodyHeight / 2
+	keysHeight := bodyHeight / 2
+
+	// The keys pane is sized to the terminal, reload if that changed
+	if b.pageSize != keysPageSize(height) {
+		err := b.resizePage(keysPageSize(height))
+		if err != nil {
+			b.status = err.Error()
+		}
+	}
+
+	left := append(b.renderFooters(leftWidth, footersHeight),
+		b.renderSegments(leftWidth, bodyHeight-footersHeight)...)
+	right := append(b.renderKeys(rightWidth, keysHeight),
+		b.renderValue(rightWidth, bodyHeight-keysHeight)...)
+
+	mode := "text"
+	if b.hex {
+		mode = "hex"
+	} else if b.pretty {
+		mode = "text, pretty"
+	}
+
+	lines := []string{reverse(fit(fmt.Sprintf(" mossScope browse: %s "+
+		"[Footer_%d] [%s]", b.dir, b.footerIdx+1, mode), width))}
+
+	for i := 0; i < bodyHeight; i++ {
+		lines = append(lines, left[i]+"|"+right[i])
+	}
+
+	switch {
+	case b.searching:
+		lines = append(lines, fit("Seek to key: "+b.search+"_", width))
+	case b.status != "":
+		lines = append(lines, fit("Error: "+b.status, width))
+	default:
+		lines = append(lines, fit("Tab:pane  Up/Down:select  PgUp/PgDn:page"+
+			"  /:seek  h:hex  p:pretty  q:quit", width))
+	}
+
+	return lines
+}
+
+// keysPageSize returns the number of keys per page, being the rows of
+// the keys pane of a terminal of the height, below its title.
+func keysPageSize(height int) int {
+	if height < 10 {
+		// Too small to render, the page is resized once it is not
+		return 1
+	}
+	return (height-2)/2 - 1
+}
+
+func (b *browser) renderFooters(width, height int) []string {
+	rows := make([]string, 0, len(b.footers))
+	for i, f := range b.footers {
+		rows = append(rows, fmt.Sprintf("Footer_%d segs:%d set:%d del:%d",
+			i+1, f.stats.NumSegments, f.stats.TotalOpsSet,
+			f.stats.TotalOpsDel))
+	}
+	return renderPane("Footers", rows, b.footerIdx,
+		b.focus == paneFooters, width, height)
+}
+
+func (b *browser) renderSegments(width, height int) []string {
+	segs := b.footers[b.footerIdx].segs
+	rows := make([]string, 0, len(segs))
+	for i := range segs {
+		sloc := &segs[i]
+		rows = append(rows, fmt.Sprintf("%d: %s set:%d del:%d "+
+			"kb:%d vb:%d", i, sloc.Kind, sloc.TotOpsSet, sloc.TotOpsDel,
+			sloc.TotKeyByte, sloc.TotValByte))
+	}
+	return renderPane("Segments (oldest first)", rows, b.segIdx,
+		b.focus == paneSegments, width, height)
+}
+
+func (b *browser) renderKeys(width, height int) []string {
+	rows := make([]string, 0, len(b.keys))
+	for _, k := range b.keys {
+		if b.hex {
+			rows = append(rows, hex.EncodeToString(k))
+		} else {
+			rows = append(rows, printable(k))
+		}
+	}
+
+	title := fmt.Sprintf("Keys (page %d)", len(b.prevPages)+1)
+	if b.more {
+		title += " more..."
+	}
+	return renderPane(title, rows, b.keyIdx, b.focus == paneKeys,
+		width, height)
+}
+
+func (b *browser) renderValue(width, height int) []string {
+	var val []byte
+	if b.keyIdx < len(b.vals) {
+		val = b.vals[b.keyIdx]
+	}
+	return renderPane(fmt.Sprintf("Value (%d bytes)", len(val)),
+		formatValue(val, b.hex, b.pretty), -1, false, width, height)
+}
+
+// formatValue returns the lines to display of a value, a hex dump in
+// hex mode, else the indented JSON if it's pretty-printable.
+func formatValue(val []byte, toHex, pretty bool) []string {
+	if toHex {
+		return strings.Split(strings.TrimRight(hex.Dump(val), "\n"), "\n")
+	}
+
+	if pretty {
+		var buf bytes.Buffer
+		if json.Indent(&buf, val, "", "  ") == nil {
+			return strings.Split(buf.String(), "\n")
+		}
+	}
+
+	return strings.Split(printable(val), "\n")
+}
+
+// renderPane renders the rows with a title line, scrolling to keep
+// the selected row visible.
+func renderPane(title string, rows []string, selected int, focused bool,
+	width, height int) []string {
+	titleLine := fit(" "+title, width)
+	if focused {
+		titleLine = reverse(titleLine)
+	}
+	lines := []string{titleLine}
+
+	offset := 0
+	if selected >= height-1 {
+		offset = selected - (height - 2)
+	}
+
+	for i := offset; len(lines) < height; i++ {
+		if i >= len(rows) {
+			lines = append(lines, fit("", width))
+			continue
+		}
+		if i == selected {
+			lines = append(lines, reverse(fit(">"+rows[i], width)))
+		} else {
+			lines = append(lines, fit(" "+rows[i], width))
+		}
+	}
+
+	return lines
+}
+
+// printable replaces the control and invalid characters, which would
+// otherwise mess with the terminal, keeping the new lines.
+func printable(b []byte) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || (r >= ' ' && r != 127 && r != utf8.RuneError) {
+			return r
+		}
+		return '.'
+	}, string(b))
+}
+
+// fit truncates or pads the string to exactly width characters.
+func fit(s string, width int) string {
+	s = strings.Replace(printable([]byte(s)), "\n", " ", -1)
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		return string([]rune(s)[:width])
+	}
+	return s + strings.Repeat(" ", width-n)
+}
+
+func reverse(s string) string {
+	return "\x1b[7m" + s + "\x1b[0m"
+}
+
+// decodeKeys decodes the bytes read from the terminal into keys.
+func decodeKeys(buf []byte) []rune {
+	var keys []rune
+	for len(buf) > 0 {
+		seqs := []struct {
+			seq string
+			key rune
+		}{
+			{"\x1b[A", keyUp}, {"\x1bOA", keyUp},
+			{"\x1b[B", keyDown}, {"\x1bOB", keyDown},
+			{"\x1b[5~", keyPgUp}, {"\x1b[6~", keyPgDn},
+			{"\x1b[Z", keyBackTab},
+		}
+
+		matched := false
+		for _, s := range seqs {
+			if bytes.HasPrefix(buf, []byte(s.seq)) {
+				keys = append(keys, s.key)
+				buf = buf[len(s.seq):]
+				matched = true
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+
+		r, size := utf8.DecodeRune(buf)
+		keys = append(keys, r)
+		buf = buf[size:]
+	}
+	return keys
+}
+
+func init() {
+	RootCmd.AddCommand(browseCmd)
+}
@@ -0,0 +1,143 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBrowse(t *testing.T) {
+	// Footer 1 (1 segment)
+	_, store, coll := setup(t, true)
+	cleanup("", store, coll)
+
+	// Footer 2 (2 segments)
+	dir, store, coll := setup(t, false)
+	defer cleanup(dir, store, coll)
+
+	b, err := newBrowser(dir, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.close()
+
+	if len(b.footers) != 2 {
+		t.Fatalf("Unexpected number of footers: %d!", len(b.footers))
+	}
+
+	if len(b.keys) != 4 || string(b.keys[0]) != "key0" || !b.more {
+		t.Errorf("Unexpected first page: %q, more: %v!", b.keys, b.more)
+	}
+
+	// Page through the keys, the last page holds key8 and key9
+	b.handleKey(keyPgDn)
+	b.handleKey(keyPgDn)
+	if len(b.keys) != 2 || string(b.keys[0]) != "key8" || b.more {
+		t.Errorf("Unexpected last page: %q, more: %v!", b.keys, b.more)
+	}
+
+	b.handleKey(keyPgUp)
+	if string(b.keys[0]) != "key4" {
+		t.Errorf("Unexpected previous page: %q!", b.keys)
+	}
+
+	// Seek to a key
+	for _, k := range decodeKeys([]byte("/key6\r")) {
+		b.handleKey(k)
+	}
+	if b.focus != paneKeys || string(b.keys[0]) != "key6" {
+		t.Errorf("Unexpected page after seek: %q!", b.keys)
+	}
+
+	b.handleKey(keyDown)
+	if string(b.keys[b.keyIdx]) != "key7" {
+		t.Errorf("Unexpected selected key: %q!", b.keys[b.keyIdx])
+	}
+
+	// Select the older footer, which has a single segment
+	b.handleKey('\t')
+	if b.focus != paneFooters {
+		t.Errorf("Unexpected focus: %d!", b.focus)
+	}
+	b.handleKey(keyDown)
+	if b.footerIdx != 1 || len(b.footers[b.footerIdx].segs) != 1 {
+		t.Errorf("Unexpected footer selection: %d!", b.footerIdx)
+	}
+
+	lines := b.render(120, 30)
+	if len(lines) != 30 {
+		t.Errorf("Unexpected number of lines: %d!", len(lines))
+	}
+
+	// The page is resized to the keys pane of the terminal
+	if b.pageSize != keysPageSize(30) || keysPageSize(30) != 13 ||
+		len(b.keys) != 10 {
+		t.Errorf("Unexpected page of %d keys: %q!", b.pageSize, b.keys)
+	}
+	screen := strings.Join(lines, "\n")
+	for _, expect := range []string{"[Footer_2]", "Footer_1 segs:2",
+		"Footer_2 segs:1", "set:10 del:0", ">key0", "Value (4 bytes)", "val0"} {
+		if !strings.Contains(screen, expect) {
+			t.Errorf("Expected %q on the screen:\n%s", expect, screen)
+		}
+	}
+
+	// Resizing keeps the selected key selected
+	b.handleKey('\t')
+	b.handleKey('\t')
+	b.handleKey(keyDown)
+	b.handleKey(keyDown)
+	b.handleKey(keyDown)
+	b.render(120, 20)
+	if b.pageSize != 8 || string(b.keys[b.keyIdx]) != "key3" {
+		t.Errorf("Unexpected selected key after growing: %q!",
+			b.keys[b.keyIdx])
+	}
+	b.render(120, 10)
+	if b.pageSize != 3 || b.keyIdx != 0 || string(b.keys[0]) != "key3" {
+		t.Errorf("Unexpected page after shrinking: %q, selected: %d!",
+			b.keys, b.keyIdx)
+	}
+	b.handleKey(keyPgUp)
+
+	b.handleKey('h')
+	screen = strings.Join(b.render(120, 30), "\n")
+	if !strings.Contains(screen, ">6b657930") ||
+		!strings.Contains(screen, "76 61 6c 30") {
+		t.Errorf("Expected hex keys and values on the screen:\n%s", screen)
+	}
+
+	if b.handleKey('q') {
+		t.Errorf("Expected q to quit!")
+	}
+
+	// The keys are read from the stdin of the command, a terminal
+	err = invokeBrowse(strings.NewReader("q"), ioutil.Discard, dir)
+	if err == nil {
+		t.Errorf("Expected browse to require a terminal!")
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	lines := formatValue([]byte(`{"a":1}`), false, true)
+	if strings.Join(lines, "\n") != "{\n  \"a\": 1\n}" {
+		t.Errorf("Unexpected pretty value: %q", lines)
+	}
+
+	lines = formatValue([]byte("a\x00b"), false, true)
+	if len(lines) != 1 || lines[0] != "a.b" {
+		t.Errorf("Unexpected text value: %q", lines)
+	}
+
+	if fit("abc", 5) != "abc  " || fit("abcdef", 3) != "abc" {
+		t.Errorf("Unexpected fit!")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+var columnsSpec string
+
+// columns are parsed from --columns, and are nil when not set.
+var columns []string
+
+// dumpColumns are the columns that --columns may select.
+var dumpColumns = []string{"key", "value", "key_len", "val_len", "footer",
+	"collection", "error"}
+
+func checkColumns() error {
+	columns = nil
+	if columnsSpec == "" {
+		return nil
+	}
+
+	if decodeFormat != "" {
+		return usageErrorf("--columns does not apply to --decode")
+	}
+	switch selectedFormat(jsonOutput) {
+	case jsonOutput, yamlOutput:
+		return usageErrorf("--columns requires a record output format, " +
+			"such as csv or tsv")
+	}
+
+	for _, col := range strings.Split(columnsSpec, ",") {
+		col = strings.TrimSpace(col)
+
+		known := false
+		for _, name := range dumpColumns {
+			known = known || col == name
+		}
+		if !known {
+			return usageErrorf("unsupported column: %s, supported: %s",
+				col, strings.Join(dumpColumns, ", "))
+		}
+		if keysOnly && (col == "value" || col == "val_len") {
+			return usageErrorf("column %s does not apply to --keys-only", col)
+		}
+
+		columns = append(columns, col)
+	}
+	return nil
+}
+
+// recordColumns returns the columns of the records of dump, being
+// --columns, or else the key and value (and decoding error) for csv
+// and tsv, along with whether binary keys and values are escaped, which
+// they are in csv and tsv. The columns are nil for the default records.
+func recordColumns() (cols []string, escape bool) {
+	format := selectedFormat(jsonOutput)
+	escape = format == csvOutput || format == tsvOutput
+
+	if columns != nil || !escape || decodeFormat != "" {
+		return columns, escape
+	}
+
+	cols = []string{"key"}
+	if !keysOnly {
+		cols = append(cols, "value")
+	}
+	if keyDecoder != nil || valueDecoder != nil {
+		cols = append(cols, "error")
+	}
+	return cols, escape
+}
+
+// columnsRecord returns the record of a key-value holding the columns,
+// read from the snapshot of the footer (1 for the latest) and of the
+// child collection, empty for the top-level one.
+func columnsRecord(cols []string, footer int, collection string,
+	key, val []byte, escape bool) *record {
+	var errs []string
+	k, err := columnValue(keyDecoder, key, escape)
+	if err != nil {
+		errs = append(errs, fmt.Sprintf("key: %v", err))
+	}
+	v, err := columnValue(valueDecoder, val, escape)
+	if err != nil && val != nil {
+		errs = append(errs, fmt.Sprintf("value: %v", err))
+	}
+
+	rec := &record{}
+	for _, col := range cols {
+		switch col {
+		case "key":
+			rec.add(col, k)
+		case "value":
+			rec.add(col, v)
+		case "key_len":
+			rec.add(col, len(key))
+		case "val_len":
+			rec.add(col, len(val))
+		case "footer":
+			rec.add(col, footer)
+		case "collection":
+			rec.add(col, collection)
+		case "error":
+			rec.add(col, strings.Join(errs, "; "))
+		}
+	}
+	return rec
+}
+
+// columnValue returns the key or value in hex with --hex, or else as
+// decoded by the decoder if set, or as a string, escaped if binary and
+// escape, along with the error of the decoder.
+func columnValue(decoder scope.Decoder, b []byte,
+	escape bool) (interface{}, error) {
+	if inHex {
+		return hex.EncodeToString(b), nil
+	}
+
+	text := func(s string) string {
+		if escape {
+			return binaryText(s)
+		}
+		return s
+	}
+
+	if decoder == nil {
+		return text(string(b)), nil
+	}
+
+	decoded, err := decoder(b)
+	if err != nil {
+		return text(string(b)), err
+	}
+	if s, ok := decoded.(string); ok {
+		return text(s), nil
+	}
+	return recordValue(decoded), nil
+}
+
+// binaryText returns the string as is if it is text, and otherwise in
+// hex after a "\x" prefix (as with the bytea type of PostgreSQL), being
+// the strings that are not valid UTF-8, that hold control characters
+// other than tabs and line breaks, or that begin with "\x" themselves.
+func binaryText(s string) string {
+	binary := !utf8.ValidString(s) || strings.HasPrefix(s, `\x`)
+	for _, c := range s {
+		if unicode.IsControl(c) && c != '\t' && c != '\n' && c != '\r' {
+			binary = true
+			break
+		}
+	}
+
+	if binary {
+		return `\x` + hex.EncodeToString([]byte(s))
+	}
+	return s
+}
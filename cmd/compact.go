@@ -9,9 +9,11 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 
-	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -28,49 +30,46 @@ For example:
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
 		return nil
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeCompact(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeCompact(cmd.OutOrStdout(), dirs)
 	},
 }
 
-func invokeCompact(dirs []string) error {
-	fmt.Printf("[")
+func invokeCompact(w io.Writer, dirs []string) error {
+	var failures storeFailures
+
+	fmt.Fprintf(w, "[")
 	for _, dir := range dirs {
-		store, coll, err := moss.OpenStoreCollection(dir,
-			moss.StoreOptions{}, moss.StorePersistOptions{})
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStoreCollection() API failed, err: %v",
-				err)
-		}
-		// A snapshot of a freshly opened collection should be empty.
-		emptySnap, err := coll.Snapshot()
+		err := scope.Compact(dir)
 		if err != nil {
-			return fmt.Errorf("Moss-Snapshot failed, err: %v", err)
-		}
+			if !keepGoing {
+				return err
+			}
+			failures.add(dir, err)
 
-		// Attempting to persist an empty snapshot should trigger compaction.
-		storePersistOpts := moss.StorePersistOptions{
-			CompactionConcern: moss.CompactionAllow,
-		}
-		snap, err := store.Persist(emptySnap, storePersistOpts)
-		if err != nil || snap == nil {
-			return fmt.Errorf("Store-Persist() API failed, err: %v", err)
+			jBuf, err := json.Marshal(storeErrorDoc{Store: dir,
+				Error: err.Error()})
+			if err != nil {
+				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+			}
+			fmt.Fprintf(w, "%s\n", string(jBuf))
+			continue
 		}
 
-		fmt.Printf("{ \"%s\" : \"compaction done.\" }\n", dir)
-
-		snap.Close()
-		coll.Close()
-		store.Close()
+		fmt.Fprintf(w, "{ \"%s\" : \"compaction done.\" }\n", dir)
 	}
-	fmt.Printf("]\n")
+	fmt.Fprintf(w, "]\n")
 
-	return nil
+	return failures.err()
 }
 
 func init() {
@@ -11,7 +11,6 @@ package cmd
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"testing"
 
@@ -71,28 +70,13 @@ func TestCompact(t *testing.T) {
 	store.Close()
 	dirs := []string{dir}
 
-	old := os.Stdout // keep backup of the real stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	var buf bytes.Buffer
 
-	err = invokeCompact(dirs)
+	err = invokeCompact(&buf, dirs)
 	if err != nil {
 		t.Fatalf("compaction comand failed")
 	}
 
-	outC := make(chan string)
-	// copy the output in a separate goroutine so dump wouldn't block
-	// indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
-	}()
-
-	// back to normal state
-	w.Close()
-	os.Stdout = old // restoring the real stdout
-
 	store, err = moss.OpenStore(dir, moss.StoreOptions{})
 	if err != nil || store == nil {
 		t.Errorf("Expected OpenStore() to work!")
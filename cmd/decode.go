@@ -0,0 +1,161 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+// decoders decode the key-values of the stores of the applications
+// built on moss, by the name given to --decode.
+var decoders = map[string]func(key, val []byte) (interface{}, error){
+	"bleve-upsidedown": scope.DecodeBleveRow,
+}
+
+var decodeFormat string
+
+func checkDecodeFormat() error {
+	if decodeFormat == "" {
+		return nil
+	}
+	if _, ok := decoders[decodeFormat]; !ok {
+		names := make([]string, 0, len(decoders))
+		for name := range decoders {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return usageErrorf("unsupported decoder: %s, supported: %s",
+			decodeFormat, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// decodedKeyVal is the document of a decoded key-value, where the value
+// is only emitted as is when it fails to decode.
+type decodedKeyVal struct {
+	Key   string      `json:"k"`
+	Row   interface{} `json:"row,omitempty"`
+	Val   *string     `json:"v,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+// decodedOutput returns the document of a key-value decoded by the
+// selected decoder, along with rec extended by its fields, where the
+// row is emitted as JSON.
+func decodedOutput(rec *record, key []byte, val []byte,
+	toHex bool) (interface{}, *record) {
+	kv := encodeKeyVal(key, val, toHex)
+	doc := decodedKeyVal{Key: kv.Key}
+
+	row, err := decoders[decodeFormat](key, val)
+	if err != nil {
+		doc.Error = err.Error()
+		if val != nil {
+			doc.Val = &kv.Val
+		}
+		return doc, rec.add("key", kv.Key).add("row", "").
+			add("error", doc.Error)
+	}
+	doc.Row = row
+
+	jBuf, err := json.Marshal(row)
+	if err != nil {
+		doc.Error = err.Error()
+	}
+	return doc, rec.add("key", kv.Key).add("row", string(jBuf)).
+		add("error", doc.Error)
+}
+
+var keyDecoderSpec string
+var valueDecoderSpec string
+
+// keyDecoder and valueDecoder are built from --key-decoder and
+// --value-decoder, and are nil when not set.
+var keyDecoder, valueDecoder scope.Decoder
+
+func checkKeyValDecoders() error {
+	keyDecoder, valueDecoder = nil, nil
+
+	var err error
+	if keyDecoderSpec != "" {
+		keyDecoder, err = scope.NewDecoder(keyDecoderSpec)
+		if err != nil {
+			return usageErrorf("invalid key decoder: %v", err)
+		}
+	}
+	if valueDecoderSpec != "" {
+		valueDecoder, err = scope.NewDecoder(valueDecoderSpec)
+		if err != nil {
+			return usageErrorf("invalid value decoder: %v", err)
+		}
+	}
+	return nil
+}
+
+// decodeKeyVal returns the key and the value, decoded by keyDecoder and
+// valueDecoder if set, and as strings (in hex if toHex) otherwise,
+// along with the errors of the decoders, which leave the key or value
+// as a string. A nil val (keys only) is returned as nil.
+func decodeKeyVal(key, val []byte, toHex bool) (k, v interface{},
+	errMsg string) {
+	kv := encodeKeyVal(key, val, toHex)
+
+	var errs []string
+	decode := func(decoder scope.Decoder, b []byte, s string,
+		what string) interface{} {
+		if decoder == nil {
+			return s
+		}
+		decoded, err := decoder(b)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", what, err))
+			return s
+		}
+		return decoded
+	}
+
+	k = decode(keyDecoder, key, kv.Key, "key")
+	if val != nil {
+		v = decode(valueDecoder, val, kv.Val, "value")
+	}
+
+	return k, v, strings.Join(errs, "; ")
+}
+
+// recordValue returns the decoded key or value as a field of a record,
+// where structured values are emitted as JSON.
+func recordValue(v interface{}) interface{} {
+	switch v.(type) {
+	case string, nil:
+		return v
+	}
+	jBuf, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(jBuf)
+}
+
+// decodedKeyOnly and decodedKV are the documents of a key-value,
+// decoded by keyDecoder or valueDecoder.
+type decodedKeyOnly struct {
+	Key   interface{} `json:"k"`
+	Error string      `json:"error,omitempty"`
+}
+
+type decodedKV struct {
+	Key   interface{} `json:"k"`
+	Val   interface{} `json:"v"`
+	Error string      `json:"error,omitempty"`
+}
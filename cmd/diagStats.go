@@ -9,11 +9,11 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
-	"sort"
+	"io"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -26,78 +26,58 @@ var diagStatsCmd = &cobra.Command{
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
 		return nil
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeDiagStats(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeDiagStats(cmd.OutOrStdout(), dirs)
 	},
 }
 
-func invokeDiagStats(dirs []string) error {
-	if jsonFormat {
-		fmt.Printf("[")
-	} else {
-		emitVersion()
-		fmt.Println()
+func invokeDiagStats(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, tableOutput)
+	if err != nil {
+		return err
 	}
 
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
-		defer store.Close()
-
-		snap, err := store.Snapshot()
-		if err != nil || snap == nil {
-			continue
-		}
-
-		footer := snap.(*moss.Footer)
-		stats := make(map[string]interface{})
+	// The table, being the text output, starts with the versions
+	if selectedFormat(tableOutput) == tableOutput {
+		emitVersion(w)
+		fmt.Fprintln(w)
+	}
 
-		fetchFooterStats(footer, stats)
+	var failures storeFailures
 
-		storeStats, err := store.Stats()
-		if err != nil {
-			return fmt.Errorf("Store-Stats() failed!, err: %v", err)
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		stats, err := scope.FetchDiagStats(store)
+		if err == scope.ErrNoSnapshot {
+			return nil, nil
 		}
-
-		for k, v := range storeStats {
-			stats[k] = v
-		}
-
-		if jsonFormat {
-			jBuf, err := json.Marshal(stats)
-			if err != nil {
-				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
-			}
-			if index != 0 {
-				fmt.Printf(",")
-			}
-			fmt.Printf("{\"%s\":%s}", dir, string(jBuf))
-		} else {
-			fmt.Println(dir)
-			var keys []string
-			for k := range stats {
-				keys = append(keys, k)
-			}
-			sort.Strings(keys)
-			for _, k := range keys {
-				fmt.Printf("%35s : %v\n", k, stats[k])
-			}
-			fmt.Println()
+		return stats, err
+	}, func(dir string, val interface{}) error {
+		if val == nil {
+			return nil
 		}
+		stats := val.(map[string]interface{})
+		return r.section(dir, stats, []*record{(&record{}).addMap(stats)})
+	}, failures.report(r))
+	if err != nil {
+		return err
 	}
 
-	if jsonFormat {
-		fmt.Printf("]\n")
+	err = r.close()
+	if err != nil {
+		return err
 	}
 
-	return nil
+	return failures.err()
 }
 
 func init() {
@@ -106,4 +86,5 @@ func init() {
 	// Local flag that is intended to work with stats diag
 	diagStatsCmd.Flags().BoolVar(&jsonFormat, "json", false,
 		"Emits output in JSON")
+	diagStatsCmd.Flags().MarkDeprecated("json", "use --output json")
 }
@@ -9,12 +9,13 @@
 package cmd
 
 import (
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"strings"
+	"io"
+	"math/rand"
+	"time"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -23,117 +24,231 @@ var dumpCmd = &cobra.Command{
 	Use:   "dump",
 	Short: "Dumps key/val data in the specified store",
 	Long: `Dumps every key-value persisted in the store in JSON
-format. It has a set of options that it can used with.
+format. It has a set of options that it can used with, such as
+--decode bleve-upsidedown to decode the rows of bleve indexes,
+and --where to emit only the values matching an expression.
 For example:
 	./mossScope dump [sub-command] <path_to_store> [flag]`,
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
-		return nil
+		if dumpLimit < 0 || dumpOffset < 0 || sampleSize < 0 {
+			return usageErrorf("--limit, --offset and --sample must not " +
+				"be negative")
+		}
+		if sampleRate < 0 || sampleRate > 1 {
+			return usageErrorf("--sample-rate must be between 0 and 1")
+		}
+		if dumpFooter < 1 {
+			return usageErrorf("--footer must be at least 1")
+		}
+		if !cmd.Flags().Changed("seed") {
+			sampleSeed = time.Now().UnixNano()
+		}
+		err := checkDecodeFormat()
+		if err != nil {
+			return err
+		}
+		err = checkKeyValDecoders()
+		if err != nil {
+			return err
+		}
+		err = checkKeyFilter()
+		if err != nil {
+			return err
+		}
+		err = checkColumns()
+		if err != nil {
+			return err
+		}
+		return checkWhere()
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeDump(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeDump(cmd.OutOrStdout(), dirs)
 	},
 }
 
 var keysOnly bool
 var inHex bool
+var dumpLimit int
+var dumpOffset int
+var afterKey string
+var dumpReverse bool
+var sampleSize int
+var sampleRate float64
+var sampleSeed int64
+var dumpFooter int
+var dumpCollection string
 
-func invokeDump(dirs []string) error {
-	fmt.Printf("[")
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
-
-		snap, err := store.Snapshot()
-		if err != nil || snap == nil {
-			return fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
-		}
+func invokeDump(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, jsonOutput)
+	if err != nil {
+		return err
+	}
 
-		iter, err := snap.StartIterator(nil, nil, moss.IteratorOptions{})
-		if err != nil || iter == nil {
-			return fmt.Errorf("Snapshot-StartItr() API failed, err: %v", err)
-		}
+	var failures storeFailures
 
-		if index != 0 {
-			fmt.Printf(",")
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return dumpStore(store)
+	}, func(dir string, val interface{}) error {
+		err := r.beginList(dir)
+		if err != nil {
+			return err
 		}
-		fmt.Printf("{\"%s\":", dir)
-
-		fmt.Printf("[")
-		for err, firstDoc := error(nil), true; err == nil; err = iter.Next() {
-			var k, v []byte
-			k, v, err = iter.Current()
-			if err != nil {
-				break
-			}
-
-			if keyPrefix != "" && !strings.HasPrefix(string(k), keyPrefix) {
-				continue
-			}
-			if keysOnly {
-				err = dumpKeyVal(k, nil, inHex, &firstDoc)
-			} else {
-				err = dumpKeyVal(k, v, inHex, &firstDoc)
-			}
 
+		for _, item := range val.([]dumpItem) {
+			err = r.item(item.doc, item.rec)
 			if err != nil {
 				return err
 			}
 		}
-		fmt.Printf("]")
 
-		iter.Close()
-		snap.Close()
-		store.Close()
+		return r.endList()
+	}, failures.report(r))
+	if err != nil {
+		return err
+	}
 
-		fmt.Printf("}")
+	err = r.close()
+	if err != nil {
+		return err
 	}
-	fmt.Printf("]\n")
 
-	return nil
+	return failures.err()
 }
 
-func dumpKeyVal(key []byte, val []byte, toHex bool, firstDoc *bool) error {
-	if toHex {
-		if !*firstDoc {
-			fmt.Printf(",")
+// dumpItem is the output of a key-value, as handed to renderer.item.
+type dumpItem struct {
+	doc interface{}
+	rec *record
+}
+
+// dumpStore returns the output of the key-values of the store, which
+// is held until the outputs of the stores before it are emitted.
+func dumpStore(store *moss.Store) ([]dumpItem, error) {
+	snap, err := dumpSnapshot(store)
+	if err != nil {
+		return nil, err
+	}
+	defer snap.Close()
+
+	d, err := scope.DumpSnapshot(snap, dumpOptions())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	cols, escape := recordColumns()
+
+	var items []dumpItem
+	for d.Next() {
+		rec := d.Record()
+
+		var item dumpItem
+		if decodeFormat != "" {
+			item.doc, item.rec = decodedOutput(&record{}, rec.Key, rec.Val,
+				inHex)
+		} else if cols != nil {
+			// Only the record formats have columns
+			item.rec = columnsRecord(cols, dumpFooter, dumpCollection,
+				rec.Key, rec.Val, escape)
 		} else {
-			*firstDoc = false
+			item.doc, item.rec = keyValOutput(&record{}, rec.Key, rec.Val,
+				inHex)
 		}
-		if val == nil {
-			fmt.Printf("{\"k\":\"%s\"}", hex.EncodeToString(key))
+		items = append(items, item)
+	}
+
+	return items, d.Err()
+}
+
+// dumpSnapshot returns the snapshot to dump, being the one of the
+// --footer, or of its child collection selected by --collection. The
+// caller must close it.
+func dumpSnapshot(store *moss.Store) (moss.Snapshot, error) {
+	snap, err := scope.SnapshotAt(store, dumpFooter)
+	if err != nil {
+		return nil, err
+	}
+	if dumpCollection == "" {
+		return snap, nil
+	}
+	defer snap.Close()
+
+	child, err := snap.ChildCollectionSnapshot(dumpCollection)
+	if err != nil {
+		return nil, fmt.Errorf("Snapshot-ChildCollectionSnapshot() API "+
+			"failed, err: %v", err)
+	}
+	if child == nil {
+		return nil, fmt.Errorf("collection not found: %s", dumpCollection)
+	}
+	return child, nil
+}
+
+// dumpOptions returns the options of the key-values to dump, by the
+// key and --where filters, the sample selected by --sample and
+// --sample-rate, and the page selected by --limit, --offset,
+// --after-key and --reverse.
+func dumpOptions() scope.DumpOptions {
+	opts := scope.DumpOptions{Prefix: keyFilter.Prefix(keyPrefix),
+		KeysOnly: keysOnly, Limit: dumpLimit, Offset: dumpOffset,
+		Reverse: dumpReverse}
+	if afterKey != "" {
+		// The page continues past the key, which is excluded
+		if dumpReverse {
+			opts.End = []byte(afterKey)
 		} else {
-			fmt.Printf("{\"k\":\"%s\",\"v\":\"%s\"}",
-				hex.EncodeToString(key), hex.EncodeToString(val))
+			opts.Start = append([]byte(afterKey), 0)
 		}
-	} else {
-		jBufk, err := json.Marshal(string(key))
-		if err != nil {
-			return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
-		}
-		if !*firstDoc {
-			fmt.Printf(",")
-		} else {
-			*firstDoc = false
+	}
+	if keyFilter != nil || where != nil {
+		opts.Filter = func(rec scope.Record) bool {
+			return keyFilter.Match(rec.Key) &&
+				(where == nil || whereFilter(rec))
 		}
+	}
+	if sampleSize > 0 || sampleRate > 0 {
+		// Every store is sampled the same way with the same --seed
+		opts.Sample, opts.SampleRate = sampleSize, sampleRate
+		opts.Rand = rand.New(rand.NewSource(sampleSeed))
+	}
+	return opts
+}
+
+// keyOnly is the document of a key, when emitted without its value.
+type keyOnly struct {
+	Key string `json:"k"`
+}
+
+// keyValOutput returns the document of a key-value, along with rec
+// extended by its fields, where a nil val (keys only) is left out.
+func keyValOutput(rec *record, key []byte, val []byte,
+	toHex bool) (interface{}, *record) {
+	if keyDecoder != nil || valueDecoder != nil {
+		k, v, errMsg := decodeKeyVal(key, val, toHex)
+		rec.add("key", recordValue(k))
 		if val == nil {
-			fmt.Printf("{\"k\":%s}", string(jBufk))
-		} else {
-			jBufv, err := json.Marshal(string(val))
-			if err != nil {
-				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
-			}
-			fmt.Printf("{\"k\":%s,\"v\":%s}",
-				string(jBufk), string(jBufv))
+			return decodedKeyOnly{Key: k, Error: errMsg},
+				rec.add("error", errMsg)
 		}
+		return decodedKV{Key: k, Val: v, Error: errMsg},
+			rec.add("value", recordValue(v)).add("error", errMsg)
+	}
+
+	kv := encodeKeyVal(key, val, toHex)
+	if val == nil {
+		return keyOnly{Key: kv.Key}, rec.add("key", kv.Key)
 	}
-	return nil
+	return kv, rec.add("key", kv.Key).add("value", kv.Val)
 }
 
 func init() {
@@ -144,6 +259,43 @@ func init() {
 		"Emits keys only")
 	dumpCmd.Flags().StringVar(&keyPrefix, "key-prefix", "",
 		"Emits only keys matching this key prefix. Example --key-prefix b")
+	addKeyFilterFlags(dumpCmd)
+	dumpCmd.Flags().IntVar(&dumpLimit, "limit", 0,
+		"Emits at most this many key-values per store, 0 for no limit")
+	dumpCmd.Flags().IntVar(&dumpOffset, "offset", 0,
+		"Skips this many key-values per store before emitting")
+	dumpCmd.Flags().StringVar(&afterKey, "after-key", "",
+		"Emits the key-values after this key, such as the last key of "+
+			"the previous page (before it with --reverse)")
+	dumpCmd.Flags().BoolVar(&dumpReverse, "reverse", false,
+		"Emits the key-values in descending key order")
+	dumpCmd.Flags().IntVar(&sampleSize, "sample", 0,
+		"Emits a uniform random sample of this many key-values per store")
+	dumpCmd.Flags().Float64Var(&sampleRate, "sample-rate", 0,
+		"Emits every key-value with this probability, such as 0.001")
+	dumpCmd.Flags().Int64Var(&sampleSeed, "seed", 0,
+		"Seeds --sample and --sample-rate, for repeatable samples "+
+			"(default: random)")
+	dumpCmd.Flags().IntVar(&dumpFooter, "footer", 1,
+		"Dumps the snapshot of this footer, 1 for the latest")
+	dumpCmd.Flags().StringVar(&dumpCollection, "collection", "",
+		"Dumps this child collection rather than the top-level one")
 	dumpCmd.Flags().BoolVar(&inHex, "hex", false,
 		"Emits output in hex")
+	dumpCmd.PersistentFlags().StringVar(&keyDecoderSpec, "key-decoder", "",
+		"Decodes the keys, such as: json, raw, hex, base64, snappy+json")
+	dumpCmd.PersistentFlags().StringVar(&valueDecoderSpec, "value-decoder",
+		"", "Decodes the values, such as: json, raw, hex, base64, snappy, "+
+			"gzip, msgpack, cbor, proto-descriptor:<file>[:<message>]")
+	dumpCmd.Flags().StringVar(&columnsSpec, "columns", "",
+		"Emits these columns in the record output formats, such as csv "+
+			"and tsv, out of: key, value, key_len, val_len, footer "+
+			"(--footer), collection (--collection), error "+
+			"(default: key,value)")
+	dumpCmd.Flags().StringVar(&decodeFormat, "decode", "",
+		"Decodes the key-values of the store, supported: bleve-upsidedown")
+	dumpCmd.Flags().StringVar(&whereExpr, "where", "",
+		"Emits only the key-values whose values (decoded as JSON, or by "+
+			"--value-decoder) match the expression, such as: "+
+			"'.type == \"user\" && .age > 30'")
 }
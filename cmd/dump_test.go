@@ -12,13 +12,13 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"reflect"
 	"strings"
 	"testing"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 )
 
 var itemCount = 10
@@ -85,30 +85,16 @@ func cleanup(dir string, store *moss.Store, coll moss.Collection) {
 func dumpHelper(t *testing.T, onlyKeys bool) (output string) {
 	dir, store, coll := setup(t, true)
 
-	old := os.Stdout // keep backup of the real stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	var buf bytes.Buffer
 
 	keysOnly = onlyKeys
 	dirs := []string{dir}
-	err := invokeDump(dirs)
+	err := invokeDump(&buf, dirs)
 	if err != nil {
 		t.Error(err)
 	}
 
-	outC := make(chan string)
-	// copy the output in a separate goroutine so dump wouldn't block
-	// indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
-	}()
-
-	// back to normal state
-	w.Close()
-	os.Stdout = old // restoring the real stdout
-	out := <-outC
+	out := buf.String()
 
 	cleanup(dir, store, coll)
 
@@ -214,31 +200,17 @@ func TestDumpKey(t *testing.T) {
 	dir, store, coll := setup(t, true)
 
 	for i := 0; i < itemCount; i++ {
-		old := os.Stdout // keep backup of the real stdout
-		r, w, _ := os.Pipe()
-		os.Stdout = w
+		var buf bytes.Buffer
 
 		allVersions = false
 		key := fmt.Sprintf("key%d", i)
 		dirs := []string{dir}
-		err := invokeKey(key, dirs)
+		err := invokeKey(&buf, key, dirs)
 		if err != nil {
 			t.Error(err)
 		}
 
-		outC := make(chan string)
-		// copy the output in a separate goroutine so dump wouldn't
-		// block indefinitely
-		go func() {
-			var buf bytes.Buffer
-			io.Copy(&buf, r)
-			outC <- buf.String()
-		}()
-
-		// back to normal state
-		w.Close()
-		os.Stdout = old // restoring the real stdout
-		out := <-outC
+		out := buf.String()
 
 		var m []interface{}
 		json.Unmarshal([]byte(out), &m)
@@ -271,6 +243,142 @@ func TestDumpKey(t *testing.T) {
 	cleanup(dir, store, coll)
 }
 
+func TestDumpKeys(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	keys, err := readKeys(strings.NewReader("6b657932\n\r\n6e6f6b6579\r\n"),
+		"hex")
+	if err != nil || len(keys) != 2 || string(keys[0]) != "key2" {
+		t.Fatalf("Unexpected keys: %q, err: %v", keys, err)
+	}
+
+	_, err = readKeys(strings.NewReader("key2\n!!\n"), "base64")
+	if exitCode(err) != exitUsage {
+		t.Errorf("Expected an invalid key to be rejected, err: %v", err)
+	}
+
+	var buf bytes.Buffer
+	err = invokeKeys(&buf, keys, []string{dir})
+	if exitCode(err) != exitNotFound {
+		t.Errorf("Expected the missing key to be reported, err: %v", err)
+	}
+
+	var m []map[string][]map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &m)
+	if len(m) != 1 || len(m[0][dir]) != 2 {
+		t.Fatalf("Unexpected output: %s", buf.String())
+	}
+
+	entries := m[0][dir]
+	if entries[0]["k"] != "key2" || entries[0]["found"] != true ||
+		entries[0]["v"] != "val2" {
+		t.Errorf("Unexpected found key: %v", entries[0])
+	}
+	if entries[1]["k"] != "nokey" || entries[1]["found"] != false ||
+		entries[1]["v"] != nil {
+		t.Errorf("Unexpected missing key: %v", entries[1])
+	}
+
+	buf.Reset()
+	err = invokeKeys(&buf, keys[:1], []string{dir})
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDumpKeyExplain(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	explainKey = true
+	defer func() {
+		explainKey = false
+	}()
+
+	var buf bytes.Buffer
+	err := invokeKey(&buf, "key3", []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var m []map[string][]map[string]interface{}
+	json.Unmarshal(buf.Bytes(), &m)
+	if len(m) != 1 || len(m[0][dir]) != 1 {
+		t.Fatalf("Unexpected output: %s", buf.String())
+	}
+
+	op := m[0][dir][0]
+	if op["segment"] != float64(0) || op["op"] != "set" ||
+		op["visible"] != true || op["val_len"] != float64(len("val3")) ||
+		!strings.HasPrefix(op["file"].(string), dir) {
+		t.Errorf("Unexpected op: %v", op)
+	}
+
+	buf.Reset()
+	err = invokeKey(&buf, "missing", []string{dir})
+	if exitCode(err) != exitNotFound {
+		t.Errorf("Expected a missing key to be not found, err: %v", err)
+	}
+}
+
+func TestDumpDecode(t *testing.T) {
+	decodeFormat = "bleve-upsidedown"
+	defer func() {
+		decodeFormat = ""
+	}()
+
+	doc, rec := decodedOutput(&record{}, []byte("v"), []byte{7}, false)
+	jBuf, _ := json.Marshal(doc)
+	if string(jBuf) != `{"k":"v","row":{"type":"version","version":7}}` ||
+		rec.vals[1] != `{"type":"version","version":7}` {
+		t.Errorf("Unexpected decoded output: %s, %v", jBuf, rec.vals)
+	}
+
+	doc, _ = decodedOutput(&record{}, []byte("key0"), []byte("val0"), false)
+	jBuf, _ = json.Marshal(doc)
+	if !strings.Contains(string(jBuf), `"v":"val0","error":"unknown row type`) {
+		t.Errorf("Expected the key-value to be emitted as is: %s", jBuf)
+	}
+
+	decodeFormat = "xml"
+	if exitCode(checkDecodeFormat()) != exitUsage {
+		t.Errorf("Expected an unsupported decoder to be rejected")
+	}
+}
+
+func TestDumpValueDecoder(t *testing.T) {
+	defer func() {
+		keyDecoderSpec, valueDecoderSpec = "", ""
+		checkKeyValDecoders()
+	}()
+
+	keyDecoderSpec, valueDecoderSpec = "hex", "json"
+	err := checkKeyValDecoders()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, rec := keyValOutput(&record{}, []byte("k"), []byte(`{"a":1}`), false)
+	jBuf, _ := json.Marshal(doc)
+	if string(jBuf) != `{"k":"6b","v":{"a":1}}` ||
+		!reflect.DeepEqual(rec.vals, []interface{}{"6b", `{"a":1}`, ""}) {
+		t.Errorf("Unexpected decoded output: %s, %v", jBuf, rec.vals)
+	}
+
+	// Values that fail to decode are emitted as strings
+	doc, _ = keyValOutput(&record{}, []byte("k"), []byte("val"), false)
+	jBuf, _ = json.Marshal(doc)
+	if !strings.HasPrefix(string(jBuf), `{"k":"6b","v":"val","error":"value: `) {
+		t.Errorf("Unexpected output of a failed decoding: %s", jBuf)
+	}
+
+	valueDecoderSpec = "json+xml"
+	if exitCode(checkKeyValDecoders()) != exitUsage {
+		t.Errorf("Expected an unsupported decoder to be rejected")
+	}
+}
+
 func TestDumpKeyAllVersions(t *testing.T) {
 	// Creates
 	_, store, coll := setup(t, true)
@@ -280,31 +388,17 @@ func TestDumpKeyAllVersions(t *testing.T) {
 	dir, store, coll := setup(t, false)
 
 	for i := 0; i < itemCount; i++ {
-		old := os.Stdout // keep backup of the real stdout
-		r, w, _ := os.Pipe()
-		os.Stdout = w
+		var buf bytes.Buffer
 
 		allVersions = true
 		key := fmt.Sprintf("key%d", i)
 		dirs := []string{dir}
-		err := invokeKey(key, dirs)
+		err := invokeKey(&buf, key, dirs)
 		if err != nil {
 			t.Error(err)
 		}
 
-		outC := make(chan string)
-		// copy the output in a separate goroutine so dump wouldn't
-		// block indefinitely
-		go func() {
-			var buf bytes.Buffer
-			io.Copy(&buf, r)
-			outC <- buf.String()
-		}()
-
-		// back to normal state
-		w.Close()
-		os.Stdout = old // restoring the real stdout
-		out := <-outC
+		out := buf.String()
 
 		var m []interface{}
 		json.Unmarshal([]byte(out), &m)
@@ -320,24 +414,29 @@ func TestDumpKeyAllVersions(t *testing.T) {
 
 		kvs := storeData[dir].([]interface{})
 
-		if len(kvs) != 2 {
-			t.Errorf("Incorrect number of entries: %d!", len(kvs))
+		// The same value in both footers is collapsed into one entry
+		if len(kvs) != 1 {
+			t.Fatalf("Incorrect number of entries: %d!", len(kvs))
 		}
 
 		val := fmt.Sprintf("val%d", i)
-		for j := 0; j < len(kvs); j++ {
-			entry := kvs[j].(map[string]interface{})
-			if strings.Compare(key, entry["k"].(string)) != 0 {
-				t.Errorf("Mismatch in key [%s != %s]!",
-					key, entry["k"].(string))
-			}
-			if strings.Compare(val, entry["v"].(string)) != 0 {
-				t.Errorf("Mismatch in value [%s != %s]!",
-					val, entry["v"].(string))
-			}
+		entry := kvs[0].(map[string]interface{})
+		if strings.Compare(key, entry["k"].(string)) != 0 {
+			t.Errorf("Mismatch in key [%s != %s]!",
+				key, entry["k"].(string))
+		}
+		if strings.Compare(val, entry["v"].(string)) != 0 {
+			t.Errorf("Mismatch in value [%s != %s]!",
+				val, entry["v"].(string))
+		}
+		if entry["footer"] != float64(1) || entry["since_footer"] != float64(2) ||
+			entry["state"] != "present" {
+			t.Errorf("Unexpected history entry: %v", entry)
 		}
 	}
 
+	allVersions = false
+
 	cleanup(dir, store, coll)
 }
 
@@ -349,30 +448,16 @@ func TestDumpAllFooters(t *testing.T) {
 	// Footer 2 (2 segments)
 	dir, store, coll := setup(t, false)
 
-	old := os.Stdout // keep backup of the real stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	var buf bytes.Buffer
 
 	allAvailable = true
 	dirs := []string{dir}
-	err := invokeFooter(dirs)
+	err := invokeFooter(&buf, dirs)
 	if err != nil {
 		t.Error(err)
 	}
 
-	outC := make(chan string)
-	// copy the output in a separate goroutine so dump wouldn't
-	// block indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
-	}()
-
-	// back to normal state
-	w.Close()
-	os.Stdout = old // restoring the real stdout
-	out := <-outC
+	out := buf.String()
 
 	var m []interface{}
 	json.Unmarshal([]byte(out), &m)
@@ -432,3 +517,271 @@ func TestDumpAllFooters(t *testing.T) {
 
 	cleanup(dir, store, coll)
 }
+
+func TestDumpWhere(t *testing.T) {
+	defer func() {
+		whereExpr = ""
+		checkWhere()
+	}()
+
+	keyPrefix = ""
+	whereExpr = `$key == "key3" || $key >= "key8"`
+	err := checkWhere()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := dumpHelper(t, false)
+
+	var m []map[string][]keyVal
+	json.Unmarshal([]byte(out), &m)
+	if len(m) != 1 || len(m[0]["testDumpStore"]) != 3 {
+		t.Fatalf("Expected 3 matching key-values: %s", out)
+	}
+	for i, key := range []string{"key3", "key8", "key9"} {
+		if m[0]["testDumpStore"][i].Key != key {
+			t.Errorf("Expected %s, got: %+v", key, m[0]["testDumpStore"][i])
+		}
+	}
+
+	// Values are decoded as JSON
+	whereExpr = `.type == "user" && .age > 30`
+	err = checkWhere()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !whereFilter(scope.Record{Key: []byte("k"),
+		Val: []byte(`{"type":"user","age":31}`)}) ||
+		whereFilter(scope.Record{Key: []byte("k"),
+			Val: []byte(`{"type":"user","age":30}`)}) ||
+		whereFilter(scope.Record{Key: []byte("k"), Val: []byte("val")}) {
+		t.Errorf("Unexpected matches of %s", whereExpr)
+	}
+
+	whereExpr = `.type ==`
+	if exitCode(checkWhere()) != exitUsage {
+		t.Errorf("Expected an invalid expression to be rejected")
+	}
+}
+
+func TestDumpKeyFilters(t *testing.T) {
+	defer func() {
+		keyRegex, keyGlob, invertKeys = "", "", false
+		checkKeyFilter()
+	}()
+
+	tests := []struct {
+		regex, glob string
+		invert      bool
+		expect      []string
+	}{
+		{`^key[2-4]$`, "", false, []string{"key2", "key3", "key4"}},
+		{`[0-7]`, "", true, []string{"key8", "key9"}},
+		{"", "key?", false, []string{"key0", "key1", "key2", "key3",
+			"key4", "key5", "key6", "key7", "key8", "key9"}},
+		{"", "key[!0-8]", false, []string{"key9"}},
+		{"", "k*[1-9]", true, []string{"key0"}},
+	}
+
+	keyPrefix = ""
+	for _, test := range tests {
+		keyRegex, keyGlob, invertKeys = test.regex, test.glob, test.invert
+		err := checkKeyFilter()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := dumpHelper(t, true)
+
+		var m []map[string][]keyVal
+		json.Unmarshal([]byte(out), &m)
+		var keys []string
+		if len(m) == 1 {
+			for _, kv := range m[0]["testDumpStore"] {
+				keys = append(keys, kv.Key)
+			}
+		}
+		if !reflect.DeepEqual(keys, test.expect) {
+			t.Errorf("Expected %v for %+v, got: %v", test.expect, test, keys)
+		}
+	}
+
+	keyRegex, keyGlob = "key", "key"
+	if exitCode(checkKeyFilter()) != exitUsage {
+		t.Errorf("Expected --key-regex and --key-glob to be exclusive")
+	}
+	keyRegex, keyGlob = "(", ""
+	if exitCode(checkKeyFilter()) != exitUsage {
+		t.Errorf("Expected an invalid regex to be rejected")
+	}
+}
+
+func TestDumpPages(t *testing.T) {
+	defer func() {
+		dumpLimit, dumpOffset, afterKey, dumpReverse = 0, 0, "", false
+	}()
+
+	tests := []struct {
+		limit, offset int
+		after         string
+		reverse       bool
+		expect        []string
+	}{
+		{3, 0, "", false, []string{"key0", "key1", "key2"}},
+		{3, 0, "key2", false, []string{"key3", "key4", "key5"}},
+		{2, 1, "key7", false, []string{"key9"}},
+		{2, 0, "", true, []string{"key9", "key8"}},
+		{2, 0, "key8", true, []string{"key7", "key6"}},
+		{0, 8, "", true, []string{"key1", "key0"}},
+	}
+
+	keyPrefix = ""
+	for _, test := range tests {
+		dumpLimit, dumpOffset = test.limit, test.offset
+		afterKey, dumpReverse = test.after, test.reverse
+
+		out := dumpHelper(t, true)
+
+		var m []map[string][]keyVal
+		json.Unmarshal([]byte(out), &m)
+		var keys []string
+		if len(m) == 1 {
+			for _, kv := range m[0]["testDumpStore"] {
+				keys = append(keys, kv.Key)
+			}
+		}
+		if !reflect.DeepEqual(keys, test.expect) {
+			t.Errorf("Expected %v for %+v, got: %v", test.expect, test, keys)
+		}
+	}
+}
+
+func TestDumpSample(t *testing.T) {
+	defer func() {
+		sampleSize, sampleSeed = 0, 0
+	}()
+
+	keyPrefix = ""
+	sampleSize, sampleSeed = 4, 7
+
+	var samples []string
+	for i := 0; i < 2; i++ {
+		out := dumpHelper(t, false)
+
+		var m []map[string][]keyVal
+		json.Unmarshal([]byte(out), &m)
+		if len(m) != 1 || len(m[0]["testDumpStore"]) != 4 {
+			t.Fatalf("Expected a sample of 4 key-values: %s", out)
+		}
+		samples = append(samples, out)
+	}
+
+	if samples[0] != samples[1] {
+		t.Errorf("Expected the same sample from the same seed: %s, %s",
+			samples[0], samples[1])
+	}
+}
+
+// persistCollections persists a footer into the store at dir, setting
+// the key to val in the top-level collection and in the child
+// collection.
+func persistCollections(t *testing.T, dir, child string, key, val []byte) {
+	store, err := moss.OpenStore(dir, moss.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	coll, _ := moss.NewCollection(moss.CollectionOptions{})
+	coll.Start()
+	defer coll.Close()
+
+	batch, err := coll.NewBatch(1, len(key)+len(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Close()
+	batch.Set(key, val)
+
+	childBatch, err := batch.NewChildCollectionBatch(child,
+		moss.BatchOptions{TotalOps: 1, TotalKeyValBytes: len(key) + len(val)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childBatch.Set(key, append([]byte(child+":"), val...))
+
+	err = coll.ExecuteBatch(batch, moss.WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := coll.Snapshot()
+	defer ss.Close()
+
+	_, err = store.Persist(ss, moss.StorePersistOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpFooterCollection(t *testing.T) {
+	dir := "testDumpCollectionsStore"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+	defer os.RemoveAll(dir)
+
+	persistCollections(t, dir, "docs", []byte("k"), []byte("v0"))
+	persistCollections(t, dir, "docs", []byte("k"), []byte("v1"))
+
+	defer resetDumpFlags()()
+	defer func() {
+		outputFormat, columnsSpec = "", ""
+		checkColumns()
+	}()
+
+	outputFormat, columnsSpec = csvOutput, "key,value,footer,collection"
+	err := checkColumns()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		footer     int
+		collection string
+		expect     string
+	}{
+		{1, "", dir + ",k,v1,1,"},
+		{2, "", dir + ",k,v0,2,"},
+		{1, "docs", dir + ",k,docs:v1,1,docs"},
+		{2, "docs", dir + ",k,docs:v0,2,docs"},
+	}
+	for _, test := range tests {
+		dumpFooter, dumpCollection = test.footer, test.collection
+
+		var buf bytes.Buffer
+		err = invokeDump(&buf, []string{dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expect := "store,key,value,footer,collection\n" + test.expect + "\n"
+		if buf.String() != expect {
+			t.Errorf("Unexpected output of footer %d, collection %q: %s",
+				test.footer, test.collection, buf.String())
+		}
+	}
+
+	for _, test := range []struct {
+		footer     int
+		collection string
+	}{{3, ""}, {1, "missing"}} {
+		dumpFooter, dumpCollection = test.footer, test.collection
+
+		var buf bytes.Buffer
+		err = invokeDump(&buf, []string{dir})
+		if err == nil {
+			t.Errorf("Expected footer %d, collection %q to fail: %s",
+				test.footer, test.collection, buf.String())
+		}
+	}
+}
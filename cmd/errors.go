@@ -0,0 +1,97 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+// Exit codes of mossScope, so that scripts can tell failures apart.
+const (
+	exitOK         = 0
+	exitFailure    = 1 // Any failure not covered below.
+	exitUsage      = 2 // Invalid command, arguments or flags.
+	exitStoreOpen  = 3 // The store directory could not be accessed.
+	exitCorruption = 4 // The store's files could not be loaded.
+	exitNotFound   = 5 // The requested key or item does not exist.
+)
+
+// exitError associates an exit code with an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+func usageErrorf(format string, a ...interface{}) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, a...)}
+}
+
+func notFoundErrorf(format string, a ...interface{}) error {
+	return &exitError{code: exitNotFound, err: fmt.Errorf(format, a...)}
+}
+
+// exitCode maps err to the exit code that mossScope terminates with.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var failures *storeFailures
+	if errors.As(err, &failures) {
+		return failures.code()
+	}
+
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+
+	var openErr *scope.OpenError
+	if errors.As(err, &openErr) {
+		if openErr.Corrupt {
+			return exitCorruption
+		}
+		return exitStoreOpen
+	}
+
+	// Raised by cobra while resolving the sub-command
+	if strings.HasPrefix(err.Error(), "unknown command") {
+		return exitUsage
+	}
+
+	return exitFailure
+}
+
+// emitError writes err to w, as a JSON object when asJSON is set.
+func emitError(w io.Writer, err error, code int, asJSON bool) {
+	if !asJSON {
+		fmt.Fprintf(w, "Error: %v\n", err)
+		return
+	}
+
+	jBuf, _ := json.Marshal(struct {
+		Error string `json:"error"`
+		Code  int    `json:"code"`
+	}{err.Error(), code})
+	fmt.Fprintf(w, "%s\n", string(jBuf))
+}
@@ -0,0 +1,92 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+func executeHelper(args ...string) (code int, stdout, stderr string) {
+	var outBuf, errBuf bytes.Buffer
+	RootCmd.SetOut(&outBuf)
+	RootCmd.SetErr(&errBuf)
+	RootCmd.SetArgs(args)
+	defer func() {
+		RootCmd.SetOut(nil)
+		RootCmd.SetErr(nil)
+		RootCmd.SetArgs(nil)
+		jsonFormat = false
+		outputFormat = ""
+	}()
+
+	code = execute(RootCmd)
+	return code, outBuf.String(), errBuf.String()
+}
+
+func TestExitCodes(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	tests := []struct {
+		args   []string
+		expect int
+	}{
+		{[]string{"dump", dir}, exitOK},
+		{[]string{"dump", "key", "key1", dir}, exitOK},
+		{[]string{"dump", "key", "missing", dir}, exitNotFound},
+		{[]string{"dump"}, exitUsage},
+		{[]string{"dump", "--bogus", dir}, exitUsage},
+		{[]string{"bogus"}, exitUsage},
+		{[]string{"stats", "diag", "nonExistentStore"}, exitStoreOpen},
+	}
+
+	for _, test := range tests {
+		code, _, stderr := executeHelper(test.args...)
+		if code != test.expect {
+			t.Errorf("Expected exit code %d for %v, but got: %d (%s)",
+				test.expect, test.args, code, stderr)
+		}
+		if (code == exitOK) != (stderr == "") {
+			t.Errorf("Unexpected stderr for %v: %q", test.args, stderr)
+		}
+	}
+
+	if exitCode(&scope.OpenError{Corrupt: true}) != exitCorruption {
+		t.Errorf("Expected a corrupt store to map to exitCorruption")
+	}
+	if exitCode(fmt.Errorf("wrapped: %w",
+		notFoundErrorf("missing"))) != exitNotFound {
+		t.Errorf("Expected wrapped errors to keep their exit code")
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	code, _, stderr := executeHelper("stats", "diag", "--json",
+		"nonExistentStore")
+	if code != exitStoreOpen {
+		t.Errorf("Unexpected exit code: %d", code)
+	}
+
+	var m map[string]interface{}
+	err := json.Unmarshal([]byte(stderr), &m)
+	if err != nil {
+		t.Fatalf("Expected a JSON error, but got: %q", stderr)
+	}
+
+	if m["code"] != float64(exitStoreOpen) ||
+		!strings.Contains(m["error"].(string), "Moss-OpenStore()") {
+		t.Errorf("Unexpected JSON error: %v", m)
+	}
+}
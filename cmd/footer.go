@@ -11,8 +11,10 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -26,72 +28,79 @@ format, (optionally all) here's a sample command:
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
 		return nil
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeFooter(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeFooter(cmd.OutOrStdout(), dirs)
 	},
 }
 
 var allAvailable bool
 
-func invokeFooter(dirs []string) error {
-	fmt.Printf("[")
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
+func invokeFooter(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, jsonOutput)
+	if err != nil {
+		return err
+	}
 
-		currSnap, err := store.Snapshot()
-		if err != nil || currSnap == nil {
-			return fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
-		}
+	var failures storeFailures
 
-		if index != 0 {
-			fmt.Printf(",")
-		}
-		fmt.Printf("{\"%s\":[", dir)
-
-		if allAvailable {
-			for {
-				jBuf, err := json.Marshal(currSnap.(*moss.Footer))
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		// The footers are only valid while the store is open, so
+		// they are gathered in their JSON form along with their records
+		var footers []footerOutput
+		err := scope.WalkFooters(store, allAvailable,
+			func(id int, footer *moss.Footer) error {
+				jBuf, err := json.Marshal(footer)
 				if err != nil {
 					return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
 				}
+				footers = append(footers, footerOutput{doc: jBuf,
+					rec: (&record{}).
+						add("footer", fmt.Sprintf("Footer_%d", id)).
+						addMap(scope.GetFooterStats(footer).Map())})
+				return nil
+			})
+		return footers, err
+	}, func(dir string, val interface{}) error {
+		err := r.beginList(dir)
+		if err != nil {
+			return err
+		}
 
-				fmt.Printf("%s", string(jBuf))
-
-				prevSnap, err := store.SnapshotPrevious(currSnap)
-				currSnap.Close()
-				currSnap = prevSnap
-
-				if err != nil || currSnap == nil {
-					fmt.Printf("")
-					break
-				}
-				fmt.Printf(",")
-			}
-		} else {
-			jBuf, err := json.Marshal(currSnap.(*moss.Footer))
+		for _, footer := range val.([]footerOutput) {
+			err = r.item(footer.doc, footer.rec)
 			if err != nil {
-				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+				return err
 			}
-
-			fmt.Printf("%s", string(jBuf))
-
-			currSnap.Close()
 		}
-		fmt.Printf("]}")
 
-		store.Close()
+		return r.endList()
+	}, failures.report(r))
+	if err != nil {
+		return err
 	}
-	fmt.Printf("]\n")
 
-	return nil
+	err = r.close()
+	if err != nil {
+		return err
+	}
+
+	return failures.err()
+}
+
+// footerOutput is the document and the record of a footer.
+type footerOutput struct {
+	doc json.RawMessage
+	rec *record
 }
 
 func init() {
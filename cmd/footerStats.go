@@ -9,10 +9,11 @@
 package cmd
 
 import (
-	"encoding/json"
 	"fmt"
+	"io"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -26,115 +27,64 @@ collected from the latest footer of the store.
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
 		return nil
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeFooterStats(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeFooterStats(cmd.OutOrStdout(), dirs)
 	},
 }
 
 var getAll bool
 
-func invokeFooterStats(dirs []string) error {
-	if jsonFormat {
-		fmt.Printf("[")
+func invokeFooterStats(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, tableOutput)
+	if err != nil {
+		return err
 	}
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
-		defer store.Close()
-
-		currSnap, err := store.Snapshot()
-		if err != nil || currSnap == nil {
-			continue
-		}
-
-		type statsType map[string]interface{}
-		footerStats := make(map[string]statsType)
-		id := 1
-
-		for {
-
-			footer := currSnap.(*moss.Footer)
-			footerID := fmt.Sprintf("Footer_%d", id)
-			footerStats[footerID] = make(statsType)
-
-			fetchFooterStats(footer, footerStats[footerID])
-
-			if !getAll {
-				break
-			}
 
-			prevSnap, err := store.SnapshotPrevious(currSnap)
-			currSnap.Close()
-			currSnap = prevSnap
-			id++
+	var failures storeFailures
 
-			if err != nil || currSnap == nil {
-				break
-			}
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		stats, err := scope.FetchFooterStats(store, getAll)
+		if err == scope.ErrNoSnapshot {
+			return nil, nil
 		}
-
-		if jsonFormat {
-			jBuf, err := json.Marshal(footerStats)
-			if err != nil {
-				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
-			}
-			if index != 0 {
-				fmt.Printf(",")
-			}
-			fmt.Printf("{\"%s\":%s}", dir, string(jBuf))
-		} else {
-			fmt.Println(dir)
-			for f, fstats := range footerStats {
-				fmt.Printf("  %s\n", f)
-				for k, v := range fstats {
-					fmt.Printf("%25s : %v\n", k, v)
-				}
-			}
-			fmt.Println()
+		return stats, err
+	}, func(dir string, val interface{}) error {
+		if val == nil {
+			return nil
 		}
-	}
-
-	if jsonFormat {
-		fmt.Printf("]\n")
-	}
 
-	return nil
-}
+		stats := val.([]scope.FooterStats)
+		footerStats := make(map[string]scope.FooterStats)
+		recs := make([]*record, 0, len(stats))
+		for i, fstats := range stats {
+			footer := fmt.Sprintf("Footer_%d", i+1)
+			footerStats[footer] = fstats
+			recs = append(recs,
+				(&record{}).add("footer", footer).addMap(fstats.Map()))
+		}
 
-func fetchFooterStats(footer *moss.Footer, stats map[string]interface{}) {
-	if footer == nil {
-		return
+		return r.section(dir, footerStats, recs)
+	}, failures.report(r))
+	if err != nil {
+		return err
 	}
 
-	var totalOpsSet uint64
-	var totalOpsDel uint64
-	var totalKeyBytes uint64
-	var totalValBytes uint64
-	segmentBytes := make([]uint64, 0, len(footer.SegmentLocs))
-
-	for i := range footer.SegmentLocs {
-		sloc := &footer.SegmentLocs[i]
-
-		totalOpsSet += sloc.TotOpsSet
-		totalOpsDel += sloc.TotOpsDel
-		totalKeyBytes += sloc.TotKeyByte
-		totalValBytes += sloc.TotValByte
-		segmentBytes = append(segmentBytes, sloc.TotKeyByte+sloc.TotValByte)
+	err = r.close()
+	if err != nil {
+		return err
 	}
 
-	stats["segment_bytes"] = segmentBytes
-	stats["num_segments"] = len(footer.SegmentLocs)
-	stats["total_ops_set"] = totalOpsSet
-	stats["total_ops_del"] = totalOpsDel
-	stats["total_key_bytes"] = totalKeyBytes
-	stats["total_val_bytes"] = totalValBytes
+	return failures.err()
 }
 
 func init() {
@@ -145,4 +95,5 @@ func init() {
 		"Fetches stats from all available footers (Footer_1 is latest)")
 	footerStatsCmd.Flags().BoolVar(&jsonFormat, "json", false,
 		"Emits output in JSON")
+	footerStatsCmd.Flags().MarkDeprecated("json", "use --output json")
 }
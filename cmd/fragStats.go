@@ -9,10 +9,10 @@
 package cmd
 
 import (
-	"encoding/json"
-	"fmt"
+	"io"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -23,121 +23,59 @@ var fragStatsCmd = &cobra.Command{
 	Long: `This command dumps the key-val sizes and directory size info,
 and alongside that estimates the fragmentation levels. This data
 could assist with decisions around invoking manual compaction.
+With --accurate, reads every entry of the segments of the latest
+footer to account for the versions shadowed by newer segments and
+the tombstones, along with the bytes that a full compaction would
+reclaim.
 	./mossScope stats frag <path_to_store>`,
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
 		return nil
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeFragStats(args)
-	},
-}
-
-func invokeFragStats(dirs []string) error {
-	if jsonFormat {
-		fmt.Printf("[")
-	}
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
-		defer store.Close()
-
-		statsMap := make(map[string]uint64)
-
-		err = fetchFragStats(store, statsMap)
+		dirs, err := storeArgs(args)
 		if err != nil {
 			return err
 		}
-
-		if jsonFormat {
-			jBuf, err := json.Marshal(statsMap)
-			if err != nil {
-				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
-			}
-			if index != 0 {
-				fmt.Printf(",")
-			}
-			fmt.Printf("{\"%s\":", dir)
-			fmt.Printf("%s}", string(jBuf))
-		} else {
-			fmt.Println(dir)
-			for k, v := range statsMap {
-				fmt.Printf("%25s : %v\n", k, v)
-			}
-			fmt.Println()
-		}
-	}
-
-	if jsonFormat {
-		fmt.Printf("]\n")
-	}
-
-	return nil
+		return invokeFragStats(cmd.OutOrStdout(), dirs)
+	},
 }
 
-func fetchFragStats(store *moss.Store, stats map[string]uint64) error {
-	if store == nil {
-		return nil
-	}
-
-	stats["data_bytes"] = 0
-	stats["dir_size"] = 0
-	stats["fragmentation_bytes"] = 0
-	stats["fragmentation_percent"] = 0
-
-	currSnap, err := store.Snapshot()
-	if err != nil || currSnap == nil {
-		return nil
-	}
-
-	footer := currSnap.(*moss.Footer)
-
-	// Acquire key, val bytes from all segments of latest footer
-	for i := range footer.SegmentLocs {
-		sloc := &footer.SegmentLocs[i]
+var fragAccurate bool
 
-		stats["data_bytes"] += sloc.TotKeyByte
-		stats["data_bytes"] += sloc.TotValByte
+func invokeFragStats(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, tableOutput)
+	if err != nil {
+		return err
 	}
 
-	var prevSnap moss.Snapshot
-
-	for {
-		// header signature
-		stats["data_bytes"] += moss.HeaderLength()
-
-		// footer signature
-		footer = currSnap.(*moss.Footer)
-		stats["data_bytes"] += footer.Length()
-
-		prevSnap, err = store.SnapshotPrevious(currSnap)
-		currSnap.Close()
-		currSnap = prevSnap
+	var failures storeFailures
 
-		if err != nil || currSnap == nil {
-			break
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		if fragAccurate {
+			return scope.FetchAccurateFragStats(dir, store)
 		}
+		return scope.FetchFragStats(store)
+	}, func(dir string, val interface{}) error {
+		stats := val.(*scope.FragStats)
+		return r.section(dir, stats,
+			[]*record{(&record{}).addMap(stats.Map())})
+	}, failures.report(r))
+	if err != nil {
+		return err
 	}
 
-	sstats, err := store.Stats()
+	err = r.close()
 	if err != nil {
-		return fmt.Errorf("Store-Stats() failed!, err: %v", err)
+		return err
 	}
 
-	stats["dir_size"] = sstats["num_bytes_used_disk"].(uint64)
-
-	stats["fragmentation_bytes"] = stats["dir_size"] - stats["data_bytes"]
-	stats["fragmentation_percent"] = uint64(100 *
-		((float64(stats["fragmentation_bytes"])) /
-			float64(stats["dir_size"])))
-
-	return nil
+	return failures.err()
 }
 
 func init() {
@@ -146,4 +84,7 @@ func init() {
 	// Local flag that is intended to work with stats fragmentation
 	fragStatsCmd.Flags().BoolVar(&jsonFormat, "json", false,
 		"Emits output in JSON")
+	fragStatsCmd.Flags().MarkDeprecated("json", "use --output json")
+	fragStatsCmd.Flags().BoolVar(&fragAccurate, "accurate", false,
+		"Accounts for the shadowed versions and tombstones in the segments")
 }
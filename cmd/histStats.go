@@ -10,10 +10,10 @@ package cmd
 
 import (
 	"fmt"
-	"strings"
+	"io"
 
-	"github.com/couchbase/ghistogram"
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -27,68 +27,93 @@ available from the store.
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("at least one path is required")
+			return usageErrorf("at least one path is required")
 		}
-		return nil
+		return checkKeyFilter()
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeHistStats(args)
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeHistStats(cmd.OutOrStdout(), dirs)
 	},
 }
 
-func invokeHistStats(dirs []string) error {
-	for _, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
+func invokeHistStats(w io.Writer, dirs []string) error {
+	// Without a selected output format, the histograms are drawn
+	var r renderer
+	if outputFormat != "" {
+		var err error
+		r, err = newRenderer(w, outputFormat)
+		if err != nil {
+			return err
+		}
+	}
+
+	var failures storeFailures
+
+	err := forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return scope.FetchHistograms(store, keyPrefix, keyFilter)
+	}, func(dir string, val interface{}) error {
+		h := val.(*scope.Histograms)
+
+		if r == nil {
+			fmt.Fprintf(w, "\"%s\"\n", dir)
+			fmt.Fprintln(w, (h.KeySizes.EmitGraph(nil, nil)).String())
+			fmt.Fprintln(w, (h.ValSizes.EmitGraph(nil, nil)).String())
+			return nil
 		}
 
-		snap, err := store.Snapshot()
-		if err != nil || snap == nil {
-			return fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+		keySizes := toKeyHistogram(h.KeySizes)
+		valSizes := toKeyHistogram(h.ValSizes)
+
+		return r.section(dir, map[string]keyHistogram{
+			"key_sizes": keySizes,
+			"val_sizes": valSizes,
+		}, append(histRecords("key_sizes", keySizes),
+			histRecords("val_sizes", valSizes)...))
+	}, func(dir string, err error) error {
+		failures.add(dir, err)
+		if r != nil {
+			return r.storeError(dir, err)
 		}
+		fmt.Fprintf(w, "\"%s\"\nERROR: %v\n\n", dir, err)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
 
-		iter, err := snap.StartIterator(nil, nil, moss.IteratorOptions{})
-		if err != nil || iter == nil {
-			return fmt.Errorf("Snaphot-StartItr() API failed, err: %v", err)
+	if r != nil {
+		err = r.close()
+		if err != nil {
+			return err
 		}
+	}
 
-		keySizes := ghistogram.NewNamedHistogram("KeySizes(B) ", 10, 4, 4)
-		valSizes := ghistogram.NewNamedHistogram("ValSizes(B) ", 10, 4, 4)
-
-		for {
-			k, v, err := iter.Current()
-			if err != nil {
-				break
-			}
-
-			if len(keyPrefix) != 0 {
-				// A specific keyPrefix has been requested
-				if strings.HasPrefix(string(k), keyPrefix) {
-					keySizes.Add(uint64(len(k)), 1)
-					valSizes.Add(uint64(len(v)), 1)
-				}
-			} else {
-				keySizes.Add(uint64(len(k)), 1)
-				valSizes.Add(uint64(len(v)), 1)
-			}
-
-			if iter.Next() == moss.ErrIteratorDone {
-				break
-			}
+	return failures.err()
+}
+
+// histRecords returns a record per non-empty bucket of the histogram.
+func histRecords(name string, h keyHistogram) []*record {
+	var recs []*record
+	for i, count := range h.Counts {
+		if count == 0 {
+			continue
 		}
 
-		fmt.Printf("\"%s\"\n", dir)
-		fmt.Println((keySizes.EmitGraph(nil, nil)).String())
-		fmt.Println((valSizes.EmitGraph(nil, nil)).String())
+		bucket := fmt.Sprintf("%d+", h.Ranges[i])
+		if i+1 < len(h.Ranges) {
+			bucket = fmt.Sprintf("%d-%d", h.Ranges[i], h.Ranges[i+1])
+		}
 
-		iter.Close()
-		snap.Close()
-		store.Close()
+		recs = append(recs, (&record{}).add("histogram", name).
+			add("bucket", bucket).add("count", count))
 	}
-
-	return nil
+	return recs
 }
 
 func init() {
@@ -97,4 +122,5 @@ func init() {
 	// Local flag that is intended to work with stats hist
 	histCmd.Flags().StringVar(&keyPrefix, "key-prefix", "",
 		"Emits histograms of keys that begin with the specified prefix")
+	addKeyFilterFlags(histCmd)
 }
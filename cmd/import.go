@@ -12,40 +12,41 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"math"
-	"os"
-	"sync"
 
-	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
 // importCmd represents the import command
 var importCmd = &cobra.Command{
 	Use:   "import",
-	Short: "Imports the docs from the JSON file into the store",
+	Short: "Imports the docs from the JSON, CSV or TSV file into the store",
 	Long: `Imports the key-values from the specified file (required to be in
-JSON format - array of maps - mapping a string to string only),
-taking into account - batch size, which can be specified by an
-optional flag, into the store. For example:
+JSON format - array of maps - mapping a string to string only, unless
+--format csv or tsv is specified), taking into account - batch size,
+which can be specified by an optional flag, into the store. For example:
 	./mossScope import <path_to_store> <flag(s)>
 Order of execution (if all flags included): stdin < cmdline < file
 Expected JSON file format:
-	[{"k" : "key0", "v" : "val0"}, {"k" : "key1", "v" : "val1"}]`,
+	[{"k" : "key0", "v" : "val0"}, {"k" : "key1", "v" : "val1"}]
+With --format csv or tsv, the key and value are read from the columns
+selected by --key-col and --val-col, and the operation (set or del)
+from the one selected by --op-col, if any.`,
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 1 {
-			return fmt.Errorf("one path needed")
+			return usageErrorf("one path needed")
 		} else if len(args) != 1 {
-			return fmt.Errorf("only one path allowed")
+			return usageErrorf("only one path allowed")
 		}
 
 		if len(fileInput) == 0 && len(jsonInput) == 0 && !readFromStdin {
-			return fmt.Errorf("at least one input source required")
+			return usageErrorf("at least one input source required")
 		}
 
-		return nil
+		return checkImportFormat()
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
@@ -68,27 +69,40 @@ Expected JSON file format:
 			fromCla = jsonInput
 		}
 
-		if readFromStdin {
-			reader := bufio.NewReader(os.Stdin)
+		if readFromStdin && importFormat != jsonOutput {
+			// CSV and TSV are read up to the end of stdin
+			var input []byte
+			input, err = ioutil.ReadAll(cmd.InOrStdin())
+			if err != nil {
+				return fmt.Errorf("Error in reading from stdin, err: %v", err)
+			}
+			fromStdin = string(input)
+		} else if readFromStdin {
+			reader := bufio.NewReader(cmd.InOrStdin())
 			fromStdin, err = reader.ReadString('\n')
 			if err != nil {
 				return fmt.Errorf("Error in reading from stdin, err: %v", err)
 			}
 		}
 
-		err = invokeImport(fromStdin, args[0])
+		load := invokeImport
+		if importFormat != jsonOutput {
+			load = invokeImportDelimited
+		}
+
+		err = load(cmd.OutOrStdout(), fromStdin, args[0])
 		if err != nil {
-			return fmt.Errorf("Import from STDIN failed; err: %v", err)
+			return fmt.Errorf("Import from STDIN failed; err: %w", err)
 		}
 
-		err = invokeImport(fromCla, args[0])
+		err = load(cmd.OutOrStdout(), fromCla, args[0])
 		if err != nil {
-			return fmt.Errorf("Import from CMD-LINE failed; err: %v", err)
+			return fmt.Errorf("Import from CMD-LINE failed; err: %w", err)
 		}
 
-		err = invokeImport(fromFile, args[0])
+		err = load(cmd.OutOrStdout(), fromFile, args[0])
 		if err != nil {
-			return fmt.Errorf("Import from FILE failed; err: %v", err)
+			return fmt.Errorf("Import from FILE failed; err: %w", err)
 		}
 
 		return nil
@@ -105,7 +119,7 @@ type keyVal struct {
 	Val string `json:"v"`
 }
 
-func invokeImport(jsonStr string, dir string) error {
+func invokeImport(w io.Writer, jsonStr string, dir string) error {
 	if len(jsonStr) == 0 {
 		return nil
 	}
@@ -115,181 +129,29 @@ func invokeImport(jsonStr string, dir string) error {
 	var data []keyVal
 	err := json.Unmarshal(input, &data)
 	if err != nil {
-		fmt.Printf("Expected format:")
-		fmt.Printf("[{\"k\" : \"key0\", \"v\" : \"val0\"}, " +
+		fmt.Fprintf(w, "Expected format:")
+		fmt.Fprintf(w, "[{\"k\" : \"key0\", \"v\" : \"val0\"}, "+
 			"{\"k\" : \"key1\", \"v\" : \"val1\"}]\n")
 		return fmt.Errorf("Json-UnMarshal() failed!, err: %v", err)
 	}
 
 	if len(data) == 0 {
-		fmt.Println("Empty JSON file, no key-values to load!")
+		fmt.Fprintln(w, "Empty JSON file, no key-values to load!")
 		return nil
 	}
 
-	if _, err = os.Stat(dir); os.IsNotExist(err) {
-		// Create the directory (specified) if it does not already exist
-		os.Mkdir(dir, 0777)
-	}
-
-	var m sync.Mutex
-	var waitingForCleanCh chan struct{}
-
-	var store *moss.Store
-	var coll moss.Collection
-	var stats *moss.CollectionStats
-
-	co := moss.CollectionOptions{
-		OnEvent: func(event moss.Event) {
-			if event.Kind == moss.EventKindPersisterProgress {
-				stats, err = coll.Stats()
-				if err == nil && stats.CurDirtyOps <= 0 &&
-					stats.CurDirtyBytes <= 0 && stats.CurDirtySegments <= 0 {
-					m.Lock()
-					if waitingForCleanCh != nil {
-						waitingForCleanCh <- struct{}{}
-						waitingForCleanCh = nil
-					}
-					m.Unlock()
-				}
-			}
-		},
-	}
-
-	store, coll, err = moss.OpenStoreCollection(dir,
-		moss.StoreOptions{CollectionOptions: co},
-		moss.StorePersistOptions{})
-	if err != nil || store == nil {
-		return fmt.Errorf("Moss-OpenStoreCollection failed, err: %v", err)
+	recs := make([]scope.Record, 0, len(data))
+	for i := range data {
+		recs = append(recs, scope.Record{Key: []byte(data[i].Key),
+			Val: []byte(data[i].Val)})
 	}
 
-	defer store.Close()
-	defer coll.Close()
-
-	ch := make(chan struct{}, 1)
-
-	numBatches := 1
-	itemsWritten := 0
-
-	if batchSize <= 0 {
-		// All key-values in a single batch
-
-		sizeOfBatch := 0
-		for i := 0; i < len(data); i++ {
-			// Get the size of the batch
-			sizeOfBatch += len(data[i].Key) + len(data[i].Val)
-		}
-
-		if sizeOfBatch == 0 {
-			return nil
-		}
-
-		batch, err := coll.NewBatch(len(data), sizeOfBatch)
-		if err != nil {
-			return fmt.Errorf("Collection-NewBatch() failed, err: %v", err)
-		}
-
-		var kbuf, vbuf []byte
-
-		for i := 0; i < len(data); i++ {
-			if len(data[i].Key) == 0 {
-				continue
-			}
-
-			kbuf, err = batch.Alloc(len(data[i].Key))
-			if err != nil {
-				return fmt.Errorf("Batch-Alloc() failed, err: %v", err)
-			}
-			vbuf, err = batch.Alloc(len(data[i].Val))
-			if err != nil {
-				return fmt.Errorf("Batch-Alloc() failed, err: %v", err)
-			}
-
-			copy(kbuf, data[i].Key)
-			copy(vbuf, data[i].Val)
-
-			err = batch.AllocSet(kbuf, vbuf)
-			if err != nil {
-				return fmt.Errorf("Batch-AllocSet() failed, err: %v", err)
-			}
-			itemsWritten++
-		}
-
-		m.Lock()
-		waitingForCleanCh = ch
-		m.Unlock()
-
-		err = coll.ExecuteBatch(batch, moss.WriteOptions{})
-		if err != nil {
-			return fmt.Errorf("Collection-ExecuteBatch() failed, err: %v", err)
-		}
-
-	} else {
-
-		numBatches = int(math.Ceil(float64(len(data)) / float64(batchSize)))
-		cursor := 0
-
-		for i := 0; i < numBatches; i++ {
-			sizeOfBatch := 0
-			numItemsInBatch := 0
-			for j := cursor; j < cursor+batchSize; j++ {
-				if j >= len(data) {
-					break
-				}
-				sizeOfBatch += len(data[j].Key) + len(data[j].Val)
-				numItemsInBatch++
-			}
-			if sizeOfBatch == 0 {
-				continue
-			}
-
-			batch, err := coll.NewBatch(numItemsInBatch, sizeOfBatch)
-			if err != nil {
-				return fmt.Errorf("Collection-NewBatch() failed, err: %v", err)
-			}
-
-			var kbuf, vbuf []byte
-
-			for j := 0; j < numItemsInBatch; j++ {
-				if len(data[cursor].Key) == 0 {
-					cursor++
-					continue
-				}
-
-				kbuf, err = batch.Alloc(len(data[cursor].Key))
-				if err != nil {
-					return fmt.Errorf("Batch-Alloc() failed, err: %v", err)
-				}
-				vbuf, err = batch.Alloc(len(data[cursor].Val))
-				if err != nil {
-					return fmt.Errorf("Batch-Alloc() failed, err: %v", err)
-				}
-
-				copy(kbuf, data[cursor].Key)
-				copy(vbuf, data[cursor].Val)
-
-				err = batch.AllocSet(kbuf, vbuf)
-				if err != nil {
-					return fmt.Errorf("Batch-AllocSet() failed, err: %v", err)
-				}
-				cursor++
-				itemsWritten++
-			}
-
-			m.Lock()
-			waitingForCleanCh = ch
-			m.Unlock()
-
-			err = coll.ExecuteBatch(batch, moss.WriteOptions{})
-			if err != nil {
-				return fmt.Errorf("Collection-ExecuteBatch() failed, err: %v",
-					err)
-			}
-		}
+	itemsWritten, numBatches, err := scope.Import(dir, recs, batchSize)
+	if err != nil {
+		return err
 	}
 
-	<-ch
-
-	fmt.Printf("DONE! .. Wrote %d key-values, in %d batch(es)\n",
+	fmt.Fprintf(w, "DONE! .. Wrote %d key-values, in %d batch(es)\n",
 		itemsWritten, numBatches)
 
 	return nil
@@ -306,5 +168,26 @@ func init() {
 	importCmd.Flags().StringVar(&jsonInput, "json", "",
 		"Reads JSON content from command-line")
 	importCmd.Flags().BoolVar(&readFromStdin, "stdin", false,
-		"Reads JSON content from stdin (Enter to submit)")
+		"Reads JSON content from stdin (Enter to submit), or CSV or TSV "+
+			"content up to the end of stdin")
+	importCmd.Flags().StringVar(&importFormat, "format", jsonOutput,
+		"Format of the content: json, csv or tsv")
+	importCmd.Flags().StringVar(&keyCol, "key-col", "key",
+		"Name (in the header) or number (from 1) of the CSV or TSV column "+
+			"of the keys, the first column without a header")
+	importCmd.Flags().StringVar(&valCol, "val-col", "value",
+		"Name (in the header) or number (from 1) of the CSV or TSV column "+
+			"of the values, the second column without a header")
+	importCmd.Flags().StringVar(&opCol, "op-col", "",
+		"Name (in the header) or number (from 1) of the CSV or TSV column "+
+			"of the operations: set (or empty) or del")
+	importCmd.Flags().StringVar(&importHeader, "header", "auto",
+		"Whether the first CSV or TSV row is a header: yes, no or auto "+
+			"(if it names the columns selected by name)")
+	importCmd.Flags().StringVar(&importKeyEncoding, "key-encoding", "raw",
+		"Encoding of the CSV or TSV keys: raw, hex, base64 or escaped "+
+			"(\\x-prefixed hex, as emitted by dump)")
+	importCmd.Flags().StringVar(&importValEncoding, "val-encoding", "raw",
+		"Encoding of the CSV or TSV values: raw, hex, base64 or escaped "+
+			"(\\x-prefixed hex, as emitted by dump)")
 }
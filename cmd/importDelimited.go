@@ -0,0 +1,256 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+// The input formats of import, besides jsonOutput.
+const (
+	csvInput = csvOutput
+	tsvInput = tsvOutput
+)
+
+var importFormat string
+var keyCol string
+var valCol string
+var opCol string
+var importHeader string
+var importKeyEncoding string
+var importValEncoding string
+
+func checkImportFormat() error {
+	switch importFormat {
+	case jsonOutput:
+		return nil
+	case csvInput, tsvInput:
+	default:
+		return usageErrorf("unsupported input format: %s, supported: "+
+			"json, csv, tsv", importFormat)
+	}
+
+	if len(jsonInput) > 0 {
+		return usageErrorf("--json does not apply to --format %s",
+			importFormat)
+	}
+	switch importHeader {
+	case "auto", "yes", "no":
+	default:
+		return usageErrorf("unsupported --header: %s, supported: "+
+			"auto, yes, no", importHeader)
+	}
+	for _, enc := range []string{importKeyEncoding, importValEncoding} {
+		if _, ok := keyDecoderFuncs[enc]; !ok {
+			return usageErrorf("unsupported encoding: %s", enc)
+		}
+	}
+	return nil
+}
+
+// invokeImportDelimited imports the key-values of the CSV or TSV input
+// into the store at dir.
+func invokeImportDelimited(w io.Writer, input string, dir string) error {
+	if len(input) == 0 {
+		return nil
+	}
+
+	rows, err := readRows(input, importFormat)
+	if err != nil {
+		return err
+	}
+
+	recs, err := delimitedRecords(rows)
+	if err != nil {
+		return err
+	}
+
+	if len(recs) == 0 {
+		fmt.Fprintln(w, "Empty input, no key-values to load!")
+		return nil
+	}
+
+	itemsWritten, numBatches, err := scope.Import(dir, recs, batchSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "DONE! .. Wrote %d key-values, in %d batch(es)\n",
+		itemsWritten, numBatches)
+
+	return nil
+}
+
+// readRows returns the rows of the CSV or TSV input, where TSV fields
+// are unescaped as emitted by the tsv output format.
+func readRows(input string, format string) ([][]string, error) {
+	if format == csvInput {
+		r := csv.NewReader(strings.NewReader(input))
+		r.FieldsPerRecord = -1
+		rows, err := r.ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("CSV-Read() failed, err: %v", err)
+		}
+		return rows, nil
+	}
+
+	var rows [][]string
+	for _, line := range strings.Split(input, "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) == 0 {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		for i := range fields {
+			fields[i] = tsvUnescaper.Replace(fields[i])
+		}
+		rows = append(rows, fields)
+	}
+	return rows, nil
+}
+
+// tsvUnescaper reverts tsvEscaper.
+var tsvUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n",
+	`\r`, "\r")
+
+// delimitedRecords returns the records of the rows, by the columns
+// selected by --key-col, --val-col and --op-col, and the header row
+// if any.
+func delimitedRecords(rows [][]string) ([]scope.Record, error) {
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	specs := []string{keyCol, valCol}
+	if opCol != "" {
+		specs = append(specs, opCol)
+	}
+
+	header := importHeader == "yes"
+	if importHeader == "auto" {
+		// The first row is a header if it names every named column,
+		// and there are columns selected by name
+		named, found := 0, 0
+		for _, spec := range specs {
+			if _, err := strconv.Atoi(spec); err != nil {
+				named++
+				if columnIndex(rows[0], spec) >= 0 {
+					found++
+				}
+			}
+		}
+		header = named > 0 && found == named
+	}
+
+	cols := make([]int, len(specs))
+	for i, spec := range specs {
+		n, err := strconv.Atoi(spec)
+		switch {
+		case err == nil && n >= 1:
+			cols[i] = n - 1
+		case err == nil:
+			return nil, usageErrorf("invalid column: %d, columns are "+
+				"numbered from 1", n)
+		case header && columnIndex(rows[0], spec) >= 0:
+			cols[i] = columnIndex(rows[0], spec)
+		case !header && i < 2 && spec == defaultImportCols[i]:
+			// Without a header, the key and value default to the
+			// first and second columns
+			cols[i] = i
+		case !header:
+			return nil, usageErrorf("column %s not found, as the input "+
+				"has no header", spec)
+		default:
+			return nil, usageErrorf("column %s not found in the header", spec)
+		}
+	}
+
+	if header {
+		rows = rows[1:]
+	}
+
+	keyDecode := keyDecoderFuncs[importKeyEncoding]
+	valDecode := keyDecoderFuncs[importValEncoding]
+
+	recs := make([]scope.Record, 0, len(rows))
+	for i, row := range rows {
+		line := i + 1
+		if header {
+			line++
+		}
+
+		field := func(col int) (string, error) {
+			if col >= len(row) {
+				return "", fmt.Errorf("row %d has no column %d", line, col+1)
+			}
+			return row[col], nil
+		}
+
+		var rec scope.Record
+
+		if opCol != "" {
+			op, err := field(cols[2])
+			if err != nil {
+				return nil, err
+			}
+			switch strings.ToLower(op) {
+			case "", "set":
+			case "del", "delete":
+				rec.Del = true
+			default:
+				return nil, fmt.Errorf("row %d: unsupported operation: %s, "+
+					"supported: set, del", line, op)
+			}
+		}
+
+		k, err := field(cols[0])
+		if err != nil {
+			return nil, err
+		}
+		rec.Key, err = keyDecode(k)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: invalid key: %v", line, err)
+		}
+
+		if !rec.Del {
+			v, err := field(cols[1])
+			if err != nil {
+				return nil, err
+			}
+			rec.Val, err = valDecode(v)
+			if err != nil {
+				return nil, fmt.Errorf("row %d: invalid value: %v", line, err)
+			}
+		}
+
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// defaultImportCols are the default --key-col and --val-col.
+var defaultImportCols = []string{"key", "value"}
+
+// columnIndex returns the index of the named column in the header, or
+// -1 if there is none.
+func columnIndex(header []string, name string) int {
+	for i, col := range header {
+		if strings.TrimSpace(col) == name {
+			return i
+		}
+	}
+	return -1
+}
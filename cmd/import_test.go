@@ -11,11 +11,13 @@ package cmd
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 )
 
 func importHelper(t *testing.T, batchsize int) {
@@ -33,31 +35,15 @@ func importHelper(t *testing.T, batchsize int) {
 
 	tempDir := "testImportStore"
 
-	// Prevent the command from writing anything to stdout
-	old := os.Stdout // keep backup of the real stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	// Captures the output of the command, which is not verified
+	var buf bytes.Buffer
 
 	batchSize = batchsize
-	err := invokeImport(jsonText, tempDir)
+	err := invokeImport(&buf, jsonText, tempDir)
 	if err != nil {
 		t.Error(err)
 	}
 
-	outC := make(chan string)
-	// copy the output in a separate goroutine so dump wouldn't
-	// block indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
-	}()
-
-	// back to normal state
-	w.Close()
-	os.Stdout = old // restoring the real stdout
-	<-outC
-
 	defer os.RemoveAll(tempDir)
 
 	store, err := moss.OpenStore(tempDir, moss.StoreOptions{})
@@ -96,3 +82,177 @@ func TestImport(t *testing.T) {
 func TestImportWithBatchSize(t *testing.T) {
 	importHelper(t, 3)
 }
+
+// setImportFlags sets the flags of import with --format csv or tsv,
+// along with the defaults of the other ones.
+func setImportFlags(format string, cols ...string) {
+	importFormat, importHeader = format, "auto"
+	importKeyEncoding, importValEncoding = "raw", "raw"
+	keyCol, valCol, opCol = "key", "value", ""
+	if len(cols) > 0 {
+		keyCol, valCol = cols[0], cols[1]
+	}
+	if len(cols) > 2 {
+		opCol = cols[2]
+	}
+}
+
+func TestDelimitedRecords(t *testing.T) {
+	set := func(k, v string) scope.Record {
+		return scope.Record{Key: []byte(k), Val: []byte(v)}
+	}
+	del := func(k string) scope.Record {
+		return scope.Record{Key: []byte(k), Del: true}
+	}
+
+	tests := []struct {
+		format string
+		cols   []string
+		header string
+		keyEnc string
+		input  string
+		exp    []scope.Record
+		err    bool
+	}{
+		{format: "csv", input: "key,value\nk0,v0\nk1,\"v,1\"\n",
+			exp: []scope.Record{set("k0", "v0"), set("k1", "v,1")}},
+		// Without a header, the key and value are the first columns
+		{format: "csv", input: "k0,v0\nk1,v1\n",
+			exp: []scope.Record{set("k0", "v0"), set("k1", "v1")}},
+		{format: "csv", cols: []string{"1", "2"}, header: "yes",
+			input: "a,b\nk0,v0\n",
+			exp:   []scope.Record{set("k0", "v0")}},
+		{format: "csv", cols: []string{"id", "doc", "op"},
+			input: "op,doc,id\nset,v0,k0\ndel,,k1\n,v2,k2\n",
+			exp:   []scope.Record{set("k0", "v0"), del("k1"), set("k2", "v2")}},
+		{format: "csv", cols: []string{"2", "3"}, input: "x,k0,v0\n",
+			exp: []scope.Record{set("k0", "v0")}},
+		{format: "tsv", input: "key\tvalue\nk\\t0\tv\\n0\\\\\n",
+			exp: []scope.Record{set("k\t0", "v\n0\\")}},
+		{format: "tsv", keyEnc: "escaped", input: "\\x00ff\tv0\nk1\tv1\n",
+			exp: []scope.Record{set("\x00\xff", "v0"), set("k1", "v1")}},
+		{format: "csv", keyEnc: "hex", input: "6b30,v0\n",
+			exp: []scope.Record{set("k0", "v0")}},
+		{format: "csv", input: "", exp: nil},
+		{format: "csv", cols: []string{"id", "value"}, input: "k0,v0\n",
+			err: true},
+		{format: "csv", cols: []string{"0", "1"}, input: "k0,v0\n", err: true},
+		{format: "csv", input: "k0\n", err: true},
+		{format: "csv", cols: []string{"1", "2", "3"}, input: "k0,v0,put\n",
+			err: true},
+		{format: "csv", keyEnc: "hex", input: "zz,v0\n", err: true},
+		{format: "csv", input: "k0,\"v0\n", err: true},
+	}
+
+	for i, test := range tests {
+		setImportFlags(test.format, test.cols...)
+		if test.header != "" {
+			importHeader = test.header
+		}
+		if test.keyEnc != "" {
+			importKeyEncoding = test.keyEnc
+		}
+
+		rows, err := readRows(test.input, test.format)
+		var recs []scope.Record
+		if err == nil {
+			recs, err = delimitedRecords(rows)
+		}
+		if test.err {
+			if err == nil {
+				t.Errorf("Test %d: expected an error, got: %v", i, recs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+			continue
+		}
+		if len(recs) == 0 && len(test.exp) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(recs, test.exp) {
+			t.Errorf("Test %d: expected: %v, got: %v", i, test.exp, recs)
+		}
+	}
+}
+
+func TestImportDelimited(t *testing.T) {
+	tempDir := "testImportDelimitedStore"
+	defer os.RemoveAll(tempDir)
+
+	var buf bytes.Buffer
+	batchSize = 2
+
+	setImportFlags("csv")
+	err := invokeImportDelimited(&buf,
+		"key,value\nkey0,val0\nkey1,val1\nkey2,val2\n", tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setImportFlags("tsv", "k", "v", "op")
+	err = invokeImportDelimited(&buf, "op\tk\tv\ndel\tkey1\t\n"+
+		"set\tkey2\tval\\t2\n", tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := moss.OpenStore(tempDir, moss.StoreOptions{})
+	if err != nil || store == nil {
+		t.Fatalf("Expected OpenStore() to work!")
+	}
+	defer store.Close()
+
+	snapshot, _ := store.Snapshot()
+	defer snapshot.Close()
+
+	exp := map[string]string{"key0": "val0", "key1": "", "key2": "val\t2"}
+	for k, v := range exp {
+		val, err := snapshot.Get([]byte(k), moss.ReadOptions{})
+		if err != nil {
+			t.Errorf("Expected Snapshot-Get() to succeed!")
+		}
+		if string(val) != v || (v == "" && val != nil) {
+			t.Errorf("Expected %s: %q, got: %q", k, v, val)
+		}
+	}
+}
+
+func TestImportDelimitedStdin(t *testing.T) {
+	tempDir := "testImportStdinStore"
+	defer os.RemoveAll(tempDir)
+
+	// The flags that are not passed keep their values of the other tests
+	setImportFlags("csv")
+	batchSize = 0
+	RootCmd.SetIn(strings.NewReader("key,value\nkey0,val0\nkey1,val1\n"))
+	defer func() {
+		RootCmd.SetIn(nil)
+		readFromStdin = false
+		batchSize = 0
+		setImportFlags(jsonOutput)
+	}()
+
+	code, _, stderr := executeHelper("import", tempDir, "--stdin",
+		"--format", "csv")
+	if code != exitOK {
+		t.Fatalf("Expected import to succeed, got: %d (%s)", code, stderr)
+	}
+
+	store, err := moss.OpenStore(tempDir, moss.StoreOptions{})
+	if err != nil || store == nil {
+		t.Fatalf("Expected OpenStore() to work!")
+	}
+	defer store.Close()
+
+	snapshot, _ := store.Snapshot()
+	defer snapshot.Close()
+
+	for _, k := range []string{"key0", "key1"} {
+		val, err := snapshot.Get([]byte(k), moss.ReadOptions{})
+		if err != nil || string(val) != "val"+k[3:] {
+			t.Errorf("Expected %s: val%s, got: %q (%v)", k, k[3:], val, err)
+		}
+	}
+}
@@ -9,9 +9,10 @@
 package cmd
 
 import (
-	"fmt"
+	"io"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 	"github.com/spf13/cobra"
 )
 
@@ -21,89 +22,220 @@ var keyCmd = &cobra.Command{
 	Short: "Dumps the key and value of the specified key",
 	Long: `Dumps the key and value information of the requested key
 from the latest snapshot in which it is available in JSON
-format. For example:
+format. With --all-versions, emits the history of the key through
+all the footers instead, as runs of footers in which the key was
+present, deleted or absent. With --explain, emits the operations
+on the key in the segments of the latest footer, from the newest,
+marking the ones visible to reads. For example:
 	./mossScope dump key <keyname> <path_to_store> [flag]`,
 
 	PreRunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) < 2 {
-			return fmt.Errorf("a keyname along with at least one path " +
+			return usageErrorf("a keyname along with at least one path " +
 				"are required")
 		}
-		return nil
+		if allVersions && explainKey {
+			return usageErrorf("--all-versions and --explain are exclusive")
+		}
+		return checkKeyValDecoders()
 	},
 
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return invokeKey(args[0], args[1:])
+		dirs, err := storeArgs(args[1:])
+		if err != nil {
+			return err
+		}
+		return invokeKey(cmd.OutOrStdout(), args[0], dirs)
 	},
 }
 
 var allVersions bool
+var explainKey bool
 
-func invokeKey(keyname string, dirs []string) error {
-	fmt.Printf("[")
-	for index, dir := range dirs {
-		store, err := moss.OpenStore(dir, readOnlyMode)
-		if err != nil || store == nil {
-			return fmt.Errorf("Moss-OpenStore() API failed, err: %v", err)
-		}
+func invokeKey(w io.Writer, keyname string, dirs []string) error {
+	r, err := newRenderer(w, jsonOutput)
+	if err != nil {
+		return err
+	}
+
+	found := 0
+	var failures storeFailures
 
-		snap, err := store.Snapshot()
-		if err != nil || snap == nil {
-			return fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		if explainKey {
+			return scope.ExplainKey(dir, store, []byte(keyname))
+		}
+		if allVersions {
+			return scope.FetchKeyHistory(store, []byte(keyname))
+		}
+		return scope.FetchKeyVersions(store, []byte(keyname), false)
+	}, func(dir string, val interface{}) error {
+		if explanation, ok := val.(*scope.KeyExplanation); ok {
+			if len(explanation.Ops) == 0 {
+				return nil
+			}
+			found++
+			return emitKeyExplanation(r, dir, explanation)
 		}
 
-		currSnapshot := snap
-		val, err := currSnapshot.Get([]byte(keyname), moss.ReadOptions{})
-		if err == nil && val != nil {
-			if index != 0 {
-				fmt.Printf(",")
+		if history, ok := val.([]scope.KeyHistoryEntry); ok {
+			if len(history) == 1 && history[0].State == scope.KeyAbsent {
+				return nil
 			}
-			fmt.Printf("{\"%s\":[", dir)
-			firstKey := true
+			found++
+			return emitKeyHistory(r, dir, []byte(keyname), history)
+		}
+
+		versions := val.([]scope.KeyVersion)
+		if len(versions) == 0 {
+			return nil
+		}
+		found++
 
-			err = dumpKeyVal([]byte(keyname), val, inHex, &firstKey)
+		err := r.beginList(dir)
+		if err != nil {
+			return err
+		}
+
+		for _, version := range versions {
+			err = r.item(keyValOutput(
+				(&record{}).add("footer", version.Footer),
+				[]byte(keyname), version.Val, inHex))
 			if err != nil {
 				return err
 			}
-
-			if allVersions {
-				for {
-					prevSnapshot, err := store.SnapshotPrevious(currSnapshot)
-					currSnapshot.Close()
-					currSnapshot = prevSnapshot
-
-					if err != nil || currSnapshot == nil {
-						break
-					}
-
-					val, err := currSnapshot.Get([]byte(keyname),
-						moss.ReadOptions{})
-					if err == nil && val != nil {
-						err = dumpKeyVal([]byte(keyname), val, inHex, &firstKey)
-						if err != nil {
-							return err
-						}
-					}
-				}
-			}
-			fmt.Printf("]}")
 		}
 
-		snap.Close()
-		store.Close()
+		return r.endList()
+	}, failures.report(r))
+	if err != nil {
+		return err
+	}
+
+	err = r.close()
+	if err != nil {
+		return err
+	}
 
+	if failures.err() != nil {
+		return failures.err()
+	}
+
+	if found == 0 {
+		return notFoundErrorf("key not found: %s", keyname)
 	}
-	fmt.Printf("]\n")
 
 	return nil
 }
 
+// keyHistoryOutput is the document of a run of footers in the history
+// of a key, where the value is left out unless the key is present.
+type keyHistoryOutput struct {
+	Footer      int         `json:"footer"`
+	SinceFooter int         `json:"since_footer"`
+	Offset      int64       `json:"offset"`
+	State       string      `json:"state"`
+	Key         interface{} `json:"k"`
+	Val         interface{} `json:"v,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// keyHistoryDoc returns the document of an entry of the history of the
+// key, as emitted by dump key --all-versions and served by serve.
+func keyHistoryDoc(key []byte, entry scope.KeyHistoryEntry,
+	toHex bool) keyHistoryOutput {
+	k, v, errMsg := decodeKeyVal(key, entry.Val, toHex)
+	return keyHistoryOutput{Footer: entry.Footer,
+		SinceFooter: entry.SinceFooter, Offset: entry.Offset,
+		State: string(entry.State), Key: k, Val: v, Error: errMsg}
+}
+
+func emitKeyHistory(r renderer, dir string, key []byte,
+	history []scope.KeyHistoryEntry) error {
+	err := r.beginList(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range history {
+		doc := keyHistoryDoc(key, entry, inHex)
+		rec := (&record{}).add("footer", doc.Footer).
+			add("since_footer", doc.SinceFooter).
+			add("offset", doc.Offset).
+			add("state", doc.State).
+			add("key", recordValue(doc.Key))
+		if doc.Val != nil {
+			rec.add("value", recordValue(doc.Val))
+		} else {
+			rec.add("value", "")
+		}
+
+		err = r.item(doc, rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.endList()
+}
+
+// keyOpOutput is the document of an operation on a key, as persisted
+// in a segment of a footer.
+type keyOpOutput struct {
+	File         string `json:"file"`
+	Footer       int    `json:"footer"`
+	FooterOffset int64  `json:"footer_offset"`
+	Segment      int    `json:"segment"`
+	NumSegments  int    `json:"num_segments"`
+	Operation    string `json:"op"`
+	Offset       int64  `json:"offset"`
+	FileOffset   int64  `json:"file_offset"`
+	ValLen       int    `json:"val_len"`
+	Visible      bool   `json:"visible"`
+}
+
+func emitKeyExplanation(r renderer, dir string,
+	explanation *scope.KeyExplanation) error {
+	err := r.beginList(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, op := range explanation.Ops {
+		doc := keyOpOutput{File: explanation.File, Footer: explanation.Footer,
+			FooterOffset: explanation.FooterOffset, Segment: op.Segment,
+			NumSegments: explanation.NumSegments, Operation: op.Operation,
+			Offset: op.Offset, FileOffset: op.FileOffset, ValLen: op.ValLen,
+			Visible: op.Visible}
+		rec := (&record{}).add("file", doc.File).
+			add("footer", doc.Footer).
+			add("footer_offset", doc.FooterOffset).
+			add("segment", doc.Segment).
+			add("num_segments", doc.NumSegments).
+			add("op", doc.Operation).
+			add("offset", doc.Offset).
+			add("file_offset", doc.FileOffset).
+			add("val_len", doc.ValLen).
+			add("visible", doc.Visible)
+
+		err = r.item(doc, rec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.endList()
+}
+
 func init() {
 	dumpCmd.AddCommand(keyCmd)
 
 	// Local flags that are intended to work with dump key
 	keyCmd.Flags().BoolVar(&allVersions, "all-versions", false,
-		"Emits all the available versions of the key")
+		"Emits the history of the key through all the available footers")
+	keyCmd.Flags().BoolVar(&explainKey, "explain", false,
+		"Emits the segments of the latest footer that hold the key")
 	keyCmd.Flags().BoolVar(&inHex, "hex", false,
 		"Emits output in hex")
 }
@@ -0,0 +1,57 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+var keyRegex string
+var keyGlob string
+var invertKeys bool
+
+// keyFilter is built from --key-regex or --key-glob, and is nil when
+// neither is set.
+var keyFilter *scope.KeyFilter
+
+func checkKeyFilter() error {
+	keyFilter = nil
+
+	var err error
+	switch {
+	case keyRegex != "" && keyGlob != "":
+		return usageErrorf("--key-regex and --key-glob are mutually exclusive")
+	case keyRegex != "":
+		keyFilter, err = scope.CompileKeyRegex(keyRegex, invertKeys)
+		if err != nil {
+			return usageErrorf("invalid --key-regex: %v", err)
+		}
+	case keyGlob != "":
+		keyFilter, err = scope.CompileKeyGlob(keyGlob, invertKeys)
+		if err != nil {
+			return usageErrorf("invalid --key-glob: %v", err)
+		}
+	case invertKeys:
+		return usageErrorf("--invert requires --key-regex or --key-glob")
+	}
+	return nil
+}
+
+// addKeyFilterFlags adds the flags of the key filter to the command.
+func addKeyFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&keyRegex, "key-regex", "",
+		"Selects only keys matching this regular expression, "+
+			"example: --key-regex '^user::[0-9]+$'")
+	cmd.Flags().StringVar(&keyGlob, "key-glob", "",
+		"Selects only keys matching this glob pattern, "+
+			"example: --key-glob 'user::*'")
+	cmd.Flags().BoolVar(&invertKeys, "invert", false,
+		"Selects the keys not matching --key-regex or --key-glob instead")
+}
@@ -0,0 +1,223 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+// keysCmd represents the keys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Dumps the keys and values of a list of keys",
+	Long: `Looks up every key of the list, read one key per line from a
+file and/or stdin, in the latest snapshot of each of the stores,
+and emits whether it was found along with its value. The keys may
+be hex or base64 encoded. For example:
+	./mossScope dump keys --from-file keys.txt <path_to_store(s)>
+	cat keys.txt | ./mossScope dump keys --stdin <path_to_store(s)>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return usageErrorf("at least one path is required")
+		}
+
+		if len(keysFile) == 0 && !keysFromStdin {
+			return usageErrorf("--from-file or --stdin is required")
+		}
+
+		if _, ok := keyDecoderFuncs[keysEncoding]; !ok {
+			return usageErrorf("unsupported key encoding: %s", keysEncoding)
+		}
+
+		return checkKeyValDecoders()
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var keys [][]byte
+
+		if len(keysFile) > 0 {
+			f, err := os.Open(keysFile)
+			if err != nil {
+				return fmt.Errorf("File read error: %v", err)
+			}
+			fromFile, err := readKeys(f, keysEncoding)
+			f.Close()
+			if err != nil {
+				return err
+			}
+			keys = append(keys, fromFile...)
+		}
+
+		if keysFromStdin {
+			fromStdin, err := readKeys(cmd.InOrStdin(), keysEncoding)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, fromStdin...)
+		}
+
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeKeys(cmd.OutOrStdout(), keys, dirs)
+	},
+}
+
+var keysFile string
+var keysFromStdin bool
+var keysEncoding string
+
+// keyDecoderFuncs parses the keys of the --key-encoding flags, unlike
+// the decoders of --key-decoder (scope.NewDecoder), which render them.
+var keyDecoderFuncs = map[string]func(s string) ([]byte, error){
+	"raw": func(s string) ([]byte, error) {
+		return []byte(s), nil
+	},
+	"hex":    hex.DecodeString,
+	"base64": base64.StdEncoding.DecodeString,
+	"escaped": func(s string) ([]byte, error) {
+		// As emitted by dump in csv and tsv
+		if strings.HasPrefix(s, `\x`) {
+			return hex.DecodeString(s[2:])
+		}
+		return []byte(s), nil
+	},
+}
+
+// readKeys reads a key per line from r, skipping empty lines, and
+// decodes them with the named encoding.
+func readKeys(r io.Reader, encoding string) ([][]byte, error) {
+	decode := keyDecoderFuncs[encoding]
+
+	var keys [][]byte
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if len(text) == 0 {
+			continue
+		}
+
+		key, err := decode(text)
+		if err != nil {
+			return nil, usageErrorf("invalid %s key at line %d: %v",
+				encoding, line, err)
+		}
+		keys = append(keys, key)
+	}
+
+	err := scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Error in reading the keys, err: %v", err)
+	}
+
+	return keys, nil
+}
+
+// keyLookupOutput is the document of a looked up key, where the value
+// is left out when the key is not found.
+type keyLookupOutput struct {
+	Key   interface{} `json:"k"`
+	Found bool        `json:"found"`
+	Val   interface{} `json:"v,omitempty"`
+	Error string      `json:"error,omitempty"`
+}
+
+func invokeKeys(w io.Writer, keys [][]byte, dirs []string) error {
+	r, err := newRenderer(w, jsonOutput)
+	if err != nil {
+		return err
+	}
+
+	found := make([]bool, len(keys))
+	var failures storeFailures
+
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return scope.LookupKeys(store, keys)
+	}, func(dir string, val interface{}) error {
+		err := r.beginList(dir)
+		if err != nil {
+			return err
+		}
+
+		for i, lookup := range val.([]scope.KeyLookup) {
+			found[i] = found[i] || lookup.Found
+
+			k, v, errMsg := decodeKeyVal(lookup.Key, lookup.Val, inHex)
+			doc := keyLookupOutput{Key: k, Found: lookup.Found, Val: v,
+				Error: errMsg}
+			rec := (&record{}).add("key", recordValue(k)).
+				add("found", lookup.Found)
+			if v != nil {
+				rec.add("value", recordValue(v))
+			} else {
+				rec.add("value", "")
+			}
+
+			err = r.item(doc, rec)
+			if err != nil {
+				return err
+			}
+		}
+
+		return r.endList()
+	}, failures.report(r))
+	if err != nil {
+		return err
+	}
+
+	err = r.close()
+	if err != nil {
+		return err
+	}
+
+	if failures.err() != nil {
+		return failures.err()
+	}
+
+	missing := 0
+	for _, f := range found {
+		if !f {
+			missing++
+		}
+	}
+	if missing > 0 {
+		return notFoundErrorf("%d of %d keys not found", missing, len(keys))
+	}
+
+	return nil
+}
+
+func init() {
+	dumpCmd.AddCommand(keysCmd)
+
+	// Local flags that are intended to work with dump keys
+	keysCmd.Flags().StringVar(&keysFile, "from-file", "",
+		"Reads the keys from the file, one key per line")
+	keysCmd.Flags().BoolVar(&keysFromStdin, "stdin", false,
+		"Reads the keys from stdin, one key per line")
+	keysCmd.Flags().StringVar(&keysEncoding, "key-encoding", "raw",
+		"Encoding of the keys read: raw, hex, base64 or escaped")
+	keysCmd.Flags().BoolVar(&inHex, "hex", false,
+		"Emits output in hex")
+}
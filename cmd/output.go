@@ -0,0 +1,733 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The output formats that can be selected with --output.
+const (
+	tableOutput  = "table"
+	jsonOutput   = "json"
+	ndjsonOutput = "ndjson"
+	csvOutput    = "csv"
+	tsvOutput    = "tsv"
+	yamlOutput   = "yaml"
+)
+
+var outputFormat string
+
+// renderers maps every output format to the constructor of its
+// renderer.
+var renderers = map[string]func(w io.Writer) renderer{
+	tableOutput:  newTableRenderer,
+	jsonOutput:   newJSONRenderer,
+	ndjsonOutput: newNDJSONRenderer,
+	csvOutput:    newCSVRenderer,
+	tsvOutput:    newTSVRenderer,
+	yamlOutput:   newYAMLRenderer,
+	promOutput:   newPromRenderer,
+}
+
+// renderer emits the output of a command, which is made up of a
+// section per store. The document formats (json, yaml) nest the
+// document of every section under the name of its store, while the
+// record formats (table, csv, tsv, ndjson, prometheus) emit the records of
+// every section, prefixed with a "store" field.
+type renderer interface {
+	// section emits the output of a store as a whole.
+	section(store string, doc interface{}, recs []*record) error
+
+	// beginList, item and endList emit the output of a store whose
+	// document is a list one item at a time, so that it need not be
+	// held in memory.
+	beginList(store string) error
+	item(doc interface{}, rec *record) error
+	endList() error
+
+	// storeError emits the failure of a store that is skipped with
+	// --keep-going, in place of its output.
+	storeError(store string, err error) error
+
+	// close completes the output once all the stores are emitted.
+	close() error
+}
+
+// record is an ordered set of named values, a row in the output of
+// the record formats.
+type record struct {
+	names []string
+	vals  []interface{}
+}
+
+func (r *record) add(name string, val interface{}) *record {
+	r.names = append(r.names, name)
+	r.vals = append(r.vals, val)
+	return r
+}
+
+// addMap adds the entries of m to the record, ordered by name.
+func (r *record) addMap(m map[string]interface{}) *record {
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.add(name, m[name])
+	}
+	return r
+}
+
+func checkOutputFormat() error {
+	if _, exists := renderers[outputFormat]; outputFormat != "" && !exists {
+		return usageErrorf("unsupported output format: %s", outputFormat)
+	}
+	return nil
+}
+
+// selectedFormat returns the output format selected for a command,
+// where def is the command's format when none is selected.
+func selectedFormat(def string) string {
+	if outputFormat != "" {
+		return outputFormat
+	}
+	if jsonFormat {
+		return jsonOutput
+	}
+	return def
+}
+
+// newRenderer returns the renderer of the output format selected for
+// a command, where def is the command's format when none is selected.
+func newRenderer(w io.Writer, def string) (renderer, error) {
+	format := selectedFormat(def)
+	newFn, exists := renderers[format]
+	if !exists {
+		return nil, usageErrorf("unsupported output format: %s", format)
+	}
+	return newFn(w), nil
+}
+
+// storeErrorDoc is the document of a store that failed.
+type storeErrorDoc struct {
+	Store string `json:"store"`
+	Error string `json:"error"`
+}
+
+// valueString formats a value for the text based record formats.
+func valueString(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case []byte:
+		return string(val)
+	case []uint64:
+		vals := make([]string, len(val))
+		for i := range val {
+			vals[i] = strconv.FormatUint(val[i], 10)
+		}
+		return strings.Join(vals, " ")
+	}
+	return fmt.Sprint(v)
+}
+
+// ---------------------------------------------------------------
+
+// jsonRenderer emits a JSON array holding an object per store, which
+// maps the store to its document.
+type jsonRenderer struct {
+	w        io.Writer
+	sections int
+	items    int
+}
+
+func newJSONRenderer(w io.Writer) renderer {
+	return &jsonRenderer{w: w}
+}
+
+func (r *jsonRenderer) begin(store string) error {
+	jBuf, err := json.Marshal(store)
+	if err != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+	if r.sections == 0 {
+		fmt.Fprintf(r.w, "[")
+	} else {
+		fmt.Fprintf(r.w, ",")
+	}
+	r.sections++
+	fmt.Fprintf(r.w, "{%s:", string(jBuf))
+	return nil
+}
+
+func (r *jsonRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	jBuf, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+	err = r.begin(store)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.w, "%s}", string(jBuf))
+	return nil
+}
+
+func (r *jsonRenderer) beginList(store string) error {
+	err := r.begin(store)
+	if err != nil {
+		return err
+	}
+	r.items = 0
+	fmt.Fprintf(r.w, "[")
+	return nil
+}
+
+func (r *jsonRenderer) item(doc interface{}, rec *record) error {
+	jBuf, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+	if r.items != 0 {
+		fmt.Fprintf(r.w, ",")
+	}
+	r.items++
+	fmt.Fprintf(r.w, "%s", string(jBuf))
+	return nil
+}
+
+func (r *jsonRenderer) endList() error {
+	fmt.Fprintf(r.w, "]}")
+	return nil
+}
+
+func (r *jsonRenderer) storeError(store string, err error) error {
+	doc := storeErrorDoc{Store: store, Error: err.Error()}
+	jBuf, jErr := json.Marshal(doc)
+	if jErr != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", jErr)
+	}
+	if r.sections == 0 {
+		fmt.Fprintf(r.w, "[")
+	} else {
+		fmt.Fprintf(r.w, ",")
+	}
+	r.sections++
+	fmt.Fprintf(r.w, "%s", string(jBuf))
+	return nil
+}
+
+func (r *jsonRenderer) close() error {
+	if r.sections == 0 {
+		fmt.Fprintf(r.w, "[")
+	}
+	fmt.Fprintf(r.w, "]\n")
+	return nil
+}
+
+// ---------------------------------------------------------------
+
+// yamlRenderer emits the same documents as the jsonRenderer, as a
+// YAML sequence.
+type yamlRenderer struct {
+	w        io.Writer
+	sections int
+	items    int
+}
+
+func newYAMLRenderer(w io.Writer) renderer {
+	return &yamlRenderer{w: w}
+}
+
+// yamlDoc converts doc to its generic JSON form, so that the field
+// names follow the JSON tags and integers are kept intact.
+func yamlDoc(doc interface{}) (interface{}, error) {
+	jBuf, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(jBuf))
+	dec.UseNumber()
+
+	var generic interface{}
+	err = dec.Decode(&generic)
+	if err != nil {
+		return nil, fmt.Errorf("Json-Decode() failed!, err: %v", err)
+	}
+
+	return yamlNumbers(generic), nil
+}
+
+func yamlNumbers(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		for k := range val {
+			val[k] = yamlNumbers(val[k])
+		}
+	case []interface{}:
+		for i := range val {
+			val[i] = yamlNumbers(val[i])
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(string(val), 10, 64); err == nil {
+			return n
+		}
+		if n, err := strconv.ParseUint(string(val), 10, 64); err == nil {
+			return n
+		}
+		if n, err := val.Float64(); err == nil {
+			return n
+		}
+	}
+	return v
+}
+
+// yamlSequence marshals doc as a single entry of a YAML sequence,
+// indented by indent.
+func yamlSequence(doc interface{}, indent string) ([]byte, error) {
+	generic, err := yamlDoc(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	yBuf, err := yaml.Marshal([]interface{}{generic})
+	if err != nil {
+		return nil, fmt.Errorf("Yaml-Marshal() failed!, err: %v", err)
+	}
+
+	if indent == "" {
+		return yBuf, nil
+	}
+
+	lines := strings.SplitAfter(string(yBuf), "\n")
+	for i := range lines {
+		if lines[i] != "" {
+			lines[i] = indent + lines[i]
+		}
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+func (r *yamlRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	yBuf, err := yamlSequence(map[string]interface{}{store: doc}, "")
+	if err != nil {
+		return err
+	}
+	r.sections++
+	r.w.Write(yBuf)
+	return nil
+}
+
+func (r *yamlRenderer) beginList(store string) error {
+	yBuf, err := yaml.Marshal(map[string]interface{}{store: nil})
+	if err != nil {
+		return fmt.Errorf("Yaml-Marshal() failed!, err: %v", err)
+	}
+	r.sections++
+	r.items = 0
+	// Emits "- <store>:", leaving out the null value
+	fmt.Fprintf(r.w, "- %s", strings.TrimSuffix(string(yBuf), " null\n"))
+	return nil
+}
+
+func (r *yamlRenderer) item(doc interface{}, rec *record) error {
+	yBuf, err := yamlSequence(doc, "    ")
+	if err != nil {
+		return err
+	}
+	if r.items == 0 {
+		fmt.Fprintf(r.w, "\n")
+	}
+	r.items++
+	r.w.Write(yBuf)
+	return nil
+}
+
+func (r *yamlRenderer) endList() error {
+	if r.items == 0 {
+		fmt.Fprintf(r.w, " []\n")
+	}
+	return nil
+}
+
+func (r *yamlRenderer) storeError(store string, err error) error {
+	yBuf, yErr := yamlSequence(storeErrorDoc{Store: store,
+		Error: err.Error()}, "")
+	if yErr != nil {
+		return yErr
+	}
+	r.sections++
+	r.w.Write(yBuf)
+	return nil
+}
+
+func (r *yamlRenderer) close() error {
+	if r.sections == 0 {
+		fmt.Fprintf(r.w, "[]\n")
+	}
+	return nil
+}
+
+// ---------------------------------------------------------------
+
+// ndjsonRenderer emits every record as a JSON object per line.
+type ndjsonRenderer struct {
+	w     io.Writer
+	store string
+}
+
+func newNDJSONRenderer(w io.Writer) renderer {
+	return &ndjsonRenderer{w: w}
+}
+
+func (r *ndjsonRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	r.store = store
+	for _, rec := range recs {
+		err := r.item(nil, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ndjsonRenderer) beginList(store string) error {
+	r.store = store
+	return nil
+}
+
+func (r *ndjsonRenderer) item(doc interface{}, rec *record) error {
+	var buf bytes.Buffer
+	buf.WriteString("{\"store\":")
+
+	jBuf, err := json.Marshal(r.store)
+	if err != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+	buf.Write(jBuf)
+
+	for i, name := range rec.names {
+		jBufk, err := json.Marshal(name)
+		if err != nil {
+			return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+		}
+		jBufv, err := json.Marshal(rec.vals[i])
+		if err != nil {
+			return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+		}
+		buf.WriteString(",")
+		buf.Write(jBufk)
+		buf.WriteString(":")
+		buf.Write(jBufv)
+	}
+
+	buf.WriteString("}\n")
+	r.w.Write(buf.Bytes())
+	return nil
+}
+
+func (r *ndjsonRenderer) endList() error {
+	return nil
+}
+
+func (r *ndjsonRenderer) storeError(store string, err error) error {
+	doc := storeErrorDoc{Store: store, Error: err.Error()}
+	jBuf, jErr := json.Marshal(doc)
+	if jErr != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", jErr)
+	}
+	fmt.Fprintf(r.w, "%s\n", string(jBuf))
+	return nil
+}
+
+func (r *ndjsonRenderer) close() error {
+	return nil
+}
+
+// ---------------------------------------------------------------
+
+// csvRenderer emits the records as CSV, with a header line naming the
+// fields of the first record. It also emits TSV, by another writer.
+// The rows of the stores that failed are padded to the width of the
+// header, and held back until the header is known.
+type csvRenderer struct {
+	w       rowWriter
+	store   string
+	header  bool
+	width   int
+	pending [][]string // Failed stores emitted before the header.
+}
+
+// rowWriter is implemented by csv.Writer and tsvWriter.
+type rowWriter interface {
+	Write(row []string) error
+	Flush()
+	Error() error
+}
+
+func newCSVRenderer(w io.Writer) renderer {
+	return &csvRenderer{w: csv.NewWriter(w)}
+}
+
+func newTSVRenderer(w io.Writer) renderer {
+	return &csvRenderer{w: &tsvWriter{w: bufio.NewWriter(w)}}
+}
+
+func (r *csvRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	r.store = store
+	for _, rec := range recs {
+		err := r.item(nil, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *csvRenderer) beginList(store string) error {
+	r.store = store
+	return nil
+}
+
+func (r *csvRenderer) item(doc interface{}, rec *record) error {
+	if !r.header {
+		err := r.writeHeader(append([]string{"store"}, rec.names...))
+		if err != nil {
+			return err
+		}
+	}
+
+	row := []string{r.store}
+	for _, v := range rec.vals {
+		row = append(row, valueString(v))
+	}
+	return r.w.Write(row)
+}
+
+func (r *csvRenderer) endList() error {
+	return nil
+}
+
+func (r *csvRenderer) storeError(store string, err error) error {
+	row := []string{store, "ERROR: " + err.Error()}
+	if !r.header {
+		r.pending = append(r.pending, row)
+		return nil
+	}
+	return r.writePadded(row)
+}
+
+// writeHeader emits the header, followed by the rows of the stores
+// that failed before it.
+func (r *csvRenderer) writeHeader(names []string) error {
+	r.header, r.width = true, len(names)
+	err := r.w.Write(names)
+	if err != nil {
+		return err
+	}
+
+	for _, row := range r.pending {
+		err = r.writePadded(row)
+		if err != nil {
+			return err
+		}
+	}
+	r.pending = nil
+	return nil
+}
+
+func (r *csvRenderer) writePadded(row []string) error {
+	for len(row) < r.width {
+		row = append(row, "")
+	}
+	return r.w.Write(row)
+}
+
+func (r *csvRenderer) close() error {
+	if !r.header && len(r.pending) > 0 {
+		// Every store failed
+		err := r.writeHeader([]string{"store", "error"})
+		if err != nil {
+			return err
+		}
+	}
+	return r.flush()
+}
+
+// flush emits the rows written so far, for the output of commands
+// that run until they are killed, such as stats watch.
+func (r *csvRenderer) flush() error {
+	r.w.Flush()
+	return r.w.Error()
+}
+
+// tsvEscaper escapes the fields of TSV rows, as in the text format of
+// PostgreSQL, so that fields never hold tabs or line breaks.
+var tsvEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`,
+	"\r", `\r`)
+
+// tsvWriter writes rows of tab separated fields.
+type tsvWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (t *tsvWriter) Write(row []string) error {
+	for i, field := range row {
+		if i > 0 {
+			t.w.WriteByte('\t')
+		}
+		t.w.WriteString(tsvEscaper.Replace(field))
+	}
+	_, t.err = t.w.WriteString("\n")
+	return t.err
+}
+
+func (t *tsvWriter) Flush() {
+	err := t.w.Flush()
+	if t.err == nil {
+		t.err = err
+	}
+}
+
+func (t *tsvWriter) Error() error {
+	return t.err
+}
+
+// ---------------------------------------------------------------
+
+// tableMaxColumns is the number of columns beyond which the records
+// are emitted vertically, as a block of "name : value" lines each.
+const tableMaxColumns = 8
+
+// tableRenderer emits the records as aligned columns, with a header
+// line naming the fields of the first record.
+type tableRenderer struct {
+	w        io.Writer
+	tw       *tabwriter.Writer
+	store    string
+	header   bool
+	vertical bool
+}
+
+func newTableRenderer(w io.Writer) renderer {
+	return &tableRenderer{w: w, tw: tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)}
+}
+
+func (r *tableRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	r.store = store
+	for _, rec := range recs {
+		err := r.item(nil, rec)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *tableRenderer) beginList(store string) error {
+	r.store = store
+	return nil
+}
+
+func (r *tableRenderer) item(doc interface{}, rec *record) error {
+	if !r.header {
+		r.header = true
+		r.vertical = len(rec.names)+1 > tableMaxColumns
+		if r.vertical {
+			// Emits the failed stores before, which are written
+			// to the tabwriter until the layout is known
+			err := r.tw.Flush()
+			if err != nil {
+				return err
+			}
+		} else {
+			fmt.Fprintf(r.tw, "STORE\t%s\n",
+				strings.ToUpper(strings.Join(rec.names, "\t")))
+		}
+	}
+
+	if r.vertical {
+		width := 0
+		for _, name := range rec.names {
+			if len(name) > width {
+				width = len(name)
+			}
+		}
+		fmt.Fprintln(r.w, r.store)
+		for i, name := range rec.names {
+			fmt.Fprintf(r.w, "%*s : %s\n", width+2, name,
+				tableValue(rec.vals[i]))
+		}
+		fmt.Fprintln(r.w)
+		return nil
+	}
+
+	row := []string{tableValue(r.store)}
+	for _, v := range rec.vals {
+		row = append(row, tableValue(v))
+	}
+	fmt.Fprintf(r.tw, "%s\n", strings.Join(row, "\t"))
+	return nil
+}
+
+// tableValue quotes the values that would break the alignment.
+func tableValue(v interface{}) string {
+	s := valueString(v)
+	if !utf8.ValidString(s) || strings.IndexFunc(s, notPrint) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func notPrint(r rune) bool {
+	return !unicode.IsPrint(r)
+}
+
+func (r *tableRenderer) endList() error {
+	return nil
+}
+
+func (r *tableRenderer) storeError(store string, err error) error {
+	if r.vertical {
+		fmt.Fprintf(r.w, "%s\n  ERROR: %v\n\n", store, err)
+		return nil
+	}
+	fmt.Fprintf(r.tw, "%s\tERROR: %s\n", tableValue(store),
+		tableValue(err.Error()))
+	return nil
+}
+
+func (r *tableRenderer) close() error {
+	return r.tw.Flush()
+}
@@ -0,0 +1,339 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// renderHelper emits a section with a stats document and its record,
+// in the specified format.
+func renderHelper(t *testing.T, format string) string {
+	var buf bytes.Buffer
+	r := renderers[format](&buf)
+
+	stats := map[string]interface{}{"num_segments": uint64(2),
+		"segment_bytes": []uint64{10, 20}}
+	err := r.section("storeA", stats,
+		[]*record{(&record{}).add("footer", "Footer_1").addMap(stats)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func listHelper(t *testing.T, format string) string {
+	var buf bytes.Buffer
+	r := renderers[format](&buf)
+
+	for _, store := range []string{"storeA", "storeB"} {
+		err := r.beginList(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b\tc"} {
+			err = r.item(keyValOutput(&record{}, []byte(key),
+				[]byte("val"), false))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = r.endList()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.String()
+}
+
+func TestRenderers(t *testing.T) {
+	tests := []struct {
+		format  string
+		section string
+		list    string
+	}{
+		{jsonOutput,
+			`[{"storeA":{"num_segments":2,"segment_bytes":[10,20]}}]` + "\n",
+			`[{"storeA":[{"k":"a","v":"val"},{"k":"b\tc","v":"val"}]},` +
+				`{"storeB":[{"k":"a","v":"val"},{"k":"b\tc","v":"val"}]}]` + "\n"},
+		{yamlOutput,
+			"- storeA:\n    num_segments: 2\n    segment_bytes:\n" +
+				"        - 10\n        - 20\n",
+			"- storeA:\n    - k: a\n      v: val\n    - k: \"b\\tc\"\n" +
+				"      v: val\n- storeB:\n    - k: a\n      v: val\n" +
+				"    - k: \"b\\tc\"\n      v: val\n"},
+		{ndjsonOutput,
+			`{"store":"storeA","footer":"Footer_1","num_segments":2,` +
+				`"segment_bytes":[10,20]}` + "\n",
+			`{"store":"storeA","key":"a","value":"val"}` + "\n" +
+				`{"store":"storeA","key":"b\tc","value":"val"}` + "\n" +
+				`{"store":"storeB","key":"a","value":"val"}` + "\n" +
+				`{"store":"storeB","key":"b\tc","value":"val"}` + "\n"},
+		{csvOutput,
+			"store,footer,num_segments,segment_bytes\n" +
+				"storeA,Footer_1,2,10 20\n",
+			"store,key,value\nstoreA,a,val\nstoreA,b\tc,val\n" +
+				"storeB,a,val\nstoreB,b\tc,val\n"},
+		{tsvOutput,
+			"store\tfooter\tnum_segments\tsegment_bytes\n" +
+				"storeA\tFooter_1\t2\t10 20\n",
+			"store\tkey\tvalue\nstoreA\ta\tval\nstoreA\tb\\tc\tval\n" +
+				"storeB\ta\tval\nstoreB\tb\\tc\tval\n"},
+		{tableOutput,
+			"STORE   FOOTER    NUM_SEGMENTS  SEGMENT_BYTES\n" +
+				"storeA  Footer_1  2             10 20\n",
+			"STORE   KEY     VALUE\nstoreA  a       val\n" +
+				"storeA  \"b\\tc\"  val\nstoreB  a       val\n" +
+				"storeB  \"b\\tc\"  val\n"},
+	}
+
+	for _, test := range tests {
+		out := renderHelper(t, test.format)
+		if out != test.section {
+			t.Errorf("Unexpected %s section, expected:\n%s\ngot:\n%s",
+				test.format, test.section, out)
+		}
+
+		out = listHelper(t, test.format)
+		if out != test.list {
+			t.Errorf("Unexpected %s list, expected:\n%s\ngot:\n%s",
+				test.format, test.list, out)
+		}
+	}
+}
+
+func TestCSVStoreErrors(t *testing.T) {
+	failure := fmt.Errorf("no data file")
+
+	var buf bytes.Buffer
+	r := newCSVRenderer(&buf)
+	for _, store := range []string{"storeA", "storeB", "storeC"} {
+		if store != "storeB" {
+			err := r.storeError(store, failure)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		err := r.section(store, nil, []*record{
+			(&record{}).add("key", "a").add("value", "val")})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The failed stores are padded to the width of the header
+	expect := "store,key,value\nstoreA,ERROR: no data file,\n" +
+		"storeB,a,val\nstoreC,ERROR: no data file,\n"
+	if buf.String() != expect {
+		t.Errorf("Unexpected CSV output, expected:\n%s\ngot:\n%s",
+			expect, buf.String())
+	}
+
+	buf.Reset()
+	r = newTSVRenderer(&buf)
+	err = r.storeError("storeA", failure)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "store\terror\nstoreA\tERROR: no data file\n" {
+		t.Errorf("Unexpected TSV output: %q", buf.String())
+	}
+}
+
+func TestTableStoreErrors(t *testing.T) {
+	var buf bytes.Buffer
+	r := newTableRenderer(&buf)
+	err := r.storeError("storeA", fmt.Errorf("no data file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A record with many fields switches to the vertical layout
+	rec := &record{}
+	for i := 0; i < tableMaxColumns; i++ {
+		rec.add(fmt.Sprintf("stat%d", i), i)
+	}
+	err = r.section("storeB", nil, []*record{rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if !strings.HasPrefix(out, "storeA  ERROR: no data file\nstoreB\n") {
+		t.Errorf("Expected the failed store first, got:\n%s", out)
+	}
+}
+
+func TestColumnsRecord(t *testing.T) {
+	cols := []string{"key", "value", "key_len", "val_len", "footer",
+		"collection", "error"}
+
+	rec := columnsRecord(cols, 3, "docs", []byte("k\x00"),
+		[]byte("caf\xc3\xa9\t1"), true)
+	expect := []interface{}{`\x6b00`, "caf\u00e9\t1", 2, 7, 3, "docs", ""}
+	if !reflect.DeepEqual(rec.vals, expect) {
+		t.Errorf("Unexpected columns: %#v", rec.vals)
+	}
+
+	// Text that looks escaped is escaped, and nothing is without csv or tsv
+	rec = columnsRecord(cols, 1, "", []byte(`\x00`), []byte("\xff"), false)
+	if rec.vals[0] != `\x00` || rec.vals[1] != "\xff" {
+		t.Errorf("Unexpected unescaped columns: %#v", rec.vals)
+	}
+	rec = columnsRecord(cols[:1], 1, "", []byte(`\x00`), nil, true)
+	if rec.vals[0] != `\x5c783030` {
+		t.Errorf("Unexpected escaped column: %#v", rec.vals)
+	}
+}
+
+func TestTableVertical(t *testing.T) {
+	var buf bytes.Buffer
+	r := newTableRenderer(&buf)
+
+	rec := &record{}
+	for _, name := range []string{"a", "bb", "c", "d", "e", "f", "g", "h"} {
+		rec.add(name, 1)
+	}
+	err := r.section("storeA", nil, []*record{rec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.close()
+
+	if !strings.HasPrefix(buf.String(), "storeA\n   a : 1\n  bb : 1\n") {
+		t.Errorf("Expected a vertical table, got:\n%s", buf.String())
+	}
+}
+
+// resetDumpFlags clears the flags of dump that select and encode the
+// key-values, which other tests may leave set, returning a func that
+// restores them.
+func resetDumpFlags() func() {
+	prefix, filter, cond, hex := keyPrefix, keyFilter, where, inHex
+	limit, offset, after, reverse := dumpLimit, dumpOffset, afterKey,
+		dumpReverse
+	size, rate, footer, coll := sampleSize, sampleRate, dumpFooter,
+		dumpCollection
+	decode, keyDec, valDec := decodeFormat, keyDecoder, valueDecoder
+
+	keyPrefix, keyFilter, where, inHex = "", nil, nil, false
+	dumpLimit, dumpOffset, afterKey, dumpReverse = 0, 0, "", false
+	sampleSize, sampleRate, dumpFooter, dumpCollection = 0, 0, 1, ""
+	decodeFormat, keyDecoder, valueDecoder = "", nil, nil
+
+	return func() {
+		keyPrefix, keyFilter, where, inHex = prefix, filter, cond, hex
+		dumpLimit, dumpOffset, afterKey, dumpReverse = limit, offset,
+			after, reverse
+		sampleSize, sampleRate, dumpFooter, dumpCollection = size, rate,
+			footer, coll
+		decodeFormat, keyDecoder, valueDecoder = decode, keyDec, valDec
+	}
+}
+
+func TestDumpOutputFormats(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	defer resetDumpFlags()()
+	defer func() {
+		outputFormat = ""
+		keysOnly = false
+	}()
+
+	var buf bytes.Buffer
+	outputFormat = csvOutput
+	keysOnly = true
+	err := invokeDump(&buf, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != itemCount+1 || lines[0] != "store,key" ||
+		lines[1] != dir+",key0" {
+		t.Errorf("Unexpected CSV output: %s", buf.String())
+	}
+
+	buf.Reset()
+	outputFormat = promOutput
+	err = invokeDump(&buf, []string{dir})
+	if exitCode(err) != exitUsage {
+		t.Errorf("Expected prometheus to be rejected by dump, err: %v", err)
+	}
+
+	buf.Reset()
+	outputFormat = tsvOutput
+	keysOnly = false
+	columnsSpec = "key_len,val_len,key,footer"
+	defer func() {
+		columnsSpec = ""
+		checkColumns()
+	}()
+	err = checkColumns()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = invokeDump(&buf, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines = strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != itemCount+1 ||
+		lines[0] != "store\tkey_len\tval_len\tkey\tfooter" ||
+		lines[1] != dir+"\t4\t4\tkey0\t1" {
+		t.Errorf("Unexpected TSV output: %s", buf.String())
+	}
+
+	for _, spec := range []string{"key,size", "key,"} {
+		columnsSpec = spec
+		if exitCode(checkColumns()) != exitUsage {
+			t.Errorf("Expected columns %q to be rejected", spec)
+		}
+	}
+	columnsSpec, outputFormat = "key", jsonOutput
+	if exitCode(checkColumns()) != exitUsage {
+		t.Errorf("Expected --columns to be rejected with json")
+	}
+
+	outputFormat = "xml"
+	if exitCode(checkOutputFormat()) != exitUsage {
+		t.Errorf("Expected an unsupported output format to be rejected")
+	}
+}
@@ -0,0 +1,167 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+)
+
+// parallel is the number of stores that are processed concurrently.
+var parallel int
+
+// keepGoing skips the stores that fail, instead of aborting the run.
+var keepGoing bool
+
+func checkParallel() error {
+	if parallel < 1 {
+		return usageErrorf("parallel must be at least 1")
+	}
+	return nil
+}
+
+// storeResult is the outcome of processing a store, which is complete
+// once done is closed.
+type storeResult struct {
+	val  interface{}
+	err  error
+	done chan struct{}
+}
+
+// forEachStore opens every one of the stores at dirs, invokes process
+// with it and its dir and closes it again, on up to parallel stores
+// concurrently. The results are handed to emit in the order of dirs,
+// and the first error in that order stops the processing of the
+// remaining stores, unless --keep-going is set, in which case the
+// error is handed to fail instead.
+func forEachStore(dirs []string,
+	process func(dir string, store *moss.Store) (interface{}, error),
+	emit func(dir string, val interface{}) error,
+	fail func(dir string, err error) error) error {
+	workers := parallel
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+
+	results := make([]storeResult, len(dirs))
+	for i := range results {
+		results[i].done = make(chan struct{})
+	}
+
+	next := make(chan int)
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer close(next)
+		for i := range dirs {
+			select {
+			case next <- i:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				results[i].val, results[i].err = processStore(dirs[i], process)
+				close(results[i].done)
+			}
+		}()
+	}
+
+	for i, dir := range dirs {
+		<-results[i].done
+		if results[i].err != nil {
+			if !keepGoing {
+				return results[i].err
+			}
+
+			err := fail(dir, results[i].err)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := emit(dir, results[i].val)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func processStore(dir string,
+	process func(dir string, store *moss.Store) (interface{},
+		error)) (interface{}, error) {
+	store, err := scope.OpenStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer store.Close()
+
+	return process(dir, store)
+}
+
+// storeFailures gathers the errors of the stores that are skipped with
+// --keep-going, to be reported once all the stores are processed.
+type storeFailures struct {
+	dirs []string
+	errs []error
+}
+
+func (f *storeFailures) add(dir string, err error) {
+	f.dirs = append(f.dirs, dir)
+	f.errs = append(f.errs, err)
+}
+
+// report returns a fail function for forEachStore, which gathers the
+// error and emits it through the renderer.
+func (f *storeFailures) report(r renderer) func(dir string, err error) error {
+	return func(dir string, err error) error {
+		f.add(dir, err)
+		return r.storeError(dir, err)
+	}
+}
+
+// err returns the failures as an error, or nil if there were none.
+func (f *storeFailures) err() error {
+	if len(f.errs) == 0 {
+		return nil
+	}
+	return f
+}
+
+func (f *storeFailures) Error() string {
+	msgs := make([]string, len(f.errs))
+	for i := range f.errs {
+		msgs[i] = fmt.Sprintf("%s: %v", f.dirs[i], f.errs[i])
+	}
+	return fmt.Sprintf("%d store(s) failed; %s", len(f.errs),
+		strings.Join(msgs, "; "))
+}
+
+// code returns the exit code shared by all the failures, or
+// exitFailure if they differ.
+func (f *storeFailures) code() int {
+	code := exitCode(f.errs[0])
+	for _, err := range f.errs[1:] {
+		if exitCode(err) != code {
+			return exitFailure
+		}
+	}
+	return code
+}
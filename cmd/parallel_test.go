@@ -0,0 +1,126 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync/atomic"
+	"testing"
+
+	"github.com/couchbase/moss"
+)
+
+func TestForEachStore(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	parallel = 3
+	defer func() {
+		parallel = 1
+	}()
+
+	var processed int32
+	var emitted []int
+
+	dirs := []string{dir, dir, dir, dir, dir, dir}
+	err := forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return int(atomic.AddInt32(&processed, 1)), nil
+	}, func(dir string, val interface{}) error {
+		emitted = append(emitted, val.(int))
+		return nil
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(emitted) != len(dirs) || int(processed) != len(dirs) {
+		t.Errorf("Expected every store to be emitted once: %v", emitted)
+	}
+
+	// The first error in the order of the stores is returned, with all
+	// the stores before it emitted
+	emitted = nil
+	dirs = []string{dir, dir, "nonExistentStore", dir, "otherStore"}
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return 0, nil
+	}, func(dir string, val interface{}) error {
+		emitted = append(emitted, val.(int))
+		return nil
+	}, nil)
+	if exitCode(err) != exitStoreOpen || len(emitted) != 2 {
+		t.Errorf("Unexpected result, err: %v, emitted: %v", err, emitted)
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	keepGoing = true
+	outputFormat = jsonOutput
+	defer func() {
+		keepGoing = false
+		outputFormat = ""
+	}()
+
+	var buf bytes.Buffer
+	err := invokeDiagStats(&buf, []string{dir, "nonExistentStore", dir})
+	if exitCode(err) != exitStoreOpen {
+		t.Errorf("Expected the store failure to be reported, err: %v", err)
+	}
+
+	var docs []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &docs)
+	if err != nil {
+		t.Fatalf("Expected valid JSON, err: %v, output: %s", err, buf.String())
+	}
+
+	if len(docs) != 3 || docs[1]["store"] != "nonExistentStore" ||
+		docs[1]["error"] == nil || docs[2][dir] == nil {
+		t.Errorf("Unexpected output: %s", buf.String())
+	}
+}
+
+func TestDumpParallel(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	parallel, keepGoing = 3, true
+	outputFormat = jsonOutput
+	defer func() {
+		parallel, keepGoing = 1, false
+		outputFormat = ""
+	}()
+
+	var buf bytes.Buffer
+	err := invokeDump(&buf, []string{dir, "nonExistentStore", dir, dir})
+	if exitCode(err) != exitStoreOpen {
+		t.Errorf("Expected the store failure to be reported, err: %v", err)
+	}
+
+	var docs []map[string]interface{}
+	err = json.Unmarshal(buf.Bytes(), &docs)
+	if err != nil {
+		t.Fatalf("Expected valid JSON, err: %v, output: %s", err, buf.String())
+	}
+
+	if len(docs) != 4 || docs[1]["store"] != "nonExistentStore" {
+		t.Fatalf("Unexpected output: %s", buf.String())
+	}
+	for _, i := range []int{0, 2, 3} {
+		kvs, _ := docs[i][dir].([]interface{})
+		if len(kvs) != itemCount {
+			t.Errorf("Expected %d key-values of store %d, got: %d",
+				itemCount, i, len(kvs))
+		}
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const promOutput = "prometheus"
+
+// promRenderer is the renderer of the prometheus output format, which
+// gathers the numeric fields of the records from all the stores, and
+// labels them with the store and the string fields of their records.
+type promRenderer struct {
+	w      io.Writer
+	reg    *promRegistry
+	errors []string
+}
+
+func newPromRenderer(w io.Writer) renderer {
+	return &promRenderer{w: w, reg: newPromRegistry()}
+}
+
+func (r *promRenderer) section(store string, doc interface{},
+	recs []*record) error {
+	for _, rec := range recs {
+		labels := []string{"store", store}
+		stats := make(map[string]interface{})
+		for i, name := range rec.names {
+			if val, ok := rec.vals[i].(string); ok {
+				labels = append(labels, name, val)
+			} else {
+				stats[name] = rec.vals[i]
+			}
+		}
+		r.reg.add(stats, labels...)
+	}
+	return nil
+}
+
+func (r *promRenderer) beginList(store string) error {
+	return usageErrorf("the %s output format is only supported by stats",
+		promOutput)
+}
+
+func (r *promRenderer) item(doc interface{}, rec *record) error {
+	return nil
+}
+
+func (r *promRenderer) endList() error {
+	return nil
+}
+
+// storeError is emitted as a comment, which scrapers ignore.
+func (r *promRenderer) storeError(store string, err error) error {
+	r.errors = append(r.errors, fmt.Sprintf("# store \"%s\" failed: %s",
+		promEscape(store), promEscape(err.Error())))
+	return nil
+}
+
+func (r *promRenderer) close() error {
+	for _, e := range r.errors {
+		fmt.Fprintln(r.w, e)
+	}
+	r.reg.emit(r.w)
+	return nil
+}
+
+// promFamily is a metric family, whose samples are emitted together
+// under a single TYPE line as the exposition format requires.
+type promFamily struct {
+	name    string
+	help    string
+	typ     string
+	samples []string
+}
+
+// promCounters are the stats of moss.Store.Stats() that only go up
+// while a store is open, which are typed as counters and named with a
+// "_total" suffix instead as the exposition format requires, such as
+// moss_persists_total for total_persists. The total_ stats of a footer
+// describe its data, which shrinks on compaction, so they are gauges.
+var promCounters = map[string]bool{
+	"total_persists":                  true,
+	"total_compactions":               true,
+	"total_compactions_partial":       true,
+	"total_compaction_before_bytes":   true,
+	"total_compaction_written_bytes":  true,
+	"total_compaction_decrease_bytes": true,
+	"total_compaction_increase_bytes": true,
+}
+
+// promRegistry gathers metrics from all the stores of a run, so that
+// they can be emitted grouped by family.
+type promRegistry struct {
+	families map[string]*promFamily
+	order    []string
+}
+
+func newPromRegistry() *promRegistry {
+	return &promRegistry{families: make(map[string]*promFamily)}
+}
+
+// add registers every numeric stat as a sample of the family
+// "moss_<stat>", carrying the provided label name/value pairs, typed
+// as a gauge unless it is one of the promCounters. Per-segment slices
+// are emitted as one sample per segment with an additional "segment"
+// label, non-numeric stats are skipped.
+func (r *promRegistry) add(stats map[string]interface{}, labels ...string) {
+	var keys []string
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if vals, ok := stats[k].([]uint64); ok {
+			for i, v := range vals {
+				r.addSample(k, strconv.FormatUint(v, 10),
+					append(labels, "segment", strconv.Itoa(i))...)
+			}
+			continue
+		}
+
+		if val, ok := promValue(stats[k]); ok {
+			r.addSample(k, val, labels...)
+		}
+	}
+}
+
+func (r *promRegistry) addSample(stat string, val string, labels ...string) {
+	name, typ := "moss_"+promName(stat), "gauge"
+	if promCounters[stat] {
+		name = "moss_" + promName(strings.TrimPrefix(stat, "total_")) +
+			"_total"
+		typ = "counter"
+	}
+
+	f := r.families[name]
+	if f == nil {
+		f = &promFamily{name: name, typ: typ,
+			help: fmt.Sprintf("Moss store stat %s.", stat)}
+		r.families[name] = f
+		r.order = append(r.order, name)
+	}
+
+	var pairs []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"",
+			promName(labels[i]), promEscape(labels[i+1])))
+	}
+
+	sample := name
+	if len(pairs) > 0 {
+		sample += "{" + strings.Join(pairs, ",") + "}"
+	}
+	f.samples = append(f.samples, sample+" "+val)
+}
+
+// emit prints all the gathered families in the Prometheus text
+// exposition format.
+func (r *promRegistry) emit(w io.Writer) {
+	for _, name := range r.order {
+		f := r.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", f.name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+		for _, s := range f.samples {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
+
+func promValue(v interface{}) (string, bool) {
+	switch n := v.(type) {
+	case uint64:
+		return strconv.FormatUint(n, 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(n), 10), true
+	case uint:
+		return strconv.FormatUint(uint64(n), 10), true
+	case int64:
+		return strconv.FormatInt(n, 10), true
+	case int32:
+		return strconv.FormatInt(int64(n), 10), true
+	case int:
+		return strconv.Itoa(n), true
+	case float64:
+		return strconv.FormatFloat(n, 'g', -1, 64), true
+	case float32:
+		return strconv.FormatFloat(float64(n), 'g', -1, 32), true
+	}
+	return "", false
+}
+
+// promName maps a stat name to the [a-zA-Z0-9_:] charset allowed
+// in metric and label names.
+func promName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(r >= '0' && r <= '9') || r == '_' || r == ':' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+var promEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
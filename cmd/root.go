@@ -12,7 +12,6 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/couchbase/moss"
 	"github.com/spf13/cobra"
 )
 
@@ -24,19 +23,62 @@ var RootCmd = &cobra.Command{
 directories. It comprises of a dump facility with options, stats
 facility with options, an option to compact the specified moss
 store, among other things.`,
+
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		err := checkParallel()
+		if err != nil {
+			return err
+		}
+		return checkOutputFormat()
+	},
+
+	// Errors are emitted by Execute, along with the usage if need be
+	SilenceErrors: true,
+	SilenceUsage:  true,
 }
 
 var version = "0.1.0"
 var keyPrefix string
 
-var readOnlyMode = moss.StoreOptions{KeepFiles: true,
-	CollectionOptions: moss.CollectionOptions{ReadOnly: true}}
-
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
-	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+	os.Exit(execute(RootCmd))
+}
+
+// execute runs the root command, emits any error to its error writer
+// and returns the exit code.
+func execute(root *cobra.Command) int {
+	cmd, err := root.ExecuteC()
+	if err == nil {
+		return exitOK
+	}
+
+	asJSON := jsonFormat || outputFormat == jsonOutput ||
+		outputFormat == ndjsonOutput
+
+	code := exitCode(err)
+	emitError(root.ErrOrStderr(), err, code, asJSON)
+	if code == exitUsage && !asJSON {
+		fmt.Fprint(root.ErrOrStderr(), cmd.UsageString())
 	}
+
+	return code
+}
+
+func init() {
+	RootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "",
+		"Output format: table, json, ndjson, csv, tsv, yaml or prometheus "+
+			"(default: specific to the command)")
+	RootCmd.PersistentFlags().IntVar(&parallel, "parallel", 1,
+		"Number of stores to process concurrently")
+	RootCmd.PersistentFlags().BoolVar(&keepGoing, "keep-going", false,
+		"Skips the stores that fail, reporting them in the output "+
+			"and the exit code")
+	RootCmd.PersistentFlags().BoolVar(&recursive, "recursive", false,
+		"Processes every moss store found below the specified paths")
+
+	RootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return &exitError{code: exitUsage, err: err}
+	})
 }
@@ -0,0 +1,145 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema",
+	Short: "Infers the schema of the JSON values in the store",
+	Long: `This command parses the values of the store as JSON (or with
+--value-decoder), and dumps the inferred schema: the paths of the
+fields found in the values, along with the types, frequencies, lengths
+and examples of their values. The number of values that failed to
+decode is only emitted in the json and yaml output formats.
+	./mossScope stats schema <path_to_store>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return usageErrorf("at least one path is required")
+		}
+		if schemaExamples < 0 {
+			return usageErrorf("examples must not be negative")
+		}
+		err := checkKeyValDecoders()
+		if err != nil {
+			return err
+		}
+		return checkKeyFilter()
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeSchemaStats(cmd.OutOrStdout(), dirs)
+	},
+}
+
+var schemaExamples int
+
+func invokeSchemaStats(w io.Writer, dirs []string) error {
+	r, err := newRenderer(w, tableOutput)
+	if err != nil {
+		return err
+	}
+
+	var failures storeFailures
+
+	err = forEachStore(dirs, func(dir string,
+		store *moss.Store) (interface{}, error) {
+		return scope.FetchSchema(store, scope.SchemaOptions{
+			Prefix:   keyPrefix,
+			Filter:   keyFilter,
+			Decoder:  valueDecoder,
+			Examples: schemaExamples,
+		})
+	}, func(dir string, val interface{}) error {
+		schema := val.(*scope.Schema)
+
+		recs := make([]*record, 0, len(schema.Fields))
+		for _, f := range schema.Fields {
+			var examples interface{} = ""
+			if len(f.Examples) > 0 {
+				examples = recordValue(f.Examples)
+			}
+			recs = append(recs, (&record{}).add("path", f.Path).
+				add("docs", f.Docs).
+				add("frequency", fmt.Sprintf("%.2f%%", f.Frequency)).
+				add("types", schemaTypes(f.Types)).
+				add("min_length", intOrEmpty(f.MinLength)).
+				add("max_length", intOrEmpty(f.MaxLength)).
+				add("examples", examples))
+		}
+
+		return r.section(dir, schema, recs)
+	}, failures.report(r))
+	if err != nil {
+		return err
+	}
+
+	err = r.close()
+	if err != nil {
+		return err
+	}
+
+	return failures.err()
+}
+
+// schemaTypes returns the types of a field along with their counts,
+// such as "number:10 string:2", most frequent first.
+func schemaTypes(types map[string]uint64) string {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if types[names[i]] != types[names[j]] {
+			return types[names[i]] > types[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s:%d", name, types[name])
+	}
+	return strings.Join(names, " ")
+}
+
+func intOrEmpty(i *int) interface{} {
+	if i == nil {
+		return ""
+	}
+	return *i
+}
+
+func init() {
+	statsCmd.AddCommand(schemaCmd)
+
+	// Local flags that are intended to work with stats schema
+	schemaCmd.Flags().StringVar(&keyPrefix, "key-prefix", "",
+		"Infers the schema of the values of keys with the specified prefix")
+	addKeyFilterFlags(schemaCmd)
+	schemaCmd.Flags().StringVar(&valueDecoderSpec, "value-decoder", "",
+		"Decodes the values, such as: snappy+json, msgpack, cbor "+
+			"(default: json)")
+	schemaCmd.Flags().IntVar(&schemaExamples, "examples", 3,
+		"Max number of distinct example values per path")
+}
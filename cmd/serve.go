@@ -0,0 +1,375 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/ghistogram"
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Serves the stores over a REST API",
+	Long: `This command starts an HTTP server that exposes the dump and
+stats facilities for the specified stores, returning JSON. A store
+is addressed by the base name of its directory.
+	GET /stores
+	GET /stores/{name}/footers
+	GET /stores/{name}/keys?start=&end=&prefix=&limit=&hex=
+	GET /stores/{name}/keys/{key}?all-versions=&hex=
+	GET /stores/{name}/stats/{diag|footer|frag|hist}
+For example:
+	./mossScope serve --listen :8080 <path_to_store(s)>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return usageErrorf("at least one path is required")
+		}
+		return nil
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeServe(cmd.OutOrStdout(), dirs)
+	},
+}
+
+var listenAddr string
+
+// defaultKeysLimit caps the number of key-values returned by the
+// keys endpoint when no limit is requested.
+const defaultKeysLimit = 1000
+
+func invokeServe(w io.Writer, dirs []string) error {
+	server, err := newStoreServer(dirs)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "Serving %d store(s) on %s\n", len(dirs), listenAddr)
+
+	return http.ListenAndServe(listenAddr, server)
+}
+
+// storeServer is the http.Handler serving the REST API, every request
+// opens the addressed store read-only for its own duration.
+type storeServer struct {
+	dirs  map[string]string // Store name -> store directory.
+	names []string
+}
+
+func newStoreServer(dirs []string) (*storeServer, error) {
+	s := &storeServer{dirs: make(map[string]string)}
+	for _, dir := range dirs {
+		name := filepath.Base(filepath.Clean(dir))
+		if _, exists := s.dirs[name]; exists {
+			return nil, fmt.Errorf("stores with the same name: %s, %s",
+				s.dirs[name], dir)
+		}
+		s.dirs[name] = dir
+		s.names = append(s.names, name)
+	}
+	return s, nil
+}
+
+type storeInfo struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type keyHistogram struct {
+	Ranges []uint64 `json:"ranges"`
+	Counts []uint64 `json:"counts"`
+	Total  uint64   `json:"total"`
+}
+
+func (s *storeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed,
+			fmt.Errorf("method not allowed: %s", r.Method))
+		return
+	}
+
+	// Split the escaped path, so that keys can hold (escaped) slashes
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i := range parts {
+		part, err := url.PathUnescape(parts[i])
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err)
+			return
+		}
+		parts[i] = part
+	}
+
+	if parts[0] != "stores" {
+		writeJSONError(w, http.StatusNotFound,
+			fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	if len(parts) == 1 {
+		stores := make([]storeInfo, 0, len(s.names))
+		for _, name := range s.names {
+			stores = append(stores, storeInfo{Name: name, Path: s.dirs[name]})
+		}
+		writeJSON(w, http.StatusOK, stores)
+		return
+	}
+
+	dir, exists := s.dirs[parts[1]]
+	if !exists {
+		writeJSONError(w, http.StatusNotFound,
+			fmt.Errorf("unknown store: %s", parts[1]))
+		return
+	}
+
+	if len(parts) < 3 || len(parts) > 4 {
+		writeJSONError(w, http.StatusNotFound,
+			fmt.Errorf("not found: %s", r.URL.Path))
+		return
+	}
+
+	store, err := scope.OpenStore(dir)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	defer store.Close()
+
+	query := r.URL.Query()
+
+	var status int
+	var resp interface{}
+
+	switch {
+	case parts[2] == "footers" && len(parts) == 3:
+		status, resp, err = s.footers(store)
+	case parts[2] == "keys" && len(parts) == 3:
+		status, resp, err = s.keys(store, query)
+	case parts[2] == "keys":
+		status, resp, err = s.key(store, parts[3], query)
+	case parts[2] == "stats" && len(parts) == 4:
+		status, resp, err = s.stats(store, parts[3])
+	default:
+		status, err = http.StatusNotFound,
+			fmt.Errorf("not found: %s", r.URL.Path)
+	}
+
+	if err != nil {
+		writeJSONError(w, status, err)
+		return
+	}
+
+	writeJSON(w, status, resp)
+}
+
+func (s *storeServer) footers(store *moss.Store) (int, interface{}, error) {
+	var footers []json.RawMessage
+	err := scope.WalkFooters(store, true,
+		func(id int, footer *moss.Footer) error {
+			jBuf, err := json.Marshal(footer)
+			if err != nil {
+				return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+			}
+			footers = append(footers, jBuf)
+			return nil
+		})
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	return http.StatusOK, footers, nil
+}
+
+func (s *storeServer) keys(store *moss.Store,
+	query url.Values) (int, interface{}, error) {
+	toHex, err := queryBool(query, "hex")
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	limit := defaultKeysLimit
+	if query.Get("limit") != "" {
+		limit, err = strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			return http.StatusBadRequest, nil,
+				fmt.Errorf("invalid limit: %s", query.Get("limit"))
+		}
+	}
+
+	var start, end []byte
+	if query.Get("start") != "" {
+		start = []byte(query.Get("start"))
+	}
+	if query.Get("end") != "" {
+		end = []byte(query.Get("end"))
+	}
+
+	d, err := scope.Dump(store, scope.DumpOptions{Start: start, End: end,
+		Prefix: query.Get("prefix"), Limit: limit})
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	defer d.Close()
+
+	kvs := []keyVal{}
+	for d.Next() {
+		rec := d.Record()
+		kvs = append(kvs, encodeKeyVal(rec.Key, rec.Val, toHex))
+	}
+	if d.Err() != nil {
+		return http.StatusInternalServerError, nil, d.Err()
+	}
+	return http.StatusOK, kvs, nil
+}
+
+func (s *storeServer) key(store *moss.Store, key string,
+	query url.Values) (int, interface{}, error) {
+	all, err := queryBool(query, "all-versions")
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	toHex, err := queryBool(query, "hex")
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+
+	if all {
+		// The same history as dump key --all-versions
+		history, err := scope.FetchKeyHistory(store, []byte(key))
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		if len(history) == 1 && history[0].State == scope.KeyAbsent {
+			return http.StatusNotFound, nil,
+				fmt.Errorf("key not found: %s", key)
+		}
+
+		docs := make([]keyHistoryOutput, 0, len(history))
+		for _, entry := range history {
+			docs = append(docs, keyHistoryDoc([]byte(key), entry, toHex))
+		}
+		return http.StatusOK, docs, nil
+	}
+
+	versions, err := scope.FetchKeyVersions(store, []byte(key), false)
+	if err != nil {
+		return http.StatusInternalServerError, nil, err
+	}
+	if len(versions) == 0 {
+		return http.StatusNotFound, nil, fmt.Errorf("key not found: %s", key)
+	}
+
+	kvs := make([]keyVal, 0, len(versions))
+	for _, version := range versions {
+		kvs = append(kvs, encodeKeyVal([]byte(key), version.Val, toHex))
+	}
+	return http.StatusOK, kvs, nil
+}
+
+func (s *storeServer) stats(store *moss.Store,
+	kind string) (int, interface{}, error) {
+	switch kind {
+	case "diag":
+		stats, err := scope.FetchDiagStats(store)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		return http.StatusOK, stats, nil
+	case "footer":
+		stats, err := scope.FetchFooterStats(store, true)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		footerStats := make(map[string]scope.FooterStats)
+		for i, fstats := range stats {
+			footerStats[fmt.Sprintf("Footer_%d", i+1)] = fstats
+		}
+		return http.StatusOK, footerStats, nil
+	case "frag":
+		stats, err := scope.FetchFragStats(store)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		return http.StatusOK, stats, nil
+	case "hist":
+		h, err := scope.FetchHistograms(store, "", nil)
+		if err != nil {
+			return http.StatusInternalServerError, nil, err
+		}
+		return http.StatusOK, map[string]keyHistogram{
+			"key_sizes": toKeyHistogram(h.KeySizes),
+			"val_sizes": toKeyHistogram(h.ValSizes),
+		}, nil
+	}
+	return http.StatusNotFound, nil, fmt.Errorf("unknown stats: %s", kind)
+}
+
+func encodeKeyVal(key, val []byte, toHex bool) keyVal {
+	if toHex {
+		return keyVal{Key: hex.EncodeToString(key),
+			Val: hex.EncodeToString(val)}
+	}
+	return keyVal{Key: string(key), Val: string(val)}
+}
+
+func toKeyHistogram(h *ghistogram.Histogram) keyHistogram {
+	return keyHistogram{Ranges: h.Ranges, Counts: h.Counts, Total: h.TotCount}
+}
+
+func queryBool(query url.Values, name string) (bool, error) {
+	if query.Get(name) == "" {
+		return false, nil
+	}
+	b, err := strconv.ParseBool(query.Get(name))
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %s", name, query.Get(name))
+	}
+	return b, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	jBuf, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		jBuf, _ = json.Marshal(map[string]string{
+			"error": fmt.Sprintf("Json-Marshal() failed!, err: %v", err)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jBuf)
+	w.Write([]byte("\n"))
+}
+
+func writeJSONError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+
+	// Local flag that is intended to work with serve
+	serveCmd.Flags().StringVar(&listenAddr, "listen", ":8080",
+		"Address (host:port) to serve the REST API on")
+}
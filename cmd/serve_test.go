@@ -0,0 +1,138 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serveHelper(t *testing.T, ts *httptest.Server, path string,
+	status int, resp interface{}) {
+	res, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("Expected GET %s to work, err: %v", path, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != status {
+		t.Errorf("Unexpected status for %s: %d!", path, res.StatusCode)
+	}
+
+	err = json.NewDecoder(res.Body).Decode(resp)
+	if err != nil {
+		t.Errorf("Expected JSON response for %s, err: %v", path, err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	server, err := newStoreServer([]string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	var stores []storeInfo
+	serveHelper(t, ts, "/stores", http.StatusOK, &stores)
+	if len(stores) != 1 || stores[0].Name != dir {
+		t.Errorf("Unexpected stores: %v!", stores)
+	}
+
+	var kvs []keyVal
+	serveHelper(t, ts, "/stores/"+dir+"/keys", http.StatusOK, &kvs)
+	if len(kvs) != itemCount {
+		t.Errorf("Incorrect number of entries: %d!", len(kvs))
+	}
+
+	kvs = nil
+	serveHelper(t, ts, "/stores/"+dir+"/keys?start=key2&limit=3",
+		http.StatusOK, &kvs)
+	if len(kvs) != 3 || kvs[0].Key != "key2" || kvs[2].Key != "key4" {
+		t.Errorf("Unexpected entries: %v!", kvs)
+	}
+
+	kvs = nil
+	serveHelper(t, ts, "/stores/"+dir+"/keys?prefix=key7",
+		http.StatusOK, &kvs)
+	if len(kvs) != 1 || kvs[0].Val != "val7" {
+		t.Errorf("Unexpected entries: %v!", kvs)
+	}
+
+	for i := 0; i < itemCount; i++ {
+		kvs = nil
+		serveHelper(t, ts, fmt.Sprintf("/stores/%s/keys/key%d", dir, i),
+			http.StatusOK, &kvs)
+		if len(kvs) != 1 || kvs[0].Val != fmt.Sprintf("val%d", i) {
+			t.Errorf("Unexpected entries: %v!", kvs)
+		}
+	}
+
+	var history []map[string]interface{}
+	serveHelper(t, ts, "/stores/"+dir+"/keys/key3?all-versions=true",
+		http.StatusOK, &history)
+	if len(history) != 1 || history[0]["state"] != "present" ||
+		history[0]["footer"] != float64(1) ||
+		history[0]["since_footer"] != float64(1) ||
+		history[0]["offset"] == nil || history[0]["v"] != "val3" {
+		t.Errorf("Unexpected history: %v!", history)
+	}
+
+	var footers []interface{}
+	serveHelper(t, ts, "/stores/"+dir+"/footers", http.StatusOK, &footers)
+	if len(footers) != 1 {
+		t.Errorf("Unexpected number of footers: %d!", len(footers))
+	}
+
+	var stats map[string]interface{}
+	serveHelper(t, ts, "/stores/"+dir+"/stats/diag", http.StatusOK, &stats)
+	if stats["total_ops_set"] != float64(itemCount) {
+		t.Errorf("Unexpected total_ops_set: %v!", stats["total_ops_set"])
+	}
+
+	stats = nil
+	serveHelper(t, ts, "/stores/"+dir+"/stats/frag", http.StatusOK, &stats)
+	if stats["dir_size"] == nil {
+		t.Errorf("Expected an entry for dir_size!")
+	}
+
+	var hists map[string]keyHistogram
+	serveHelper(t, ts, "/stores/"+dir+"/stats/hist", http.StatusOK, &hists)
+	if hists["key_sizes"].Total != uint64(itemCount) {
+		t.Errorf("Unexpected key_sizes total: %d!", hists["key_sizes"].Total)
+	}
+
+	var errResp map[string]string
+	serveHelper(t, ts, "/stores/"+dir+"/keys/missing", http.StatusNotFound,
+		&errResp)
+	if errResp["error"] == "" {
+		t.Errorf("Expected an error for a missing key!")
+	}
+
+	errResp = nil
+	serveHelper(t, ts, "/stores/unknown/footers", http.StatusNotFound,
+		&errResp)
+	if errResp["error"] == "" {
+		t.Errorf("Expected an error for an unknown store!")
+	}
+
+	errResp = nil
+	serveHelper(t, ts, "/stores/"+dir+"/keys?limit=x", http.StatusBadRequest,
+		&errResp)
+	if errResp["error"] == "" {
+		t.Errorf("Expected an error for an invalid limit!")
+	}
+}
@@ -0,0 +1,576 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// shellCmd represents the shell command
+var shellCmd = &cobra.Command{
+	Use:   "shell",
+	Short: "Opens an interactive shell for browsing the store",
+	Long: `Opens the store once, and keeps a snapshot of it open for
+answering any number of questions, with command history and tab
+completion. Type "help" in the shell for the available commands.
+For example:
+	./mossScope shell <path_to_store>`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return usageErrorf("exactly one path is required")
+		}
+		return nil
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return invokeShell(cmd.InOrStdin(), cmd.OutOrStdout(), args[0])
+	},
+}
+
+var shellLimit int
+
+var shellHelp = `Available commands:
+    get <key>                 Emits the value of the key
+    scan [start [end]]        Emits the key-values within [start, end)
+    prefix <prefix>           Emits the key-values beginning with prefix
+    limit [n]                 Shows or sets the max entries emitted by a scan
+    footers                   Lists the available footers (1 is latest)
+    use footer <n>            Switches to the snapshot of footer n
+    collections               Lists the child collections of the snapshot
+    use collection [name]     Switches to a child collection (or back)
+    stats                     Emits the stats of the current snapshot
+    help                      Emits this help
+    exit                      Exits the shell
+Keys holding spaces may be specified as quoted strings, e.g. "my key".`
+
+var shellCommands = []string{"collections", "exit", "footers", "get",
+	"help", "limit", "prefix", "scan", "stats", "use"}
+
+// shellSession holds the store and the snapshot that a shell browses.
+type shellSession struct {
+	dir   string
+	store *moss.Store
+
+	footer   moss.Snapshot // Snapshot of the selected footer.
+	footerID int           // 1 for the latest footer.
+	child    moss.Snapshot // Snapshot of the selected child collection.
+	collName string
+
+	limit int
+	out   io.Writer
+}
+
+func invokeShell(in io.Reader, out io.Writer, dir string) error {
+	sess, err := newShellSession(dir, out)
+	if err != nil {
+		return err
+	}
+	defer sess.close()
+
+	f, ok := in.(*os.File)
+	if !ok || !term.IsTerminal(int(f.Fd())) {
+		return runShell(sess, in)
+	}
+	fd := int(f.Fd())
+
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("Terminal-MakeRaw() failed, err: %v", err)
+	}
+	defer term.Restore(fd, oldState)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{in, out}, sess.prompt())
+	t.AutoCompleteCallback = sess.complete
+	sess.out = t
+
+	fmt.Fprintln(t, `Type "help" for the available commands.`)
+
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if !sess.exec(line) {
+			return nil
+		}
+		t.SetPrompt(sess.prompt())
+	}
+}
+
+// runShell executes the commands read from r, one per line, without
+// any prompts, which allows for scripting the shell.
+func runShell(sess *shellSession, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if !sess.exec(scanner.Text()) {
+			return nil
+		}
+	}
+	return scanner.Err()
+}
+
+func newShellSession(dir string, out io.Writer) (*shellSession, error) {
+	store, err := scope.OpenStore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	sess := &shellSession{dir: dir, store: store, limit: shellLimit, out: out}
+
+	err = sess.useFooter(1)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func (s *shellSession) close() {
+	if s.child != nil {
+		s.child.Close()
+	}
+	if s.footer != nil {
+		s.footer.Close()
+	}
+	s.store.Close()
+}
+
+// snapshot returns the snapshot that the commands operate on.
+func (s *shellSession) snapshot() moss.Snapshot {
+	if s.child != nil {
+		return s.child
+	}
+	return s.footer
+}
+
+func (s *shellSession) prompt() string {
+	p := fmt.Sprintf("%s@Footer_%d", filepath.Base(s.dir), s.footerID)
+	if s.collName != "" {
+		p += "/" + s.collName
+	}
+	return p + "> "
+}
+
+// exec executes a single command line, and returns false once the
+// shell is to be exited.
+func (s *shellSession) exec(line string) bool {
+	args, err := shellSplit(line)
+	if err != nil {
+		fmt.Fprintf(s.out, "error: %v\n", err)
+		return true
+	}
+	if len(args) == 0 {
+		return true
+	}
+
+	switch args[0] {
+	case "get":
+		err = s.checkArgs(args, 2, 2, "get <key>")
+		if err == nil {
+			err = s.get(args[1])
+		}
+	case "scan":
+		err = s.checkArgs(args, 1, 3, "scan [start [end]]")
+		if err == nil {
+			var start, end []byte
+			if len(args) > 1 {
+				start = []byte(args[1])
+			}
+			if len(args) > 2 {
+				end = []byte(args[2])
+			}
+			err = s.scan(start, end, "")
+		}
+	case "prefix":
+		err = s.checkArgs(args, 2, 2, "prefix <prefix>")
+		if err == nil {
+			err = s.scan([]byte(args[1]), nil, args[1])
+		}
+	case "limit":
+		err = s.checkArgs(args, 1, 2, "limit [n]")
+		if err == nil && len(args) == 2 {
+			var n int
+			n, err = strconv.Atoi(args[1])
+			if err == nil && n <= 0 {
+				err = fmt.Errorf("limit must be greater than zero")
+			}
+			if err == nil {
+				s.limit = n
+			}
+		}
+		if err == nil {
+			fmt.Fprintf(s.out, "limit: %d\n", s.limit)
+		}
+	case "footers":
+		err = s.checkArgs(args, 1, 1, "footers")
+		if err == nil {
+			err = s.footers()
+		}
+	case "use":
+		err = s.use(args)
+	case "collections":
+		err = s.checkArgs(args, 1, 1, "collections")
+		if err == nil {
+			err = s.collections()
+		}
+	case "stats":
+		err = s.checkArgs(args, 1, 1, "stats")
+		if err == nil {
+			err = s.stats()
+		}
+	case "help":
+		fmt.Fprintln(s.out, shellHelp)
+	case "exit", "quit":
+		return false
+	default:
+		err = fmt.Errorf("unknown command: %s, see \"help\"", args[0])
+	}
+
+	if err != nil {
+		fmt.Fprintf(s.out, "error: %v\n", err)
+	}
+
+	return true
+}
+
+func (s *shellSession) checkArgs(args []string, min, max int,
+	usage string) error {
+	if len(args) < min || len(args) > max {
+		return fmt.Errorf("usage: %s", usage)
+	}
+	return nil
+}
+
+func (s *shellSession) emit(key, val []byte) error {
+	jBuf, err := json.Marshal(encodeKeyVal(key, val, inHex))
+	if err != nil {
+		return fmt.Errorf("Json-Marshal() failed!, err: %v", err)
+	}
+	fmt.Fprintln(s.out, string(jBuf))
+	return nil
+}
+
+func (s *shellSession) get(key string) error {
+	val, err := s.snapshot().Get([]byte(key), moss.ReadOptions{})
+	if err != nil {
+		return fmt.Errorf("Snapshot-Get() API failed, err: %v", err)
+	}
+	if val == nil {
+		return fmt.Errorf("key not found: %s", key)
+	}
+	return s.emit([]byte(key), val)
+}
+
+func (s *shellSession) scan(start, end []byte, prefix string) error {
+	// One more than the limit is loaded, to find out if it's reached
+	d, err := scope.DumpSnapshot(s.snapshot(), scope.DumpOptions{
+		Start: start, End: end, Prefix: prefix, Limit: s.limit + 1})
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	n := 0
+	for d.Next() {
+		if n == s.limit {
+			fmt.Fprintf(s.out, "... (limit of %d reached, see \"limit\")\n",
+				s.limit)
+			break
+		}
+
+		rec := d.Record()
+		err = s.emit(rec.Key, rec.Val)
+		if err != nil {
+			return err
+		}
+		n++
+	}
+
+	fmt.Fprintf(s.out, "(%d entries)\n", n)
+	return d.Err()
+}
+
+func (s *shellSession) footers() error {
+	return scope.WalkFooters(s.store, true,
+		func(id int, footer *moss.Footer) error {
+			stats := scope.GetFooterStats(footer)
+
+			marker := " "
+			if id == s.footerID {
+				marker = "*"
+			}
+			fmt.Fprintf(s.out, "%s Footer_%d: num_segments=%d "+
+				"total_ops_set=%d total_ops_del=%d total_key_bytes=%d "+
+				"total_val_bytes=%d\n", marker, id, stats.NumSegments,
+				stats.TotalOpsSet, stats.TotalOpsDel, stats.TotalKeyBytes,
+				stats.TotalValBytes)
+			return nil
+		})
+}
+
+func (s *shellSession) use(args []string) error {
+	if len(args) >= 2 && args[1] == "footer" && len(args) == 3 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n <= 0 {
+			return fmt.Errorf("invalid footer: %s", args[2])
+		}
+		return s.useFooter(n)
+	}
+
+	if len(args) >= 2 && args[1] == "collection" && len(args) <= 3 {
+		name := ""
+		if len(args) == 3 {
+			name = args[2]
+		}
+		return s.useCollection(name)
+	}
+
+	return fmt.Errorf("usage: use footer <n> | use collection [name]")
+}
+
+// useFooter switches to the snapshot of the n'th footer, where 1 is
+// the latest, walking back from the latest footer.
+func (s *shellSession) useFooter(n int) error {
+	snap, err := scope.SnapshotAt(s.store, n)
+	if err != nil {
+		return err
+	}
+
+	if s.child != nil {
+		s.child.Close()
+		s.child, s.collName = nil, ""
+	}
+	if s.footer != nil {
+		s.footer.Close()
+	}
+	s.footer, s.footerID = snap, n
+
+	return nil
+}
+
+// useCollection switches to the named child collection of the
+// selected footer, or back to the top-level collection if no name is
+// provided.
+func (s *shellSession) useCollection(name string) error {
+	var child moss.Snapshot
+	if name != "" {
+		var err error
+		child, err = s.footer.ChildCollectionSnapshot(name)
+		if err != nil {
+			return fmt.Errorf("Snapshot-ChildCollectionSnapshot() API "+
+				"failed, err: %v", err)
+		}
+		if child == nil {
+			return fmt.Errorf("collection not found: %s", name)
+		}
+	}
+
+	if s.child != nil {
+		s.child.Close()
+	}
+	s.child, s.collName = child, name
+
+	return nil
+}
+
+func (s *shellSession) collections() error {
+	names, err := s.footer.ChildCollectionNames()
+	if err != nil {
+		return fmt.Errorf("Snapshot-ChildCollectionNames() API failed, "+
+			"err: %v", err)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintln(s.out, name)
+	}
+	fmt.Fprintf(s.out, "(%d collections)\n", len(names))
+
+	return nil
+}
+
+func (s *shellSession) stats() error {
+	stats, err := s.store.Stats()
+	if err != nil {
+		return fmt.Errorf("Store-Stats() failed!, err: %v", err)
+	}
+
+	// The stats of the selected footer take precedence over the store
+	// stats, which always reflect the latest footer
+	if footer, ok := s.snapshot().(*moss.Footer); ok {
+		for k, v := range scope.GetFooterStats(footer).Map() {
+			stats[k] = v
+		}
+	}
+
+	var keys []string
+	for k := range stats {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(s.out, "%35s : %v\n", k, stats[k])
+	}
+
+	return nil
+}
+
+// complete is the tab completion callback of the terminal, which
+// completes command names, "use" targets and keys of the snapshot.
+func (s *shellSession) complete(line string, pos int,
+	key rune) (string, int, bool) {
+	if key != '\t' || pos != len(line) {
+		return "", 0, false
+	}
+
+	// The last field is the (possibly empty) word being completed
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasSuffix(line, " ") {
+		fields = append(fields, "")
+	}
+
+	word := fields[len(fields)-1]
+
+	var candidates []string
+	switch {
+	case len(fields) == 1:
+		candidates = filterPrefix(shellCommands, word)
+	case fields[0] == "use" && len(fields) == 2:
+		candidates = filterPrefix([]string{"collection", "footer"}, word)
+	case fields[0] == "use" && fields[1] == "collection" && len(fields) == 3:
+		names, _ := s.footer.ChildCollectionNames()
+		candidates = filterPrefix(names, word)
+	case fields[0] == "get" || fields[0] == "scan" || fields[0] == "prefix":
+		candidates = s.completeKey(word)
+	}
+
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+
+	completion := longestCommonPrefix(candidates)
+	if len(candidates) == 1 && len(fields) == 1 {
+		completion += " "
+	}
+	if len(completion) <= len(word) {
+		return "", 0, false
+	}
+
+	newLine := line[:len(line)-len(word)] + completion
+	return newLine, len(newLine), true
+}
+
+// completeKey returns up to a hundred keys that begin with the word.
+func (s *shellSession) completeKey(word string) []string {
+	iter, err := s.snapshot().StartIterator([]byte(word), nil,
+		moss.IteratorOptions{})
+	if err != nil || iter == nil {
+		return nil
+	}
+	defer iter.Close()
+
+	var keys []string
+	for err = error(nil); err == nil && len(keys) < 100; err = iter.Next() {
+		var k []byte
+		k, _, err = iter.Current()
+		if err != nil || !strings.HasPrefix(string(k), word) {
+			break
+		}
+		// Keys with whitespace can't be completed as a single word
+		if !strings.ContainsAny(string(k), " \t") {
+			keys = append(keys, string(k))
+		}
+	}
+	return keys
+}
+
+func filterPrefix(words []string, prefix string) []string {
+	var out []string
+	for _, w := range words {
+		if strings.HasPrefix(w, prefix) {
+			out = append(out, w)
+		}
+	}
+	return out
+}
+
+func longestCommonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// shellSplit splits a command line into whitespace separated words,
+// where a word can also be a double quoted Go string literal.
+func shellSplit(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("unterminated quoted string")
+		}
+		arg, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		line = line[len(quoted):]
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(shellCmd)
+
+	// Local flags that are intended to work with shell
+	shellCmd.Flags().IntVar(&shellLimit, "limit", 100,
+		"Max number of key-values emitted by a scan")
+	shellCmd.Flags().BoolVar(&inHex, "hex", false,
+		"Emits output in hex")
+}
@@ -0,0 +1,145 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func shellHelper(t *testing.T, sess *shellSession, commands string) string {
+	var buf bytes.Buffer
+	sess.out = &buf
+
+	err := runShell(sess, strings.NewReader(commands))
+	if err != nil {
+		t.Error(err)
+	}
+
+	return buf.String()
+}
+
+func TestShell(t *testing.T) {
+	// Footer 1 (1 segment)
+	_, store, coll := setup(t, true)
+	cleanup("", store, coll)
+
+	// Footer 2 (2 segments)
+	dir, store, coll := setup(t, false)
+	defer cleanup(dir, store, coll)
+
+	shellLimit = 100
+	sess, err := newShellSession(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+
+	out := shellHelper(t, sess, "get key3\n")
+	if out != "{\"k\":\"key3\",\"v\":\"val3\"}\n" {
+		t.Errorf("Unexpected output for get: %s", out)
+	}
+
+	out = shellHelper(t, sess, "get missing\n")
+	if !strings.HasPrefix(out, "error: key not found") {
+		t.Errorf("Unexpected output for missing get: %s", out)
+	}
+
+	out = shellHelper(t, sess, "scan key2 key5\n")
+	if strings.Count(out, "\"k\"") != 3 || !strings.Contains(out, "(3 entries)") {
+		t.Errorf("Unexpected output for scan: %s", out)
+	}
+
+	out = shellHelper(t, sess, "limit 2\nscan\nlimit 100\n")
+	if strings.Count(out, "\"k\"") != 2 || !strings.Contains(out, "limit of 2") {
+		t.Errorf("Unexpected output for limited scan: %s", out)
+	}
+
+	out = shellHelper(t, sess, "prefix key9\n")
+	if strings.Count(out, "\"k\"") != 1 {
+		t.Errorf("Unexpected output for prefix: %s", out)
+	}
+
+	out = shellHelper(t, sess, "footers\n")
+	if !strings.Contains(out, "* Footer_1: num_segments=2") ||
+		!strings.Contains(out, "  Footer_2: num_segments=1") {
+		t.Errorf("Unexpected output for footers: %s", out)
+	}
+
+	out = shellHelper(t, sess, "use footer 2\nstats\n")
+	if sess.footerID != 2 || !strings.Contains(out, "num_segments : 1") {
+		t.Errorf("Unexpected output for footer 2 stats: %s", out)
+	}
+
+	out = shellHelper(t, sess, "use footer 3\n")
+	if sess.footerID != 2 || !strings.HasPrefix(out, "error:") {
+		t.Errorf("Expected footer 3 to be unavailable: %s", out)
+	}
+
+	out = shellHelper(t, sess, "collections\n")
+	if out != "(0 collections)\n" {
+		t.Errorf("Unexpected output for collections: %s", out)
+	}
+
+	out = shellHelper(t, sess, "bogus\nexit\nget key1\n")
+	if !strings.HasPrefix(out, "error: unknown command") ||
+		strings.Contains(out, "key1") {
+		t.Errorf("Unexpected output after exit: %s", out)
+	}
+}
+
+func TestShellComplete(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	sess, err := newShellSession(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.close()
+
+	tests := []struct {
+		line   string
+		expect string
+		ok     bool
+	}{
+		{"fo", "footers ", true},
+		{"use f", "use footer", true},
+		{"get k", "get key", true},
+		{"get key4", "", false},
+		{"get key", "", false},
+		{"bogus k", "", false},
+	}
+
+	for _, test := range tests {
+		line, pos, ok := sess.complete(test.line, len(test.line), '\t')
+		if ok != test.ok || line != test.expect ||
+			(ok && pos != len(test.expect)) {
+			t.Errorf("Unexpected completion of %q: %q, %d, %v",
+				test.line, line, pos, ok)
+		}
+	}
+}
+
+func TestShellSplit(t *testing.T) {
+	args, err := shellSplit(`get "my key" plain  "a\"b"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"get", "my key", "plain", `a"b`}
+	if strings.Join(args, "|") != strings.Join(expect, "|") {
+		t.Errorf("Unexpected split: %q", args)
+	}
+
+	_, err = shellSplit(`get "unterminated`)
+	if err == nil {
+		t.Errorf("Expected an error for an unterminated quote!")
+	}
+}
@@ -22,8 +22,8 @@ var statsCmd = &cobra.Command{
 specific moss store.
 	./mossScope stats <sub-command> <path_to_store>`,
 	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("USAGE: mossScope stats <sub_command> <path_to_store>, " +
-			"more details with --help")
+		fmt.Fprintln(cmd.OutOrStdout(), "USAGE: mossScope stats "+
+			"<sub_command> <path_to_store>, more details with --help")
 	},
 }
 
@@ -12,13 +12,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
-	"io"
+	"io/ioutil"
 	"math"
 	"os"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
 )
 
 var ITEMS = 5
@@ -127,6 +130,7 @@ const (
 	FRAGMENTATIONSTATS = 2
 	DIAGSTATS          = 3
 	HISTSTATS          = 4
+	WATCHSTATS         = 5
 )
 
 func init2FootersAndInterceptStdout(t *testing.T, batches int,
@@ -138,23 +142,35 @@ func init2FootersAndInterceptStdout(t *testing.T, batches int,
 	// Footer 2 (2 segments)
 	dir, store, coll := initStore(t, false, batches)
 
-	old := os.Stdout // keep backup of the real stdout
-	r, w, _ := os.Pipe()
-	os.Stdout = w
+	var buf bytes.Buffer
 
 	var err error
 
+	prevJSON := jsonFormat
+	defer func() {
+		jsonFormat = prevJSON
+	}()
+
 	jsonFormat = true
 	dirs := []string{dir}
 	switch command {
 	case FOOTERSTATS:
-		err = invokeFooterStats(dirs)
+		err = invokeFooterStats(&buf, dirs)
 	case FRAGMENTATIONSTATS:
-		err = invokeFragStats(dirs)
+		err = invokeFragStats(&buf, dirs)
 	case DIAGSTATS:
-		err = invokeDiagStats(dirs)
+		err = invokeDiagStats(&buf, dirs)
 	case HISTSTATS:
-		err = invokeHistStats(dirs)
+		err = invokeHistStats(&buf, dirs)
+	case WATCHSTATS:
+		prevCount, prevInterval := watchCount, watchInterval
+		defer func() {
+			watchCount, watchInterval = prevCount, prevInterval
+		}()
+
+		watchCount = 2
+		watchInterval = time.Millisecond
+		err = invokeWatch(&buf, dirs)
 	default:
 		t.Errorf("Unknown CMD: %d", command)
 	}
@@ -163,19 +179,7 @@ func init2FootersAndInterceptStdout(t *testing.T, batches int,
 		t.Error(err)
 	}
 
-	outC := make(chan string)
-	// copy the output in a separate goroutine so dump wouldn't
-	// block indefinitely
-	go func() {
-		var buf bytes.Buffer
-		io.Copy(&buf, r)
-		outC <- buf.String()
-	}()
-
-	// back to normal state
-	w.Close()
-	os.Stdout = old // restoring the real stdout
-	out := <-outC
+	out := buf.String()
 
 	cleanupStore(dir, store, coll)
 
@@ -265,6 +269,66 @@ func TestFragmentationStats(t *testing.T) {
 	}
 }
 
+func TestAccurateFragmentationStats(t *testing.T) {
+	fragAccurate = true
+	defer func() {
+		fragAccurate = false
+	}()
+
+	out := init2FootersAndInterceptStdout(t, 2, FRAGMENTATIONSTATS)
+
+	var m []map[string]map[string]interface{}
+	json.Unmarshal([]byte(out), &m)
+	if len(m) != 1 || m[0]["testStatsStore"] == nil {
+		t.Fatalf("Unexpected output: %s", out)
+	}
+
+	// Every key is set again by the second footer
+	stats := m[0]["testStatsStore"]
+	if stats["shadowed_versions"] != float64(ITEMS) ||
+		stats["tombstones"] != float64(0) ||
+		stats["reclaimable_bytes"] == nil {
+		t.Errorf("Unexpected accurate stats: %v", stats)
+	}
+}
+
+func TestBleveStats(t *testing.T) {
+	dir := "testBleveStatsStore"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	_, _, err := scope.Import(dir, []scope.Record{
+		{Key: []byte("f\x00\x00"), Val: []byte("title\xff")},
+		{Key: []byte("d\x00\x00moss"), Val: []byte{1}},
+		{Key: []byte("t\x00\x00moss\xffdoc1"), Val: []byte{1, 0}},
+		{Key: []byte("bdoc1"), Val: []byte{}},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFormat = csvOutput
+	defer func() {
+		outputFormat = ""
+	}()
+
+	var buf bytes.Buffer
+	err = invokeBleveStats(&buf, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "store,kind,field,name,term,count,terms,dictionary_bytes," +
+		"postings,postings_bytes,stored_fields,stored_bytes\n" +
+		dir + ",field,0,title,,,1,8,1,14,0,0\n" +
+		dir + ",docs,,,,1,,,,,,\n" +
+		dir + ",posting,0,title,moss,1,,,,,,\n"
+	if buf.String() != expect {
+		t.Errorf("Unexpected output, expected:\n%s\ngot:\n%s", expect,
+			buf.String())
+	}
+}
+
 func TestDiagStats(t *testing.T) {
 	out := init2FootersAndInterceptStdout(t, 2, DIAGSTATS)
 
@@ -346,4 +410,211 @@ ValSizes(B)  (1 Total)
 		t.Errorf("Mismatch in output: Expected: %s, Got: %s", expect, out)
 	}
 
+	keyPrefix, keyGlob, invertKeys = "", "key[34]", true
+	defer func() {
+		keyGlob, invertKeys = "", false
+		checkKeyFilter()
+	}()
+	err := checkKeyFilter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out = init2FootersAndInterceptStdout(t, 1, HISTSTATS)
+	if !strings.Contains(out, "KeySizes(B)  (3 Total)") {
+		t.Errorf("Expected the histograms of 3 keys, got: %s", out)
+	}
+}
+
+func TestWatchStats(t *testing.T) {
+	out := init2FootersAndInterceptStdout(t, 2, WATCHSTATS)
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 samples, but count: %d!", len(lines))
+	}
+
+	for i, line := range lines {
+		var rec map[string]interface{}
+		err := json.Unmarshal([]byte(line), &rec)
+		if err != nil {
+			t.Fatalf("Expected sample %d to be valid JSON, err: %v", i, err)
+		}
+
+		if rec["store"] != "testStatsStore" {
+			t.Errorf("Unexpected store: %v!", rec["store"])
+		}
+
+		if rec["total_ops_set"] != float64(2*ITEMS) {
+			t.Errorf("Unexpected total_ops_set: %v!", rec["total_ops_set"])
+		}
+
+		if rec["num_bytes_used_disk"] == nil ||
+			rec["num_bytes_used_disk"] == float64(0) {
+			t.Errorf("Unexpected num_bytes_used_disk: %v!",
+				rec["num_bytes_used_disk"])
+		}
+
+		// Both footers persisted a segment
+		if rec["num_segments"] != float64(2) {
+			t.Errorf("Unexpected num_segments: %v!", rec["num_segments"])
+		}
+
+		// Nothing is written to the store between samples
+		if rec["total_ops_set_delta"] != float64(0) {
+			t.Errorf("Unexpected total_ops_set_delta: %v!",
+				rec["total_ops_set_delta"])
+		}
+	}
+}
+
+// signalWriter signals every write, so that a test can tell when the
+// output is emitted.
+type signalWriter struct {
+	writes chan []byte
+}
+
+func (w *signalWriter) Write(p []byte) (int, error) {
+	w.writes <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWatchStatsFlush(t *testing.T) {
+	dir, store, coll := initStore(t, true, 1)
+	cleanupStore("", store, coll)
+	defer os.RemoveAll(dir)
+
+	prevCount, prevInterval := watchCount, watchInterval
+	defer func() {
+		watchCount, watchInterval = prevCount, prevInterval
+		outputFormat = ""
+	}()
+
+	// Without --count, json could never be completed
+	watchCount = 0
+	outputFormat = jsonOutput
+	err := invokeWatch(ioutil.Discard, []string{dir})
+	if exitCode(err) != exitUsage {
+		t.Errorf("Expected json to be rejected without --count, err: %v",
+			err)
+	}
+
+	// The first sample is emitted before the second one is taken
+	watchCount = 2
+	watchInterval = 2 * time.Second
+	outputFormat = csvOutput
+	w := &signalWriter{writes: make(chan []byte, 16)}
+	done := make(chan error)
+	go func() {
+		done <- invokeWatch(w, []string{dir})
+	}()
+
+	select {
+	case out := <-w.writes:
+		if !strings.HasPrefix(string(out), "store,time,") ||
+			strings.Count(string(out), "\n") != 2 {
+			t.Errorf("Unexpected first sample: %s", out)
+		}
+	case <-time.After(watchInterval / 2):
+		t.Errorf("Expected the first sample to be flushed")
+	}
+
+	err = <-done
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDiagStatsTable(t *testing.T) {
+	dir, store, coll := setup(t, true)
+	defer cleanup(dir, store, coll)
+
+	var buf bytes.Buffer
+	err := invokeDiagStats(&buf, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var version bytes.Buffer
+	emitVersion(&version)
+	if !strings.HasPrefix(buf.String(), version.String()+"\n"+dir+"\n") {
+		t.Errorf("Expected the versions before the stats: %s", buf.String())
+	}
+}
+
+func TestDiagStatsPrometheus(t *testing.T) {
+	outputFormat = promOutput
+	out := init2FootersAndInterceptStdout(t, 2, DIAGSTATS)
+	outputFormat = ""
+
+	expect := []string{
+		"# TYPE moss_total_ops_set gauge\n",
+		fmt.Sprintf("moss_total_ops_set{store=\"testStatsStore\"} %d\n",
+			2*ITEMS),
+		"# TYPE moss_persists_total counter\n",
+		"# TYPE moss_num_segments gauge\n",
+		"moss_segment_bytes{store=\"testStatsStore\",segment=\"0\"} ",
+		"moss_num_bytes_used_disk{store=\"testStatsStore\"} ",
+	}
+
+	for _, e := range expect {
+		if !strings.Contains(out, e) {
+			t.Errorf("Expected %q in output: %s", e, out)
+		}
+	}
+
+	if strings.HasPrefix(out, "[") {
+		t.Errorf("Unexpected JSON in prometheus output: %s", out)
+	}
+}
+
+func TestFooterStatsPrometheus(t *testing.T) {
+	outputFormat = promOutput
+	out := init2FootersAndInterceptStdout(t, 2, FOOTERSTATS)
+	outputFormat = ""
+
+	expect := fmt.Sprintf("moss_total_key_bytes{store=\"testStatsStore\","+
+		"footer=\"Footer_1\"} %d\n", 4*(2*ITEMS))
+	if !strings.Contains(out, expect) {
+		t.Errorf("Expected %q in output: %s", expect, out)
+	}
+
+	if strings.Count(out, "# TYPE moss_total_key_bytes gauge") != 1 {
+		t.Errorf("Expected a single TYPE line per metric: %s", out)
+	}
+}
+
+func TestSchemaStats(t *testing.T) {
+	dir := "testSchemaStatsStore"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	_, _, err := scope.Import(dir, []scope.Record{
+		{Key: []byte("doc1"), Val: []byte(`{"id":1,"tags":["x"]}`)},
+		{Key: []byte("doc2"), Val: []byte(`{"id":2}`)},
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputFormat = csvOutput
+	defer func() {
+		outputFormat = ""
+	}()
+
+	var buf bytes.Buffer
+	err = invokeSchemaStats(&buf, []string{dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := "store,path,docs,frequency,types,min_length,max_length," +
+		"examples\n" +
+		dir + ",.,2,100.00%,object:2,1,2,\n" +
+		dir + ",.id,2,100.00%,number:2,,,\"[1,2]\"\n" +
+		dir + ",.tags,1,50.00%,array:1,1,1,\n" +
+		dir + ",.tags[],1,50.00%,string:1,1,1,\"[\"\"x\"\"]\"\n"
+	if buf.String() != expect {
+		t.Errorf("Unexpected output, expected:\n%s\ngot:\n%s", expect,
+			buf.String())
+	}
 }
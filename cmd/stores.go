@@ -0,0 +1,52 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+var recursive bool
+
+// storeArgs resolves the store paths passed to a command. With
+// --recursive, every path is searched for the stores below it, while
+// paths holding glob patterns are expanded to the stores they match,
+// and any other path is taken as is.
+func storeArgs(args []string) ([]string, error) {
+	var dirs []string
+	for _, arg := range args {
+		switch {
+		case recursive:
+			found, err := scope.FindStores(arg)
+			if err != nil {
+				return nil, fmt.Errorf("Store discovery in %s failed, err: %v",
+					arg, err)
+			}
+			if len(found) == 0 {
+				return nil, notFoundErrorf("no moss stores found in: %s", arg)
+			}
+			dirs = append(dirs, found...)
+		case strings.ContainsAny(arg, "*?["):
+			found, err := scope.GlobStores(arg)
+			if err != nil {
+				return nil, usageErrorf("invalid pattern: %s, err: %v", arg, err)
+			}
+			if len(found) == 0 {
+				return nil, notFoundErrorf("no moss stores match: %s", arg)
+			}
+			dirs = append(dirs, found...)
+		default:
+			dirs = append(dirs, arg)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+func TestStoreArgs(t *testing.T) {
+	root, err := ioutil.TempDir("", "testStoreArgs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// The stores are found by the glob, and by the recursive discovery
+	// in the nested directories, unlike the empty directory
+	stores := []string{filepath.Join(root, "a", "store0"),
+		filepath.Join(root, "b", "c", "store1")}
+	for _, dir := range stores {
+		err = os.MkdirAll(dir, 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = scope.Import(dir, []scope.Record{
+			{Key: []byte("key"), Val: []byte("val")}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = os.MkdirAll(filepath.Join(root, "a", "empty"), 0777)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dirs, err := storeArgs([]string{filepath.Join(root, "a", "store*"),
+		"somePath"})
+	if err != nil || len(dirs) != 2 || dirs[0] != stores[0] ||
+		dirs[1] != "somePath" {
+		t.Errorf("Unexpected stores: %v, err: %v", dirs, err)
+	}
+
+	_, err = storeArgs([]string{filepath.Join(root, "noSuchStore*")})
+	if exitCode(err) != exitNotFound {
+		t.Errorf("Expected no stores to match, err: %v", err)
+	}
+
+	prevRecursive := recursive
+	recursive = true
+	defer func() {
+		recursive = prevRecursive
+	}()
+
+	dirs, err = storeArgs([]string{root})
+	if err != nil || len(dirs) != 2 || dirs[0] != stores[0] ||
+		dirs[1] != stores[1] {
+		t.Errorf("Unexpected stores found: %v, err: %v", dirs, err)
+	}
+
+	_, err = storeArgs([]string{filepath.Join(root, "a", "empty")})
+	if exitCode(err) != exitNotFound {
+		t.Errorf("Expected no stores to be found, err: %v", err)
+	}
+}
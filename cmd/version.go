@@ -10,6 +10,7 @@ package cmd
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/couchbase/moss"
 	"github.com/spf13/cobra"
@@ -20,12 +21,12 @@ var versionCmd = &cobra.Command{
 	Use:   "version",
 	Short: "Retrieves the current version of mossScope",
 	Run: func(cmd *cobra.Command, args []string) {
-		emitVersion()
+		emitVersion(cmd.OutOrStdout())
 	},
 }
 
-func emitVersion() {
-	fmt.Printf("mossScope v%s (moss lib version: %v)\n",
+func emitVersion(w io.Writer) {
+	fmt.Fprintf(w, "mossScope v%s (moss lib version: %v)\n",
 		version, moss.StoreVersion)
 }
 
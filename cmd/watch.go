@@ -0,0 +1,255 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/couchbase/moss"
+	"github.com/couchbase/mossScope/scope"
+	"github.com/spf13/cobra"
+)
+
+// watchCmd represents the watch command
+var watchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Periodically samples stats from a live store",
+	Long: `This command repeatedly opens the store in read-only mode,
+re-reads the latest footer and the store stats, and emits the
+changes in disk usage, segment count, ops and fragmentation
+between consecutive samples. With --output ndjson, every sample
+is emitted as one JSON object per line. The json output, a single
+array, requires --count.
+	./mossScope stats watch <path_to_store> --interval 5s`,
+
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return usageErrorf("at least one path is required")
+		}
+		if watchInterval <= 0 {
+			return usageErrorf("interval must be greater than zero")
+		}
+		return nil
+	},
+
+	RunE: func(cmd *cobra.Command, args []string) error {
+		dirs, err := storeArgs(args)
+		if err != nil {
+			return err
+		}
+		return invokeWatch(cmd.OutOrStdout(), dirs)
+	},
+}
+
+var watchInterval time.Duration
+var watchCount int
+
+// watchSample holds the stats tracked across samples of a store.
+type watchSample struct {
+	NumBytesUsedDisk uint64 `json:"num_bytes_used_disk"`
+	NumSegments      uint64 `json:"num_segments"`
+	TotalOpsSet      uint64 `json:"total_ops_set"`
+	TotalOpsDel      uint64 `json:"total_ops_del"`
+	FragPercent      uint64 `json:"fragmentation_percent"`
+}
+
+// watchRecord is a single sample along with the deltas from the
+// previous sample of the same store.
+type watchRecord struct {
+	Time  string `json:"time"`
+	Store string `json:"store"`
+	watchSample
+	NumBytesUsedDiskDelta int64 `json:"num_bytes_used_disk_delta"`
+	NumSegmentsDelta      int64 `json:"num_segments_delta"`
+	TotalOpsSetDelta      int64 `json:"total_ops_set_delta"`
+	TotalOpsDelDelta      int64 `json:"total_ops_del_delta"`
+	FragPercentDelta      int64 `json:"fragmentation_percent_delta"`
+}
+
+// flusher is implemented by the renderers that buffer their output,
+// which is flushed after every sample.
+type flusher interface {
+	flush() error
+}
+
+func invokeWatch(w io.Writer, dirs []string) error {
+	// The samples are emitted as they are taken, so table is drawn
+	// with fixed widths, and --json stands for NDJSON here
+	format := outputFormat
+	if format == "" && jsonFormat {
+		format = ndjsonOutput
+	}
+
+	if format == promOutput {
+		return usageErrorf("the %s output format is not supported by watch",
+			promOutput)
+	}
+	if format == jsonOutput && watchCount <= 0 {
+		// The JSON array would never be closed
+		return usageErrorf("the %s output format requires --count, "+
+			"or use --output %s", jsonOutput, ndjsonOutput)
+	}
+
+	var r renderer
+	if format != "" && format != tableOutput {
+		newFn, exists := renderers[format]
+		if !exists {
+			return usageErrorf("unsupported output format: %s", format)
+		}
+		r = newFn(w)
+	} else {
+		fmt.Fprintf(w, "%-20s %-30s %16s %12s %12s %12s %10s\n",
+			"TIME", "STORE", "DISK_BYTES", "SEGMENTS",
+			"OPS_SET", "OPS_DEL", "FRAG%")
+	}
+
+	prev := make(map[string]*watchSample)
+	var failures storeFailures
+
+	for n := 0; watchCount <= 0 || n < watchCount; n++ {
+		if n != 0 {
+			time.Sleep(watchInterval)
+		}
+
+		now := time.Now().Format(time.RFC3339)
+
+		err := forEachStore(dirs, func(dir string,
+			store *moss.Store) (interface{}, error) {
+			return sampleStore(store)
+		}, func(dir string, val interface{}) error {
+			curr := val.(*watchSample)
+
+			rec := watchRecord{Time: now, Store: dir, watchSample: *curr}
+			if p := prev[dir]; p != nil {
+				rec.NumBytesUsedDiskDelta = delta(curr.NumBytesUsedDisk,
+					p.NumBytesUsedDisk)
+				rec.NumSegmentsDelta = delta(curr.NumSegments, p.NumSegments)
+				rec.TotalOpsSetDelta = delta(curr.TotalOpsSet, p.TotalOpsSet)
+				rec.TotalOpsDelDelta = delta(curr.TotalOpsDel, p.TotalOpsDel)
+				rec.FragPercentDelta = delta(curr.FragPercent, p.FragPercent)
+			}
+			prev[dir] = curr
+
+			if r != nil {
+				return r.section(dir, rec, []*record{rec.record()})
+			}
+
+			fmt.Fprintf(w, "%-20s %-30s %16s %12s %12s %12s %10s\n",
+				rec.Time, rec.Store,
+				withDelta(rec.NumBytesUsedDisk, rec.NumBytesUsedDiskDelta),
+				withDelta(rec.NumSegments, rec.NumSegmentsDelta),
+				withDelta(rec.TotalOpsSet, rec.TotalOpsSetDelta),
+				withDelta(rec.TotalOpsDel, rec.TotalOpsDelDelta),
+				withDelta(rec.FragPercent, rec.FragPercentDelta))
+			return nil
+		}, func(dir string, err error) error {
+			failures.add(dir, err)
+			if r != nil {
+				return r.storeError(dir, err)
+			}
+			fmt.Fprintf(w, "%-20s %-30s ERROR: %v\n", now, dir, err)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if f, ok := r.(flusher); ok {
+			err = f.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if r != nil {
+		err := r.close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return failures.err()
+}
+
+// record returns the fields of the sample, other than the store, in
+// the order of their JSON form.
+func (rec *watchRecord) record() *record {
+	return (&record{}).add("time", rec.Time).
+		add("num_bytes_used_disk", rec.NumBytesUsedDisk).
+		add("num_segments", rec.NumSegments).
+		add("total_ops_set", rec.TotalOpsSet).
+		add("total_ops_del", rec.TotalOpsDel).
+		add("fragmentation_percent", rec.FragPercent).
+		add("num_bytes_used_disk_delta", rec.NumBytesUsedDiskDelta).
+		add("num_segments_delta", rec.NumSegmentsDelta).
+		add("total_ops_set_delta", rec.TotalOpsSetDelta).
+		add("total_ops_del_delta", rec.TotalOpsDelDelta).
+		add("fragmentation_percent_delta", rec.FragPercentDelta)
+}
+
+// sampleStore collects the tracked stats from the store, which is
+// re-opened for every sample, so that the latest persisted state is
+// picked up: the disk usage and segment count of the store stats, the
+// ops of the latest footer, and the fragmentation.
+func sampleStore(store *moss.Store) (*watchSample, error) {
+	stats, err := store.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("Store-Stats() failed!, err: %v", err)
+	}
+
+	sample := &watchSample{}
+	sample.NumBytesUsedDisk, _ = stats["num_bytes_used_disk"].(uint64)
+	sample.NumSegments, _ = stats["num_segments"].(uint64)
+
+	err = scope.WalkFooters(store, false, func(id int,
+		footer *moss.Footer) error {
+		footerStats := scope.GetFooterStats(footer)
+		sample.TotalOpsSet = footerStats.TotalOpsSet
+		sample.TotalOpsDel = footerStats.TotalOpsDel
+		return nil
+	})
+	if err != nil && err != scope.ErrNoSnapshot {
+		return nil, err
+	}
+
+	fragStats, err := scope.FetchFragStats(store)
+	if err != nil {
+		return nil, err
+	}
+	sample.FragPercent = fragStats.FragmentationPercent
+
+	return sample, nil
+}
+
+func delta(curr, prev uint64) int64 {
+	return int64(curr) - int64(prev)
+}
+
+func withDelta(val uint64, d int64) string {
+	if d == 0 {
+		return fmt.Sprintf("%d", val)
+	}
+	return fmt.Sprintf("%d(%+d)", val, d)
+}
+
+func init() {
+	statsCmd.AddCommand(watchCmd)
+
+	// Local flags that are intended to work with stats watch
+	watchCmd.Flags().DurationVar(&watchInterval, "interval", 5*time.Second,
+		"Interval between consecutive samples")
+	watchCmd.Flags().IntVar(&watchCount, "count", 0,
+		"Number of samples to take before exiting (default: until killed)")
+	watchCmd.Flags().BoolVar(&jsonFormat, "json", false,
+		"Emits every sample as a JSON object per line (NDJSON)")
+	watchCmd.Flags().MarkDeprecated("json", "use --output ndjson")
+}
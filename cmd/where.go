@@ -0,0 +1,70 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package cmd
+
+import (
+	"encoding/json"
+
+	"github.com/couchbase/mossScope/scope"
+)
+
+var whereExpr string
+
+// where is compiled from --where, and is nil when not set.
+var where *scope.Where
+
+// jsonDecoder decodes the values for --where when --value-decoder is
+// not set.
+var jsonDecoder scope.Decoder
+
+func checkWhere() error {
+	where = nil
+	if whereExpr == "" {
+		return nil
+	}
+
+	var err error
+	where, err = scope.CompileWhere(whereExpr)
+	if err != nil {
+		return usageErrorf("invalid --where: %v", err)
+	}
+
+	if jsonDecoder == nil {
+		jsonDecoder, err = scope.NewDecoder("json")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// whereFilter returns whether the value of the record, decoded by
+// valueDecoder or else as JSON, matches --where. Values that fail to
+// decode are taken as null, so that they can still match on $key.
+func whereFilter(rec scope.Record) bool {
+	decoder := valueDecoder
+	if decoder == nil {
+		decoder = jsonDecoder
+	}
+
+	v, err := decoder(rec.Val)
+	if err != nil {
+		v = nil
+	}
+
+	// Decoders such as proto-descriptor produce JSON text
+	if raw, ok := v.(json.RawMessage); ok {
+		v, err = jsonDecoder(raw)
+		if err != nil {
+			v = nil
+		}
+	}
+
+	return where.Match(rec.Key, v)
+}
@@ -0,0 +1,542 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/couchbase/moss"
+)
+
+// The row types of a bleve upsidedown index, being the first byte of
+// the keys of its rows.
+const (
+	BleveVersionRow       = 'v'
+	BleveInternalRow      = 'i'
+	BleveFieldRow         = 'f'
+	BleveDictionaryRow    = 'd'
+	BleveTermFrequencyRow = 't'
+	BleveBackIndexRow     = 'b'
+	BleveStoredRow        = 's'
+)
+
+// bleveByteSeparator separates the variable length parts of the keys
+// and values of the rows.
+const bleveByteSeparator = 0xff
+
+// BleveVersion is the row holding the version of the index format.
+type BleveVersion struct {
+	Type    string `json:"type"`
+	Version uint8  `json:"version"`
+}
+
+// BleveInternal is a row of the internal key-values of the index.
+type BleveInternal struct {
+	Type string `json:"type"`
+	Key  string `json:"key"`
+	Val  string `json:"val"`
+}
+
+// BleveField maps the index of a field to its name.
+type BleveField struct {
+	Type  string `json:"type"`
+	Index uint16 `json:"index"`
+	Name  string `json:"name"`
+}
+
+// BleveDictionary is the number of documents holding a term in a field.
+type BleveDictionary struct {
+	Type  string `json:"type"`
+	Field uint16 `json:"field"`
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+// BleveTermVector is the location of an occurrence of a term.
+type BleveTermVector struct {
+	Field          uint16   `json:"field"`
+	Pos            uint64   `json:"pos"`
+	Start          uint64   `json:"start"`
+	End            uint64   `json:"end"`
+	ArrayPositions []uint64 `json:"array_positions,omitempty"`
+}
+
+// BleveTermFrequency is the frequency of a term in a field of a
+// document, along with the locations of its occurrences.
+type BleveTermFrequency struct {
+	Type    string            `json:"type"`
+	Field   uint16            `json:"field"`
+	Term    string            `json:"term"`
+	DocID   string            `json:"doc_id"`
+	Freq    uint64            `json:"freq"`
+	Norm    float32           `json:"norm"`
+	Vectors []BleveTermVector `json:"vectors,omitempty"`
+}
+
+// BleveBackIndexTerms are the terms of a field of a document.
+type BleveBackIndexTerms struct {
+	Field uint32   `json:"field"`
+	Terms []string `json:"terms"`
+}
+
+// BleveBackIndexStored is a stored field of a document.
+type BleveBackIndexStored struct {
+	Field          uint32   `json:"field"`
+	ArrayPositions []uint64 `json:"array_positions,omitempty"`
+}
+
+// BleveBackIndex is the row of a document listing the rows to remove
+// when the document is updated or deleted.
+type BleveBackIndex struct {
+	Type   string                 `json:"type"`
+	DocID  string                 `json:"doc_id"`
+	Terms  []BleveBackIndexTerms  `json:"terms,omitempty"`
+	Stored []BleveBackIndexStored `json:"stored,omitempty"`
+}
+
+// BleveStored is a stored field of a document.
+type BleveStored struct {
+	Type           string      `json:"type"`
+	DocID          string      `json:"doc_id"`
+	Field          uint16      `json:"field"`
+	ArrayPositions []uint64    `json:"array_positions,omitempty"`
+	ValueType      string      `json:"value_type,omitempty"`
+	Value          interface{} `json:"value"`
+}
+
+// DecodeBleveRow decodes a key-value of a bleve upsidedown index into
+// one of the Bleve row types. A nil val (keys only) decodes just the
+// parts of the row held in its key.
+func DecodeBleveRow(key, val []byte) (interface{}, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+
+	switch key[0] {
+	case BleveVersionRow:
+		row := &BleveVersion{Type: "version"}
+		if len(val) > 0 {
+			row.Version = val[0]
+		}
+		return row, nil
+
+	case BleveInternalRow:
+		return &BleveInternal{Type: "internal", Key: string(key[1:]),
+			Val: string(val)}, nil
+
+	case BleveFieldRow:
+		if len(key) < 3 {
+			return nil, fmt.Errorf("field row key too short: %d", len(key))
+		}
+		return &BleveField{Type: "field",
+			Index: binary.LittleEndian.Uint16(key[1:3]),
+			Name:  string(bytes.TrimSuffix(val, []byte{bleveByteSeparator}))}, nil
+
+	case BleveDictionaryRow:
+		if len(key) < 3 {
+			return nil, fmt.Errorf("dictionary row key too short: %d", len(key))
+		}
+		row := &BleveDictionary{Type: "dictionary",
+			Field: binary.LittleEndian.Uint16(key[1:3]), Term: string(key[3:])}
+		if val != nil {
+			count, n := binary.Uvarint(val)
+			if n <= 0 {
+				return nil, fmt.Errorf("invalid dictionary row count")
+			}
+			row.Count = count
+		}
+		return row, nil
+
+	case BleveTermFrequencyRow:
+		return decodeBleveTermFrequency(key, val)
+
+	case BleveBackIndexRow:
+		return decodeBleveBackIndex(key, val)
+
+	case BleveStoredRow:
+		return decodeBleveStored(key, val)
+	}
+
+	return nil, fmt.Errorf("unknown row type: %q", key[0])
+}
+
+func decodeBleveTermFrequency(key, val []byte) (*BleveTermFrequency, error) {
+	if len(key) < 3 {
+		return nil, fmt.Errorf("term frequency row key too short: %d",
+			len(key))
+	}
+
+	sep := bytes.IndexByte(key[3:], bleveByteSeparator)
+	if sep < 0 {
+		return nil, fmt.Errorf("term frequency row key without doc ID")
+	}
+
+	row := &BleveTermFrequency{Type: "term_frequency",
+		Field: binary.LittleEndian.Uint16(key[1:3]),
+		Term:  string(key[3 : 3+sep]), DocID: string(key[3+sep+1:])}
+	if val == nil {
+		return row, nil
+	}
+
+	r := uvarintReader{buf: val}
+	row.Freq = r.next()
+	row.Norm = math.Float32frombits(uint32(r.next()))
+	for r.err == nil && len(r.buf) > 0 {
+		tv := BleveTermVector{Field: uint16(r.next()), Pos: r.next(),
+			Start: r.next(), End: r.next()}
+		for n := r.next(); r.err == nil && n > 0; n-- {
+			tv.ArrayPositions = append(tv.ArrayPositions, r.next())
+		}
+		row.Vectors = append(row.Vectors, tv)
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid term frequency row value: %v", r.err)
+	}
+
+	return row, nil
+}
+
+func decodeBleveBackIndex(key, val []byte) (*BleveBackIndex, error) {
+	row := &BleveBackIndex{Type: "back_index", DocID: string(key[1:])}
+	if val == nil {
+		return row, nil
+	}
+
+	// The value is a BackIndexRowValue protobuf message, holding the
+	// BackIndexTermsEntry (1) and BackIndexStoreEntry (2) messages
+	err := walkProtobuf(val, func(num int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			var terms BleveBackIndexTerms
+			err := walkProtobuf(b, func(num int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					terms.Field = uint32(v)
+				case 2:
+					terms.Terms = append(terms.Terms, string(b))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			row.Terms = append(row.Terms, terms)
+		case 2:
+			var stored BleveBackIndexStored
+			err := walkProtobuf(b, func(num int, v uint64, b []byte) error {
+				switch num {
+				case 1:
+					stored.Field = uint32(v)
+				case 2:
+					if b == nil {
+						stored.ArrayPositions = append(stored.ArrayPositions, v)
+						return nil
+					}
+					// Packed repeated field
+					r := uvarintReader{buf: b}
+					for r.err == nil && len(r.buf) > 0 {
+						stored.ArrayPositions = append(stored.ArrayPositions,
+							r.next())
+					}
+					return r.err
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			row.Stored = append(row.Stored, stored)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid back index row value: %v", err)
+	}
+
+	return row, nil
+}
+
+func decodeBleveStored(key, val []byte) (*BleveStored, error) {
+	sep := bytes.IndexByte(key[1:], bleveByteSeparator)
+	if sep < 0 || len(key) < 1+sep+3 {
+		return nil, fmt.Errorf("invalid stored row key")
+	}
+
+	row := &BleveStored{Type: "stored", DocID: string(key[1 : 1+sep]),
+		Field: binary.LittleEndian.Uint16(key[1+sep+1:])}
+
+	r := uvarintReader{buf: key[1+sep+3:]}
+	for r.err == nil && len(r.buf) > 0 {
+		row.ArrayPositions = append(row.ArrayPositions, r.next())
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid stored row array positions: %v", r.err)
+	}
+
+	if len(val) == 0 {
+		return row, nil
+	}
+
+	typ, v := val[0], val[1:]
+	switch typ {
+	case 't':
+		row.ValueType, row.Value = "text", string(v)
+	case 'n':
+		i, err := decodePrefixCoded(v)
+		if err != nil {
+			return nil, err
+		}
+		// Undo the mapping of float64 bits onto sortable int64s
+		i ^= (i >> 63) & 0x7fffffffffffffff
+		row.ValueType, row.Value = "number", math.Float64frombits(uint64(i))
+	case 'd':
+		i, err := decodePrefixCoded(v)
+		if err != nil {
+			return nil, err
+		}
+		row.ValueType = "datetime"
+		row.Value = time.Unix(0, i).UTC().Format(time.RFC3339Nano)
+	case 'b':
+		row.ValueType, row.Value = "boolean", len(v) > 0 && v[0] == 'T'
+	default:
+		row.ValueType, row.Value = string(typ), string(v)
+	}
+
+	return row, nil
+}
+
+// decodePrefixCoded decodes the int64 of a bleve prefix coded number,
+// being a byte holding the shift, followed by 7 bits per byte.
+func decodePrefixCoded(b []byte) (int64, error) {
+	if len(b) == 0 || b[0] < 0x20 || b[0] > 0x20+63 {
+		return 0, fmt.Errorf("invalid prefix coded number")
+	}
+	shift := uint(b[0] - 0x20)
+
+	var sortableBits int64
+	for _, c := range b[1:] {
+		sortableBits <<= 7
+		sortableBits |= int64(c)
+	}
+
+	return int64(uint64(sortableBits<<shift) ^ 0x8000000000000000), nil
+}
+
+// uvarintReader reads consecutive uvarints, recording the first error.
+type uvarintReader struct {
+	buf []byte
+	err error
+}
+
+func (r *uvarintReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid uvarint")
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return v
+}
+
+// walkProtobuf invokes fn with every field of a protobuf message, with
+// v set for varint and fixed size fields, and b set for length
+// delimited fields.
+func walkProtobuf(msg []byte, fn func(num int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return fmt.Errorf("invalid protobuf tag")
+		}
+		msg = msg[n:]
+
+		var v uint64
+		var b []byte
+		switch tag & 7 {
+		case 0: // varint
+			v, n = binary.Uvarint(msg)
+			if n <= 0 {
+				return fmt.Errorf("invalid protobuf varint")
+			}
+			msg = msg[n:]
+		case 1: // 64-bit
+			if len(msg) < 8 {
+				return fmt.Errorf("truncated protobuf field")
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case 2: // length delimited
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || uint64(len(msg)-n) < l {
+				return fmt.Errorf("truncated protobuf field")
+			}
+			b, msg = msg[n:n+int(l)], msg[n+int(l):]
+		case 5: // 32-bit
+			if len(msg) < 4 {
+				return fmt.Errorf("truncated protobuf field")
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type: %d", tag&7)
+		}
+
+		err := fn(int(tag>>3), v, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BleveFieldStats are the sizes of the rows of a field of a bleve
+// upsidedown index.
+type BleveFieldStats struct {
+	Field           uint16 `json:"field"`
+	Name            string `json:"name"`
+	Terms           uint64 `json:"terms"` // Dictionary rows.
+	DictionaryBytes uint64 `json:"dictionary_bytes"`
+	Postings        uint64 `json:"postings"` // Term frequency rows.
+	PostingsBytes   uint64 `json:"postings_bytes"`
+	StoredFields    uint64 `json:"stored_fields"`
+	StoredBytes     uint64 `json:"stored_bytes"`
+}
+
+// BlevePostingList is the number of documents holding a term.
+type BlevePostingList struct {
+	Field uint16 `json:"field"`
+	Name  string `json:"name"`
+	Term  string `json:"term"`
+	Count uint64 `json:"count"`
+}
+
+// BleveStats summarize the rows of a bleve upsidedown index.
+type BleveStats struct {
+	Version         uint8              `json:"version"`
+	Docs            uint64             `json:"docs"` // Back index rows.
+	Fields          []BleveFieldStats  `json:"fields"`
+	LargestPostings []BlevePostingList `json:"largest_postings"`
+	UndecodedRows   uint64             `json:"undecoded_rows"`
+}
+
+// FetchBleveStats summarizes the rows of the bleve upsidedown index in
+// the latest snapshot of the store, by field, along with the top
+// largest posting lists. Only the keys of the term frequency, stored
+// and back index rows are decoded.
+func FetchBleveStats(store *moss.Store, top int) (*BleveStats, error) {
+	d, err := Dump(store, DumpOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	stats := &BleveStats{}
+	fields := map[uint16]*BleveFieldStats{}
+	field := func(index uint16) *BleveFieldStats {
+		f, ok := fields[index]
+		if !ok {
+			f = &BleveFieldStats{Field: index}
+			fields[index] = f
+		}
+		return f
+	}
+
+	for d.Next() {
+		rec := d.Record()
+		if len(rec.Key) == 0 {
+			stats.UndecodedRows++
+			continue
+		}
+
+		val := rec.Val
+		switch rec.Key[0] {
+		case BleveTermFrequencyRow, BleveStoredRow, BleveBackIndexRow:
+			val = nil
+		}
+
+		row, err := DecodeBleveRow(rec.Key, val)
+		if err != nil {
+			stats.UndecodedRows++
+			continue
+		}
+
+		size := uint64(len(rec.Key) + len(rec.Val))
+		switch row := row.(type) {
+		case *BleveVersion:
+			stats.Version = row.Version
+		case *BleveField:
+			field(row.Index).Name = row.Name
+		case *BleveDictionary:
+			f := field(row.Field)
+			f.Terms++
+			f.DictionaryBytes += size
+			stats.LargestPostings = addLargestPosting(stats.LargestPostings,
+				top, BlevePostingList{Field: row.Field, Term: row.Term,
+					Count: row.Count})
+		case *BleveTermFrequency:
+			f := field(row.Field)
+			f.Postings++
+			f.PostingsBytes += size
+		case *BleveStored:
+			f := field(row.Field)
+			f.StoredFields++
+			f.StoredBytes += size
+		case *BleveBackIndex:
+			stats.Docs++
+		}
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+
+	stats.Fields = make([]BleveFieldStats, 0, len(fields))
+	for _, f := range fields {
+		stats.Fields = append(stats.Fields, *f)
+	}
+	sort.Slice(stats.Fields, func(i, j int) bool {
+		return stats.Fields[i].Field < stats.Fields[j].Field
+	})
+
+	for i := range stats.LargestPostings {
+		p := &stats.LargestPostings[i]
+		if f, ok := fields[p.Field]; ok {
+			p.Name = f.Name
+		}
+	}
+
+	return stats, nil
+}
+
+// addLargestPosting adds p to the postings, which are kept sorted by
+// decreasing count, if it is among the top largest ones.
+func addLargestPosting(postings []BlevePostingList, top int,
+	p BlevePostingList) []BlevePostingList {
+	if top <= 0 {
+		return postings
+	}
+	if len(postings) == top && postings[top-1].Count >= p.Count {
+		return postings
+	}
+
+	i := sort.Search(len(postings), func(i int) bool {
+		return postings[i].Count < p.Count
+	})
+	if len(postings) < top {
+		postings = append(postings, BlevePostingList{})
+	}
+	copy(postings[i+1:], postings[i:])
+	postings[i] = p
+
+	return postings
+}
@@ -0,0 +1,238 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"fmt"
+	"math"
+)
+
+// The major types of CBOR (RFC 7049).
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborIndefinite is the additional info of indefinite length items.
+const cborIndefinite = 31
+
+// cborBreak ends indefinite length items.
+const cborBreak = 0xff
+
+// DecodeCBOR decodes a CBOR value into the types that encode to JSON,
+// where map keys are converted to strings, byte strings are kept as
+// []byte (base64 in JSON), and tagged values are decoded as their
+// content.
+func DecodeCBOR(b []byte) (interface{}, error) {
+	d := &binaryDecoder{buf: b}
+	v, err := d.cborValue(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("trailing data after the CBOR value")
+	}
+	return v, nil
+}
+
+// cborHead reads the major type and argument of an item, where
+// indefinite is set for indefinite lengths.
+func (d *binaryDecoder) cborHead() (major byte, arg uint64,
+	indefinite bool, err error) {
+	b, err := d.next(1)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, uint64(info), false, nil
+	case info <= 27:
+		arg, err = d.uint(1 << (info - 24))
+		return major, arg, false, err
+	case info == cborIndefinite:
+		return major, 0, true, nil
+	}
+	return 0, 0, false, fmt.Errorf("invalid CBOR additional info: %d", info)
+}
+
+func (d *binaryDecoder) cborBreak() bool {
+	if len(d.buf) > 0 && d.buf[0] == cborBreak {
+		d.buf = d.buf[1:]
+		return true
+	}
+	return false
+}
+
+func (d *binaryDecoder) cborValue(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+
+	if len(d.buf) > 0 && d.buf[0]>>5 == cborSimple {
+		return d.cborSimple()
+	}
+
+	major, arg, indefinite, err := d.cborHead()
+	if err != nil {
+		return nil, err
+	}
+
+	switch major {
+	case cborUint:
+		return arg, nil
+
+	case cborNegInt:
+		if arg > math.MaxInt64 {
+			return -1 - float64(arg), nil
+		}
+		return -1 - int64(arg), nil
+
+	case cborBytes, cborText:
+		s, err := d.cborString(major, arg, indefinite)
+		if err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(s), nil
+		}
+		return s, nil
+
+	case cborArray:
+		if !indefinite && arg > uint64(len(d.buf)) {
+			return nil, errTruncated
+		}
+		a := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.cborBreak() {
+				break
+			}
+			v, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			a = append(a, v)
+		}
+		return a, nil
+
+	case cborMap:
+		if !indefinite && arg > uint64(len(d.buf)) {
+			return nil, errTruncated
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			if indefinite && d.cborBreak() {
+				break
+			}
+			k, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			v, err := d.cborValue(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			m[mapKey(k)] = v
+		}
+		return m, nil
+
+	case cborTag:
+		return d.cborValue(depth + 1)
+	}
+
+	return nil, fmt.Errorf("invalid CBOR major type: %d", major)
+}
+
+// cborString reads the content of a byte or text string, concatenating
+// the chunks of indefinite length strings.
+func (d *binaryDecoder) cborString(major byte, n uint64,
+	indefinite bool) ([]byte, error) {
+	if !indefinite {
+		s, err := d.next(n)
+		return append([]byte{}, s...), err
+	}
+
+	s := []byte{}
+	for !d.cborBreak() {
+		chunkMajor, chunkLen, chunkIndefinite, err := d.cborHead()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, fmt.Errorf("invalid CBOR string chunk")
+		}
+		chunk, err := d.next(chunkLen)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, chunk...)
+	}
+	return s, nil
+}
+
+func (d *binaryDecoder) cborSimple() (interface{}, error) {
+	b, _ := d.next(1)
+	switch info := b[0] & 0x1f; info {
+	case 20:
+		return false, nil
+	case 21:
+		return true, nil
+	case 22, 23: // null, undefined
+		return nil, nil
+	case 24:
+		v, err := d.uint(1)
+		return v, err
+	case 25:
+		bits, err := d.uint(2)
+		return jsonFloat(halfFloat(uint16(bits))), err
+	case 26:
+		bits, err := d.uint(4)
+		return jsonFloat(float64(math.Float32frombits(uint32(bits)))), err
+	case 27:
+		bits, err := d.uint(8)
+		return jsonFloat(math.Float64frombits(bits)), err
+	default:
+		if info < 20 {
+			return uint64(info), nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected CBOR simple value: 0x%x", b[0])
+}
+
+// halfFloat converts an IEEE 754 half precision float.
+func halfFloat(bits uint16) float64 {
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -f
+	}
+	return f
+}
@@ -0,0 +1,253 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Decoder decodes the bytes of a key or a value into a value that
+// encodes to JSON. Decoders returning []byte, such as the ones that
+// decompress, may be chained with other decoders.
+type Decoder func(b []byte) (interface{}, error)
+
+// DecoderFactory returns a Decoder, given the argument that follows
+// the name of the decoder in a decoder spec, if any.
+type DecoderFactory func(arg string) (Decoder, error)
+
+var decoderFactories = map[string]DecoderFactory{
+	"json":             plainDecoder(decodeJSON),
+	"raw":              plainDecoder(decodeRaw),
+	"hex":              plainDecoder(decodeHex),
+	"base64":           plainDecoder(decodeBase64),
+	"snappy":           plainDecoder(decodeSnappy),
+	"gzip":             plainDecoder(decodeGzip),
+	"msgpack":          plainDecoder(DecodeMsgpack),
+	"cbor":             plainDecoder(DecodeCBOR),
+	"proto-descriptor": newProtoDecoder,
+}
+
+// RegisterDecoder adds a decoder to the ones that NewDecoder knows of.
+func RegisterDecoder(name string, factory DecoderFactory) {
+	decoderFactories[name] = factory
+}
+
+// DecoderNames returns the names of the registered decoders, sorted.
+func DecoderNames() []string {
+	names := make([]string, 0, len(decoderFactories))
+	for name := range decoderFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewDecoder returns the decoder of the spec, being the names of one or
+// more decoders chained with "+", such as "snappy+json", where the last
+// one may be followed by an argument after a ":", as with
+// "snappy+proto-descriptor:<file>". The argument runs to the end of the
+// spec, so that it may hold any character, such as the ":" or "+" of a
+// path. Every decoder of the chain but the last must return []byte, and
+// a []byte returned by the last one is converted to a string.
+func NewDecoder(spec string) (Decoder, error) {
+	var chain []Decoder
+	var names []string
+
+	for rest, done := spec, false; !done; {
+		name, arg := rest, ""
+		done = true
+		if i := strings.IndexAny(rest, ":+"); i >= 0 {
+			name = rest[:i]
+			if rest[i] == ':' {
+				arg = rest[i+1:]
+			} else {
+				rest, done = rest[i+1:], false
+			}
+		}
+
+		factory, ok := decoderFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported decoder: %s, supported: %s",
+				name, strings.Join(DecoderNames(), ", "))
+		}
+
+		decoder, err := factory(arg)
+		if err != nil {
+			return nil, fmt.Errorf("decoder %s: %v", name, err)
+		}
+		chain = append(chain, decoder)
+		names = append(names, name)
+	}
+
+	return func(b []byte) (interface{}, error) {
+		var v interface{}
+		for i, decoder := range chain {
+			var err error
+			v, err = decoder(b)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", names[i], err)
+			}
+
+			if i < len(chain)-1 {
+				var ok bool
+				b, ok = v.([]byte)
+				if !ok {
+					return nil, fmt.Errorf("%s: does not produce bytes to "+
+						"decode with %s", names[i], names[i+1])
+				}
+			}
+		}
+
+		if b, ok := v.([]byte); ok {
+			return string(b), nil
+		}
+		return v, nil
+	}, nil
+}
+
+// plainDecoder returns the factory of a decoder without an argument.
+func plainDecoder(decoder Decoder) DecoderFactory {
+	return func(arg string) (Decoder, error) {
+		if arg != "" {
+			return nil, fmt.Errorf("unexpected argument: %s", arg)
+		}
+		return decoder, nil
+	}
+}
+
+func decodeJSON(b []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var v interface{}
+	err := d.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("trailing data after the JSON value")
+	}
+	return v, nil
+}
+
+func decodeRaw(b []byte) (interface{}, error) {
+	return string(b), nil
+}
+
+func decodeHex(b []byte) (interface{}, error) {
+	return hex.EncodeToString(b), nil
+}
+
+func decodeBase64(b []byte) (interface{}, error) {
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+func decodeSnappy(b []byte) (interface{}, error) {
+	return snappy.Decode(nil, b)
+}
+
+func decodeGzip(b []byte) (interface{}, error) {
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// newProtoDecoder returns a decoder of the protobuf messages described
+// by the arg, being the path of a file holding a FileDescriptorSet (as
+// emitted by protoc --descriptor_set_out), optionally followed by
+// ":<message>", the full name of the message. The first message of
+// the last file of the set is decoded by default. The arg is taken as
+// a path as a whole when such a file exists, so that a path may hold
+// a ":" of its own.
+func newProtoDecoder(arg string) (Decoder, error) {
+	fileName, msgName := arg, ""
+	if _, err := os.Stat(arg); err != nil {
+		if i := strings.LastIndex(arg, ":"); i >= 0 {
+			fileName, msgName = arg[:i], arg[i+1:]
+		}
+	}
+	if fileName == "" {
+		return nil, fmt.Errorf("a descriptor set file is required")
+	}
+
+	input, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("File read error: %v", err)
+	}
+
+	var fdset descriptorpb.FileDescriptorSet
+	err = proto.Unmarshal(input, &fdset)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	files, err := protodesc.NewFiles(&fdset)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set: %v", err)
+	}
+
+	var md protoreflect.MessageDescriptor
+	if msgName != "" {
+		d, err := files.FindDescriptorByName(protoreflect.FullName(msgName))
+		if err != nil {
+			return nil, fmt.Errorf("message %s: %v", msgName, err)
+		}
+		var ok bool
+		md, ok = d.(protoreflect.MessageDescriptor)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a message", msgName)
+		}
+	} else {
+		fds := fdset.GetFile()
+		if len(fds) > 0 {
+			fd, err := files.FindFileByPath(fds[len(fds)-1].GetName())
+			if err == nil && fd.Messages().Len() > 0 {
+				md = fd.Messages().Get(0)
+			}
+		}
+		if md == nil {
+			return nil, fmt.Errorf("no message found in the descriptor set")
+		}
+	}
+
+	return func(b []byte) (interface{}, error) {
+		msg := dynamicpb.NewMessage(md)
+		err := proto.Unmarshal(b, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		jBuf, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, err
+		}
+		return json.RawMessage(jBuf), nil
+	}, nil
+}
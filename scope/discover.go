@@ -0,0 +1,80 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// StoreFilePattern matches the names of the files of a moss store.
+const StoreFilePattern = "data-*.moss"
+
+// IsStore returns whether dir is a moss store directory, that is, a
+// directory holding at least one file matching StoreFilePattern.
+func IsStore(dir string) bool {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return false
+	}
+
+	for _, fi := range fileInfos {
+		matched, _ := filepath.Match(StoreFilePattern, fi.Name())
+		if matched && !fi.IsDir() {
+			return true
+		}
+	}
+	return false
+}
+
+// FindStores returns every moss store directory at or below root, in
+// lexical order. The directories within a store are not searched.
+func FindStores(root string) ([]string, error) {
+	var dirs []string
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo,
+		err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if IsStore(path) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// GlobStores returns the moss store directories matching the pattern,
+// skipping any other matching files and directories.
+func GlobStores(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	var dirs []string
+	for _, match := range matches {
+		if IsStore(match) {
+			dirs = append(dirs, match)
+		}
+	}
+	return dirs, nil
+}
@@ -0,0 +1,517 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/couchbase/moss"
+)
+
+// Record is a key-value of a store.
+type Record struct {
+	Key []byte
+	Val []byte // nil when dumping keys only.
+	Del bool   // Deletes the key rather than setting it, with Import.
+}
+
+// DumpOptions select the records that a Dumper emits.
+type DumpOptions struct {
+	Start    []byte // Inclusive, nil for the first key.
+	End      []byte // Exclusive, nil for past the last key.
+	Prefix   string // Only keys that begin with the prefix.
+	KeysOnly bool   // Omits the values.
+	Limit    int    // Max number of records, 0 for no limit.
+	Offset   int    // Number of records to skip before the first one.
+
+	// Reverse emits the records in descending key order. As moss only
+	// iterates forwards, the last Offset+Limit records of the range
+	// are kept in memory, or all of them without a Limit.
+	Reverse bool
+
+	// SampleRate, if set, selects every record with this probability,
+	// after the Filter. Sample, if set, selects a uniform random sample
+	// of this many records by reservoir sampling over the whole range,
+	// which are then emitted in key order. Both draw from Rand, which
+	// defaults to one seeded by the current time.
+	SampleRate float64
+	Sample     int
+	Rand       *rand.Rand
+
+	// Filter, if set, skips the records for which it returns false,
+	// before they count towards the Offset and the Limit. It sees the
+	// values even with KeysOnly.
+	Filter func(rec Record) bool
+}
+
+// Dumper iterates over the records of a snapshot in key order:
+//
+//	d, err := scope.Dump(store, scope.DumpOptions{})
+//	...
+//	defer d.Close()
+//	for d.Next() {
+//		rec := d.Record()
+//		...
+//	}
+//	if d.Err() != nil {
+//		...
+//	}
+type Dumper struct {
+	snap    moss.Snapshot // Owned snapshot, closed along with the Dumper.
+	iter    moss.Iterator
+	opts    DumpOptions
+	rec     Record
+	count   int
+	skipped int
+	started bool
+	err     error
+
+	buffered []Record // Records left to emit, with Reverse or Sample.
+	filled   bool     // Whether buffered was filled.
+}
+
+// Dump returns a Dumper over the latest snapshot of the store.
+func Dump(store *moss.Store, opts DumpOptions) (*Dumper, error) {
+	snap, err := store.Snapshot()
+	if err != nil || snap == nil {
+		return nil, fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+	}
+
+	d, err := DumpSnapshot(snap, opts)
+	if err != nil {
+		snap.Close()
+		return nil, err
+	}
+	d.snap = snap
+
+	return d, nil
+}
+
+// DumpSnapshot returns a Dumper over the snapshot, which must remain
+// open until the Dumper is closed.
+func DumpSnapshot(snap moss.Snapshot, opts DumpOptions) (*Dumper, error) {
+	start := opts.Start
+	if opts.Prefix != "" && bytes.Compare(start, []byte(opts.Prefix)) < 0 {
+		start = []byte(opts.Prefix)
+	}
+
+	iter, err := snap.StartIterator(start, opts.End, moss.IteratorOptions{})
+	if err != nil || iter == nil {
+		return nil, fmt.Errorf("Snapshot-StartItr() API failed, err: %v", err)
+	}
+
+	if (opts.SampleRate > 0 || opts.Sample > 0) && opts.Rand == nil {
+		opts.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	return &Dumper{iter: iter, opts: opts}, nil
+}
+
+// Next advances to the next record, and returns false once there are
+// no more records or an error occurred.
+func (d *Dumper) Next() bool {
+	if d.err != nil || (d.opts.Limit > 0 && d.count >= d.opts.Limit) {
+		return false
+	}
+
+	if d.opts.Reverse || d.opts.Sample > 0 {
+		return d.nextBuffered()
+	}
+
+	for {
+		k, v, ok := d.next()
+		if !ok {
+			return false
+		}
+
+		if d.skipped < d.opts.Offset {
+			d.skipped++
+			continue
+		}
+
+		if d.opts.KeysOnly {
+			v = nil
+		}
+
+		d.rec = Record{Key: k, Val: v}
+		d.count++
+
+		return true
+	}
+}
+
+// nextBuffered fills buffered on its first call, with the sample or
+// the records of the range, and then pops its records.
+func (d *Dumper) nextBuffered() bool {
+	if !d.filled {
+		d.filled = true
+
+		var recs []Record
+		if d.opts.Sample > 0 {
+			recs = d.sample()
+		} else {
+			recs = d.tail()
+		}
+		if d.err != nil {
+			return false
+		}
+
+		if d.opts.Reverse {
+			for i, j := 0, len(recs)-1; i < j; i, j = i+1, j-1 {
+				recs[i], recs[j] = recs[j], recs[i]
+			}
+		}
+
+		if d.opts.Offset < len(recs) {
+			d.buffered = recs[d.opts.Offset:]
+		}
+	}
+
+	if len(d.buffered) == 0 {
+		return false
+	}
+
+	d.rec = d.buffered[0]
+	d.buffered = d.buffered[1:]
+	d.count++
+
+	return true
+}
+
+// tail returns the last Offset+Limit records of the range, or all of
+// them without a Limit.
+func (d *Dumper) tail() []Record {
+	keep := 0
+	if d.opts.Limit > 0 {
+		keep = d.opts.Offset + d.opts.Limit
+	}
+
+	var recs []Record
+	for {
+		k, v, ok := d.next()
+		if !ok {
+			return recs
+		}
+
+		recs = append(recs, d.copyRecord(k, v))
+		if keep > 0 && len(recs) > keep {
+			recs = recs[1:]
+		}
+	}
+}
+
+// sample returns a uniform random sample of Sample records of the
+// range, in key order, by reservoir sampling.
+func (d *Dumper) sample() []Record {
+	type sampled struct {
+		pos int
+		rec Record
+	}
+	var reservoir []sampled
+
+	for pos := 0; ; pos++ {
+		k, v, ok := d.next()
+		if !ok {
+			break
+		}
+
+		if pos < d.opts.Sample {
+			reservoir = append(reservoir, sampled{pos, d.copyRecord(k, v)})
+		} else if i := d.opts.Rand.Intn(pos + 1); i < d.opts.Sample {
+			reservoir[i] = sampled{pos, d.copyRecord(k, v)}
+		}
+	}
+
+	sort.Slice(reservoir, func(i, j int) bool {
+		return reservoir[i].pos < reservoir[j].pos
+	})
+
+	recs := make([]Record, len(reservoir))
+	for i, s := range reservoir {
+		recs[i] = s.rec
+	}
+	return recs
+}
+
+// copyRecord returns a record holding copies of the key-value, which
+// remain valid after the iterator moves on.
+func (d *Dumper) copyRecord(k, v []byte) Record {
+	rec := Record{Key: append([]byte{}, k...)}
+	if !d.opts.KeysOnly {
+		rec.Val = append([]byte{}, v...)
+	}
+	return rec
+}
+
+// next returns the next key-value of the iterator that begins with the
+// prefix, and is selected by the filter and the sample rate.
+func (d *Dumper) next() (k, v []byte, ok bool) {
+	for {
+		if d.started {
+			err := d.iter.Next()
+			if err == moss.ErrIteratorDone {
+				return nil, nil, false
+			}
+			if err != nil {
+				d.err = err
+				return nil, nil, false
+			}
+		}
+		d.started = true
+
+		k, v, err := d.iter.Current()
+		if err == moss.ErrIteratorDone {
+			return nil, nil, false
+		}
+		if err != nil {
+			d.err = err
+			return nil, nil, false
+		}
+
+		if d.opts.Prefix != "" && !bytes.HasPrefix(k, []byte(d.opts.Prefix)) {
+			// Keys are ordered, so none of the rest have the prefix
+			return nil, nil, false
+		}
+
+		if d.opts.Filter != nil && !d.opts.Filter(Record{Key: k, Val: v}) {
+			continue
+		}
+
+		if d.opts.SampleRate > 0 && d.opts.Rand.Float64() >= d.opts.SampleRate {
+			continue
+		}
+
+		return k, v, true
+	}
+}
+
+// Record returns the current record, which is only valid until the
+// next call to Next.
+func (d *Dumper) Record() Record {
+	return d.rec
+}
+
+// Err returns the error, if any, that stopped the iteration.
+func (d *Dumper) Err() error {
+	return d.err
+}
+
+// Close releases the resources of the Dumper.
+func (d *Dumper) Close() error {
+	d.iter.Close()
+	if d.snap != nil {
+		d.snap.Close()
+	}
+	return nil
+}
+
+// KeyVersion is the value of a key as found in the snapshot of a
+// footer.
+type KeyVersion struct {
+	Footer int // 1 for the latest footer.
+	Val    []byte
+}
+
+// FetchKeyVersions returns the value of the key from the latest
+// footer, followed by the values from all the older footers it is
+// available in if all is set. No versions are returned if the key
+// isn't available in the latest footer.
+func FetchKeyVersions(store *moss.Store, key []byte,
+	all bool) ([]KeyVersion, error) {
+	var versions []KeyVersion
+
+	err := WalkFooters(store, all, func(id int, footer *moss.Footer) error {
+		val, err := footer.Get(key, moss.ReadOptions{})
+		if err != nil || val == nil {
+			if id == 1 {
+				return errNotInLatest
+			}
+			return nil
+		}
+		versions = append(versions, KeyVersion{Footer: id, Val: val})
+		return nil
+	})
+	if err == errNotInLatest {
+		return nil, nil
+	}
+
+	return versions, err
+}
+
+var errNotInLatest = fmt.Errorf("key not in latest footer")
+
+// KeyState is the state of a key in the snapshot of a footer.
+type KeyState string
+
+const (
+	KeyPresent KeyState = "present"
+	KeyDeleted KeyState = "deleted" // A deletion of the key is persisted.
+	KeyAbsent  KeyState = "absent"  // Neither the key nor its deletion.
+)
+
+// KeyHistoryEntry is a run of consecutive footers, from Footer back to
+// the older SinceFooter, in which the key had the same state and value.
+type KeyHistoryEntry struct {
+	Footer      int   // 1 for the latest footer.
+	SinceFooter int   // The oldest footer of the run, >= Footer.
+	Offset      int64 // See FooterOffset, of Footer.
+	State       KeyState
+	Val         []byte // nil unless the key is present.
+}
+
+// FetchKeyHistory returns the history of the key through all the
+// footers of the store, starting with the latest, where the footers in
+// which the key is unchanged are collapsed into a single entry.
+func FetchKeyHistory(store *moss.Store, key []byte) ([]KeyHistoryEntry,
+	error) {
+	var history []KeyHistoryEntry
+
+	// The offset of the next (older) footer, as the newer footer is
+	// closed by the time the older one is walked
+	var nextOffset int64
+
+	err := WalkFooters(store, true, func(id int, footer *moss.Footer) error {
+		offset := nextOffset
+		if id == 1 {
+			offset = FooterOffset(footer, nil)
+		}
+		nextOffset = footer.PrevFooterOffset
+
+		state, val, err := keyState(footer, key)
+		if err != nil {
+			return err
+		}
+
+		n := len(history)
+		if n > 0 && history[n-1].State == state &&
+			bytes.Equal(history[n-1].Val, val) {
+			history[n-1].SinceFooter = id
+			return nil
+		}
+
+		history = append(history, KeyHistoryEntry{Footer: id,
+			SinceFooter: id, Offset: offset, State: state,
+			Val: val})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// keyState returns the state of the key in the snapshot of the footer,
+// along with its value if present.
+func keyState(footer *moss.Footer, key []byte) (KeyState, []byte, error) {
+	end := append(key[:len(key):len(key)], 0)
+	iter, err := footer.StartIterator(key, end,
+		moss.IteratorOptions{IncludeDeletions: true})
+	if err != nil || iter == nil {
+		return "", nil, fmt.Errorf("Footer-StartItr() API failed, err: %v",
+			err)
+	}
+	defer iter.Close()
+
+	entry, _, _, err := iter.CurrentEx()
+	if err == moss.ErrIteratorDone {
+		return KeyAbsent, nil, nil
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Iterator-CurrentEx() API failed, err: %v",
+			err)
+	}
+
+	if entry.Operation == moss.OperationDel {
+		return KeyDeleted, nil, nil
+	}
+
+	// Get resolves any merges into the value
+	val, err := footer.Get(key, moss.ReadOptions{})
+	if err != nil {
+		return "", nil, fmt.Errorf("Footer-Get() API failed, err: %v", err)
+	}
+	if val == nil {
+		return KeyAbsent, nil, nil
+	}
+
+	return KeyPresent, val, nil
+}
+
+// FooterOffset returns the file offset of the footer, given the newer
+// footer walked right before it, nil for the latest footer. The offset
+// of an older footer is the PrevFooterOffset of the newer one, while
+// moss does not expose the offset of the latest footer, which is
+// estimated as the page boundary past both its newest segment and the
+// previous footer, where moss persists it.
+func FooterOffset(footer, newer *moss.Footer) int64 {
+	if newer != nil {
+		return newer.PrevFooterOffset
+	}
+
+	offset := segmentsEnd(footer)
+	if footer.PrevFooterOffset >= offset {
+		offset = footer.PrevFooterOffset + 1
+	}
+
+	pageSize := int64(moss.StorePageSize)
+	return (offset + pageSize - 1) / pageSize * pageSize
+}
+
+// segmentsEnd returns the file offset of the end of the newest segment
+// of the footer, including the ones of its child collections.
+func segmentsEnd(footer *moss.Footer) int64 {
+	var end int64
+	for _, loc := range footer.SegmentLocs {
+		if e := int64(loc.BufOffset + loc.BufBytes); e > end {
+			end = e
+		}
+	}
+	for _, child := range footer.ChildFooters {
+		if e := segmentsEnd(child); e > end {
+			end = e
+		}
+	}
+	return end
+}
+
+// KeyLookup is the outcome of looking up a key in a snapshot.
+type KeyLookup struct {
+	Key   []byte
+	Val   []byte // nil when the key was not found.
+	Found bool
+}
+
+// LookupKeys looks up every one of the keys in the latest snapshot of
+// the store, returning a KeyLookup per key in the order of keys.
+func LookupKeys(store *moss.Store, keys [][]byte) ([]KeyLookup, error) {
+	snap, err := store.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+	}
+	if snap == nil {
+		return nil, ErrNoSnapshot
+	}
+	defer snap.Close()
+
+	lookups := make([]KeyLookup, len(keys))
+	for i, key := range keys {
+		val, err := snap.Get(key, moss.ReadOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("Snapshot-Get() API failed, err: %v", err)
+		}
+		lookups[i] = KeyLookup{Key: key, Val: val, Found: val != nil}
+	}
+
+	return lookups, nil
+}
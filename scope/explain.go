@@ -0,0 +1,143 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/couchbase/moss"
+)
+
+// KeyOp is an operation on a key, as persisted in a segment.
+type KeyOp struct {
+	Segment    int    // Index in the footer's SegmentLocs, 0 for the oldest.
+	Operation  string // "set", "del" or "merge".
+	Offset     int64  // Of the key, within the segment's buffer.
+	FileOffset int64  // Of the key, within the data file.
+	ValLen     int
+	Visible    bool // Whether reads see it, rather than it being shadowed.
+}
+
+// KeyExplanation locates the operations on a key within the segments
+// of the latest footer of a store.
+type KeyExplanation struct {
+	File         string
+	Footer       int   // The footer explained, 1 for the latest.
+	FooterOffset int64 // See FooterOffset.
+	NumSegments  int
+	Ops          []KeyOp // From the newest segment, empty if none.
+}
+
+// DataFile returns the path of the current data file of the store at
+// dir, which holds all of the footers of the store.
+func DataFile(dir string) (string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, StoreFilePattern))
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no data file found in: %s", dir)
+	}
+
+	// The file names hold fixed width sequence numbers
+	sort.Strings(files)
+	return files[len(files)-1], nil
+}
+
+// ExplainKey finds every operation on the key that is still persisted
+// in the segments of the latest footer of the store at dir, where the
+// ones down to the newest set or deletion are visible to reads, as
+// merges apply to the older operations, and the older ones are
+// shadowed until compaction reclaims them. The segments of child
+// collections are not searched.
+func ExplainKey(dir string, store *moss.Store, key []byte) (*KeyExplanation,
+	error) {
+	fileName, err := DataFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("File open error: %v", err)
+	}
+	defer f.Close()
+
+	var explanation *KeyExplanation
+
+	err = WalkFooters(store, false, func(id int, footer *moss.Footer) error {
+		explanation = &KeyExplanation{File: fileName, Footer: id,
+			FooterOffset: FooterOffset(footer, nil),
+			NumSegments:  len(footer.SegmentLocs)}
+
+		resolved := false
+		for i := len(footer.SegmentLocs) - 1; i >= 0; i-- {
+			ops, err := findKeyOps(f, &footer.SegmentLocs[i], key)
+			if err != nil {
+				return fmt.Errorf("segment %d: %v", i, err)
+			}
+			for _, op := range ops {
+				op.Segment = i
+				op.Visible = !resolved
+				resolved = resolved || op.Operation != "merge"
+				explanation.Ops = append(explanation.Ops, op)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return explanation, nil
+}
+
+// findKeyOps binary searches the entries of the persisted segment for
+// the key, reading them from the data file.
+func findKeyOps(f *os.File, loc *moss.SegmentLoc, key []byte) ([]KeyOp,
+	error) {
+	r, err := newSegmentReader(f, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	var readErr error
+	i := sort.Search(r.n, func(i int) bool {
+		e, err := r.entry(i)
+		if err != nil {
+			readErr = err
+			return true
+		}
+		return bytes.Compare(e.key, key) >= 0
+	})
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	var ops []KeyOp
+	for ; i < r.n; i++ {
+		e, err := r.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(e.key, key) {
+			break
+		}
+
+		ops = append(ops, KeyOp{Operation: operationName(e.op),
+			Offset: e.keyPos, FileOffset: int64(loc.BufOffset) + e.keyPos,
+			ValLen: e.valLen})
+	}
+
+	return ops, nil
+}
@@ -0,0 +1,145 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// KeyFilter selects keys by a regular expression or a glob pattern,
+// along with the literal prefix that every selected key begins with,
+// which narrows the range of keys to iterate over.
+type KeyFilter struct {
+	re     *regexp.Regexp
+	invert bool
+	prefix string
+}
+
+// CompileKeyRegex returns the filter of the keys that match the regular
+// expression (RE2 syntax, unanchored), or of the keys that do not match
+// it if invert.
+func CompileKeyRegex(expr string, invert bool) (*KeyFilter, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &KeyFilter{re: re, invert: invert}
+	if !invert {
+		f.prefix = regexPrefix(expr)
+	}
+	return f, nil
+}
+
+// CompileKeyGlob returns the filter of the keys that match the glob
+// pattern as a whole, or of the keys that do not match it if invert.
+// In the pattern, "*" matches any run of bytes, "?" any single
+// character, "[...]" (or "[!...]") a character class, and "\" escapes
+// the character that follows it.
+func CompileKeyGlob(glob string, invert bool) (*KeyFilter, error) {
+	var expr, prefix strings.Builder
+	literal := true
+
+	expr.WriteString(`(?s)^`)
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+			literal = false
+		case '?':
+			expr.WriteString(".")
+			literal = false
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end == 0 {
+				// A leading "]" is part of the class
+				end = strings.IndexByte(glob[i+2:], ']') + 1
+			}
+			if end <= 0 {
+				return nil, fmt.Errorf("unterminated [ in glob: %s", glob)
+			}
+			class := glob[i+1 : i+1+end]
+			if class[0] == '!' {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+			literal = false
+		default:
+			if c == '\\' && i+1 < len(glob) {
+				i++
+				c = glob[i]
+			}
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+			if literal {
+				prefix.WriteByte(c)
+			}
+		}
+	}
+	expr.WriteString(`$`)
+
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid glob: %s, err: %v", glob, err)
+	}
+
+	f := &KeyFilter{re: re, invert: invert}
+	if !invert {
+		f.prefix = prefix.String()
+	}
+	return f, nil
+}
+
+// Match returns whether the filter selects the key, where a nil filter
+// selects every key.
+func (f *KeyFilter) Match(key []byte) bool {
+	if f == nil {
+		return true
+	}
+	return f.re.Match(key) != f.invert
+}
+
+// Prefix returns the prefix of the keys that are both selected by the
+// filter and begin with prefix, being the longer of the two when one
+// begins with the other.
+func (f *KeyFilter) Prefix(prefix string) string {
+	if f == nil || !strings.HasPrefix(f.prefix, prefix) {
+		return prefix
+	}
+	return f.prefix
+}
+
+// regexPrefix returns the literal prefix of the matches of a regular
+// expression anchored at the beginning of the text, and "" for
+// expressions that are not anchored.
+func regexPrefix(expr string) string {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+	re = re.Simplify()
+
+	if re.Op != syntax.OpConcat || len(re.Sub) == 0 ||
+		re.Sub[0].Op != syntax.OpBeginText {
+		return ""
+	}
+
+	var prefix []rune
+	for _, sub := range re.Sub[1:] {
+		if sub.Op != syntax.OpLiteral || sub.Flags&syntax.FoldCase != 0 {
+			break
+		}
+		prefix = append(prefix, sub.Rune...)
+	}
+	return string(prefix)
+}
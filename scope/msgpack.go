@@ -0,0 +1,227 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// maxDecodeDepth bounds the nesting of the arrays and maps decoded
+// from the msgpack and CBOR formats.
+const maxDecodeDepth = 512
+
+// errTruncated is returned for input ending in the middle of a value.
+var errTruncated = fmt.Errorf("truncated input")
+
+// DecodeMsgpack decodes a msgpack value into the types that encode to
+// JSON, where map keys are converted to strings, binary data is kept
+// as []byte (base64 in JSON), and extension types are decoded as maps
+// of their type and data.
+func DecodeMsgpack(b []byte) (interface{}, error) {
+	d := &binaryDecoder{buf: b}
+	v, err := d.msgpackValue(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(d.buf) > 0 {
+		return nil, fmt.Errorf("trailing data after the msgpack value")
+	}
+	return v, nil
+}
+
+// binaryDecoder consumes the input of the msgpack and CBOR decoders.
+type binaryDecoder struct {
+	buf []byte
+}
+
+func (d *binaryDecoder) next(n uint64) ([]byte, error) {
+	if uint64(len(d.buf)) < n {
+		return nil, errTruncated
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of n bytes.
+func (d *binaryDecoder) uint(n int) (uint64, error) {
+	b, err := d.next(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+func (d *binaryDecoder) msgpackValue(depth int) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, fmt.Errorf("nested too deeply")
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := b[0]
+
+	switch {
+	case c <= 0x7f:
+		return uint64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.msgpackMap(uint64(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.msgpackArray(uint64(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		s, err := d.next(uint64(c & 0x1f))
+		return string(s), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6: // bin 8, 16, 32
+		n, err := d.uint(1 << (c - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		bin, err := d.next(n)
+		return append([]byte{}, bin...), err
+	case 0xc7, 0xc8, 0xc9: // ext 8, 16, 32
+		n, err := d.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackExt(n)
+	case 0xca:
+		bits, err := d.uint(4)
+		return jsonFloat(float64(math.Float32frombits(uint32(bits)))), err
+	case 0xcb:
+		bits, err := d.uint(8)
+		return jsonFloat(math.Float64frombits(bits)), err
+	case 0xcc, 0xcd, 0xce, 0xcf: // uint 8, 16, 32, 64
+		return d.uint(1 << (c - 0xcc))
+	case 0xd0, 0xd1, 0xd2, 0xd3: // int 8, 16, 32, 64
+		n := 1 << (c - 0xd0)
+		v, err := d.uint(n)
+		if err != nil {
+			return nil, err
+		}
+		// Sign extend
+		shift := uint(64 - 8*n)
+		return int64(v<<shift) >> shift, nil
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8: // fixext 1, 2, 4, 8, 16
+		return d.msgpackExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb: // str 8, 16, 32
+		n, err := d.uint(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		s, err := d.next(n)
+		return string(s), err
+	case 0xdc, 0xdd: // array 16, 32
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackArray(n, depth)
+	case 0xde, 0xdf: // map 16, 32
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.msgpackMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("invalid msgpack type: 0x%x", c)
+}
+
+func (d *binaryDecoder) msgpackArray(n uint64,
+	depth int) ([]interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+
+	a := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := d.msgpackValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (d *binaryDecoder) msgpackMap(n uint64,
+	depth int) (map[string]interface{}, error) {
+	if n > uint64(len(d.buf)) {
+		return nil, errTruncated
+	}
+
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := d.msgpackValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.msgpackValue(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[mapKey(k)] = v
+	}
+	return m, nil
+}
+
+func (d *binaryDecoder) msgpackExt(n uint64) (interface{}, error) {
+	typ, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"ext_type": int8(typ[0]),
+		"data": append([]byte{}, data...)}, nil
+}
+
+// mapKey converts a decoded map key to the string of a JSON object key.
+func mapKey(k interface{}) string {
+	switch k := k.(type) {
+	case string:
+		return k
+	case []byte:
+		return string(k)
+	}
+	return fmt.Sprint(k)
+}
+
+// jsonFloat returns the float, or its name if JSON can not encode it.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Sprint(f)
+	}
+	return f
+}
@@ -0,0 +1,199 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/couchbase/moss"
+)
+
+// maxExampleLen is the length past which example strings are truncated.
+const maxExampleLen = 64
+
+// SchemaOptions select the values whose schema FetchSchema infers.
+type SchemaOptions struct {
+	Prefix   string     // Only keys that begin with the prefix.
+	Filter   *KeyFilter // Only keys selected by the filter, if not nil.
+	Decoder  Decoder    // Decodes the values, JSON if nil.
+	Examples int        // Max number of distinct examples per field.
+}
+
+// SchemaField is the inferred schema of a path of the values, where
+// lengths are the ones of strings (in characters), arrays and objects.
+type SchemaField struct {
+	Path      string            `json:"path"`
+	Docs      uint64            `json:"docs"` // Values holding the path.
+	Frequency float64           `json:"frequency"`
+	Types     map[string]uint64 `json:"types"`
+	MinLength *int              `json:"min_length,omitempty"`
+	MaxLength *int              `json:"max_length,omitempty"`
+	Examples  []interface{}     `json:"examples,omitempty"`
+
+	lastDoc uint64 // The last value counted in Docs.
+}
+
+// Schema is the schema inferred from the values of a store.
+type Schema struct {
+	Values    uint64         `json:"values"`    // Values decoded.
+	Undecoded uint64         `json:"undecoded"` // Values that failed to decode.
+	Fields    []*SchemaField `json:"fields"`    // In path order.
+}
+
+// FetchSchema infers the schema of the values in the latest snapshot
+// of the store, being the paths found in the values, as with Where,
+// where the elements of arrays are under "[]", along with the types,
+// frequencies, lengths and examples of their values.
+func FetchSchema(store *moss.Store, opts SchemaOptions) (*Schema, error) {
+	decoder := opts.Decoder
+	if decoder == nil {
+		decoder = decodeJSON
+	}
+
+	dumpOpts := DumpOptions{Prefix: opts.Filter.Prefix(opts.Prefix)}
+	if opts.Filter != nil {
+		dumpOpts.Filter = func(rec Record) bool {
+			return opts.Filter.Match(rec.Key)
+		}
+	}
+
+	d, err := Dump(store, dumpOpts)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	s := &Schema{}
+	fields := map[string]*SchemaField{}
+
+	for d.Next() {
+		v, err := decoder(d.Record().Val)
+		if err == nil {
+			if raw, ok := v.(json.RawMessage); ok {
+				v, err = decodeJSON(raw)
+			}
+		}
+		if err != nil {
+			s.Undecoded++
+			continue
+		}
+
+		s.Values++
+		s.add(fields, ".", v, opts.Examples)
+	}
+	if d.Err() != nil {
+		return nil, d.Err()
+	}
+
+	for _, f := range fields {
+		f.Frequency = float64(f.Docs) * 100 / float64(s.Values)
+		s.Fields = append(s.Fields, f)
+	}
+	sort.Slice(s.Fields, func(i, j int) bool {
+		return s.Fields[i].Path < s.Fields[j].Path
+	})
+
+	return s, nil
+}
+
+// add accounts for the value v at the path of the current value.
+func (s *Schema) add(fields map[string]*SchemaField, path string,
+	v interface{}, examples int) {
+	f := fields[path]
+	if f == nil {
+		f = &SchemaField{Path: path, Types: map[string]uint64{}}
+		fields[path] = f
+	}
+	if f.lastDoc != s.Values {
+		f.lastDoc = s.Values
+		f.Docs++
+	}
+
+	typ, length := "", -1
+	switch v := v.(type) {
+	case map[string]interface{}:
+		typ, length = "object", len(v)
+		for name, child := range v {
+			s.add(fields, schemaPath(path, name), child, examples)
+		}
+	case []interface{}:
+		typ, length = "array", len(v)
+		elemPath := path + "[]"
+		if path == "." {
+			elemPath = ".[]"
+		}
+		for _, child := range v {
+			s.add(fields, elemPath, child, examples)
+		}
+	case string:
+		typ, length = "string", utf8.RuneCountInString(v)
+	case bool:
+		typ = "boolean"
+	case nil:
+		typ = "null"
+	default:
+		if _, ok := number(v); ok {
+			typ = "number"
+		} else {
+			typ = fmt.Sprintf("%T", v)
+		}
+	}
+	f.Types[typ]++
+
+	if length >= 0 {
+		if f.MinLength == nil || length < *f.MinLength {
+			f.MinLength = &length
+		}
+		if f.MaxLength == nil || length > *f.MaxLength {
+			max := length
+			f.MaxLength = &max
+		}
+	}
+
+	if len(f.Examples) < examples && typ != "object" && typ != "array" {
+		f.addExample(v)
+	}
+}
+
+// addExample adds the value to the examples of the field, unless it is
+// already one of them, where long strings are truncated.
+func (f *SchemaField) addExample(v interface{}) {
+	if str, ok := v.(string); ok && utf8.RuneCountInString(str) > maxExampleLen {
+		v = string([]rune(str)[:maxExampleLen]) + "..."
+	}
+	for _, example := range f.Examples {
+		if reflect.DeepEqual(example, v) {
+			return
+		}
+	}
+	f.Examples = append(f.Examples, v)
+}
+
+var identRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// schemaPath returns the path of the field of the object at path, as
+// parsed by CompileWhere.
+func schemaPath(path, name string) string {
+	if path == "." {
+		path = ""
+	}
+	if identRE.MatchString(name) {
+		return path + "." + name
+	}
+	quoted, _ := json.Marshal(name)
+	if path == "" {
+		path = "."
+	}
+	return path + "[" + string(quoted) + "]"
+}
@@ -0,0 +1,118 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+// Package scope implements the diagnostics of mossScope over moss
+// stores, returning typed results that callers can render as they see
+// fit. The mossScope commands are renderers over this package.
+package scope
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/couchbase/moss"
+)
+
+// ReadOnlyOptions are the options that stores are opened with for
+// diagnosis, which neither modify nor remove any of the store's files.
+var ReadOnlyOptions = moss.StoreOptions{KeepFiles: true,
+	CollectionOptions: moss.CollectionOptions{ReadOnly: true}}
+
+// ErrNoSnapshot is returned when a store has no snapshot available.
+var ErrNoSnapshot = errors.New("no snapshot available")
+
+// OpenError is returned when the moss API fails to open a store.
+// Corrupt is set when the store directory itself is accessible, which
+// implies that moss failed to load its contents.
+type OpenError struct {
+	Dir     string
+	API     string
+	Corrupt bool
+	Err     error
+}
+
+func (e *OpenError) Error() string {
+	return fmt.Sprintf("%s API failed, err: %v", e.API, e.Err)
+}
+
+func (e *OpenError) Unwrap() error {
+	return e.Err
+}
+
+func newOpenError(api, dir string, err error) *OpenError {
+	if err == nil {
+		err = errors.New("no store returned")
+	}
+	fi, statErr := os.Stat(dir)
+	return &OpenError{Dir: dir, API: api, Err: err,
+		Corrupt: statErr == nil && fi.IsDir()}
+}
+
+// OpenStore opens the store at dir with the ReadOnlyOptions.
+func OpenStore(dir string) (*moss.Store, error) {
+	store, err := moss.OpenStore(dir, ReadOnlyOptions)
+	if err != nil || store == nil {
+		return nil, newOpenError("Moss-OpenStore()", dir, err)
+	}
+	return store, nil
+}
+
+// WalkFooters invokes fn with the latest footer of the store, followed
+// by all the older footers if all is set, where id is 1 for the latest
+// footer. The footer is only valid for the duration of the call, and
+// the walk stops at the first error returned by fn.
+func WalkFooters(store *moss.Store, all bool,
+	fn func(id int, footer *moss.Footer) error) error {
+	currSnap, err := store.Snapshot()
+	if err != nil {
+		return fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+	}
+	if currSnap == nil {
+		return ErrNoSnapshot
+	}
+
+	for id := 1; ; id++ {
+		err = fn(id, currSnap.(*moss.Footer))
+		if err != nil || !all {
+			currSnap.Close()
+			return err
+		}
+
+		prevSnap, err := store.SnapshotPrevious(currSnap)
+		currSnap.Close()
+		currSnap = prevSnap
+
+		if err != nil || currSnap == nil {
+			return nil
+		}
+	}
+}
+
+// SnapshotAt returns the snapshot of the n'th footer of the store,
+// where 1 is the latest footer. The caller must close the snapshot.
+func SnapshotAt(store *moss.Store, n int) (moss.Snapshot, error) {
+	snap, err := store.Snapshot()
+	if err != nil {
+		return nil, fmt.Errorf("Store-Snapshot() API failed, err: %v", err)
+	}
+	if snap == nil {
+		return nil, ErrNoSnapshot
+	}
+
+	for i := 1; i < n; i++ {
+		prevSnap, err := store.SnapshotPrevious(snap)
+		snap.Close()
+		if err != nil || prevSnap == nil {
+			return nil, fmt.Errorf("footer %d not available", n)
+		}
+		snap = prevSnap
+	}
+
+	return snap, nil
+}
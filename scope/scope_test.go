@@ -0,0 +1,1126 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/moss"
+	"github.com/golang/snappy"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+var itemCount = 10
+
+// initStore persists footers footers into a fresh store, each setting
+// all of the items with values prefixed by the footer's ordinal.
+func initStore(t *testing.T, footers int) string {
+	dir := "testScopeStore"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+
+	recs := make([]Record, 0, itemCount)
+	for j := 0; j < footers; j++ {
+		recs = recs[:0]
+		for i := 0; i < itemCount; i++ {
+			recs = append(recs, Record{Key: []byte(fmt.Sprintf("key%d", i)),
+				Val: []byte(fmt.Sprintf("val%d_%d", i, j))})
+		}
+
+		written, batches, err := Import(dir, recs, 0)
+		if err != nil || written != itemCount || batches != 1 {
+			t.Fatalf("Expected Import() to work, written: %d, batches: %d,"+
+				" err: %v", written, batches, err)
+		}
+	}
+
+	return dir
+}
+
+func openStore(t *testing.T, dir string) *moss.Store {
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFetchFooterStats(t *testing.T) {
+	dir := initStore(t, 2)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	stats, err := FetchFooterStats(store, false)
+	if err != nil || len(stats) != 1 {
+		t.Fatalf("Expected the latest footer's stats, err: %v", err)
+	}
+
+	if stats[0].NumSegments != 2 ||
+		stats[0].TotalOpsSet != uint64(2*itemCount) ||
+		len(stats[0].SegmentBytes) != 2 {
+		t.Errorf("Unexpected latest footer stats: %+v", stats[0])
+	}
+
+	stats, err = FetchFooterStats(store, true)
+	if err != nil || len(stats) != 2 {
+		t.Fatalf("Expected the stats of 2 footers, err: %v", err)
+	}
+
+	if stats[1].NumSegments != 1 || stats[1].TotalOpsSet != uint64(itemCount) {
+		t.Errorf("Unexpected older footer stats: %+v", stats[1])
+	}
+}
+
+func TestFetchFragAndDiagStats(t *testing.T) {
+	dir := initStore(t, 2)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	frag, err := FetchFragStats(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frag.DataBytes == 0 || frag.DirSize == 0 ||
+		frag.DirSize != frag.DataBytes+frag.FragmentationBytes {
+		t.Errorf("Unexpected frag stats: %+v", frag)
+	}
+
+	diag, err := FetchDiagStats(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diag["total_ops_set"] != uint64(2*itemCount) ||
+		diag["num_bytes_used_disk"] != frag.DirSize {
+		t.Errorf("Unexpected diag stats: %v", diag)
+	}
+}
+
+func TestLookupKeys(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	lookups, err := LookupKeys(store,
+		[][]byte{[]byte("key3"), []byte("nokey"), []byte("key0")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(lookups) != 3 ||
+		!lookups[0].Found || string(lookups[0].Val) != "val3_0" ||
+		lookups[1].Found || lookups[1].Val != nil ||
+		!lookups[2].Found || string(lookups[2].Key) != "key0" {
+		t.Errorf("Unexpected lookups: %+v", lookups)
+	}
+}
+
+func TestDump(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	tests := []struct {
+		opts   DumpOptions
+		expect []string
+	}{
+		{DumpOptions{}, []string{"key0", "key1", "key2", "key3", "key4",
+			"key5", "key6", "key7", "key8", "key9"}},
+		{DumpOptions{Prefix: "key3"}, []string{"key3"}},
+		{DumpOptions{Start: []byte("key7")}, []string{"key7", "key8", "key9"}},
+		{DumpOptions{Start: []byte("key2"), End: []byte("key4")},
+			[]string{"key2", "key3"}},
+		{DumpOptions{Limit: 2, KeysOnly: true}, []string{"key0", "key1"}},
+		{DumpOptions{Prefix: "nokey"}, nil},
+		{DumpOptions{Offset: 3, Limit: 2}, []string{"key3", "key4"}},
+		{DumpOptions{Offset: 10}, nil},
+		{DumpOptions{Reverse: true, Limit: 3}, []string{"key9", "key8", "key7"}},
+		{DumpOptions{Reverse: true, Offset: 8, KeysOnly: true},
+			[]string{"key1", "key0"}},
+		{DumpOptions{Reverse: true, Offset: 2, Limit: 2, End: []byte("key5")},
+			[]string{"key2", "key1"}},
+		{DumpOptions{Filter: func(rec Record) bool {
+			return rec.Key[3]%2 == 0
+		}, Offset: 1, Limit: 2}, []string{"key2", "key4"}},
+	}
+
+	for _, test := range tests {
+		d, err := Dump(store, test.opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var keys []string
+		for d.Next() {
+			rec := d.Record()
+			keys = append(keys, string(rec.Key))
+
+			if test.opts.KeysOnly != (rec.Val == nil) {
+				t.Errorf("Unexpected value for %s: %q", rec.Key, rec.Val)
+			}
+		}
+		if d.Err() != nil {
+			t.Error(d.Err())
+		}
+		d.Close()
+
+		if fmt.Sprint(keys) != fmt.Sprint(test.expect) {
+			t.Errorf("Unexpected keys for %+v: %v", test.opts, keys)
+		}
+	}
+}
+
+func TestDumpSample(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	sample := func(opts DumpOptions) []string {
+		opts.Rand = rand.New(rand.NewSource(42))
+		d, err := Dump(store, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+
+		var keys []string
+		for d.Next() {
+			keys = append(keys, string(d.Record().Key))
+		}
+		if d.Err() != nil {
+			t.Error(d.Err())
+		}
+		return keys
+	}
+
+	keys := sample(DumpOptions{Sample: 3})
+	if len(keys) != 3 || !sort.StringsAreSorted(keys) {
+		t.Errorf("Expected 3 sampled keys in order, got: %v", keys)
+	}
+	if fmt.Sprint(sample(DumpOptions{Sample: 3})) != fmt.Sprint(keys) {
+		t.Errorf("Expected the same sample from the same seed")
+	}
+
+	keys = sample(DumpOptions{Sample: 3, Reverse: true, KeysOnly: true})
+	if len(keys) != 3 || sort.StringsAreSorted(keys) {
+		t.Errorf("Expected 3 sampled keys in reverse, got: %v", keys)
+	}
+
+	if len(sample(DumpOptions{Sample: 20})) != 10 ||
+		len(sample(DumpOptions{SampleRate: 1})) != 10 {
+		t.Errorf("Expected every key to be sampled")
+	}
+
+	keys = sample(DumpOptions{SampleRate: 0.5})
+	if len(keys) == 0 || len(keys) == 10 ||
+		fmt.Sprint(sample(DumpOptions{SampleRate: 0.5})) != fmt.Sprint(keys) {
+		t.Errorf("Unexpected keys sampled at a rate of 0.5: %v", keys)
+	}
+}
+
+func TestFetchKeyVersions(t *testing.T) {
+	dir := initStore(t, 2)
+	defer os.RemoveAll(dir)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	versions, err := FetchKeyVersions(store, []byte("key5"), true)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("Expected 2 versions, err: %v", err)
+	}
+
+	if versions[0].Footer != 1 || string(versions[0].Val) != "val5_1" ||
+		versions[1].Footer != 2 || string(versions[1].Val) != "val5_0" {
+		t.Errorf("Unexpected versions: %+v", versions)
+	}
+
+	versions, err = FetchKeyVersions(store, []byte("missing"), true)
+	if err != nil || len(versions) != 0 {
+		t.Errorf("Expected no versions, err: %v", err)
+	}
+}
+
+// persistFooter persists a footer into the store at dir, in which the
+// key is set to val, or deleted if val is nil.
+func persistFooter(t *testing.T, dir string, key, val []byte) {
+	op := moss.OperationSet
+	if val == nil {
+		op = moss.OperationDel
+	}
+	persistOp(t, dir, op, key, val)
+}
+
+// persistOp persists a footer into the store at dir, holding the
+// operation on the key, where merges append to the value.
+func persistOp(t *testing.T, dir string, op uint64, key, val []byte) {
+	store, err := moss.OpenStore(dir, moss.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	coll, _ := moss.NewCollection(moss.CollectionOptions{
+		MergeOperator: &moss.MergeOperatorStringAppend{Sep: ":"},
+	})
+	coll.Start()
+	defer coll.Close()
+
+	batch, err := coll.NewBatch(1, len(key)+len(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch op {
+	case moss.OperationSet:
+		batch.Set(key, val)
+	case moss.OperationDel:
+		batch.Del(key)
+	case moss.OperationMerge:
+		batch.Merge(key, val)
+	}
+	err = coll.ExecuteBatch(batch, moss.WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := coll.Snapshot()
+	defer ss.Close()
+
+	_, err = store.Persist(ss, moss.StorePersistOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// persistChildFooter persists a footer holding a set of the key in
+// the top-level collection, and in the child collection.
+func persistChildFooter(t *testing.T, dir, child string, key, val []byte) {
+	store, err := moss.OpenStore(dir, moss.StoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	coll, _ := moss.NewCollection(moss.CollectionOptions{})
+	coll.Start()
+	defer coll.Close()
+
+	batch, err := coll.NewBatch(1, len(key)+len(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer batch.Close()
+	batch.Set(key, val)
+
+	childBatch, err := batch.NewChildCollectionBatch(child,
+		moss.BatchOptions{TotalOps: 1, TotalKeyValBytes: len(key) + len(val)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	childBatch.Set(key, val)
+
+	err = coll.ExecuteBatch(batch, moss.WriteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ss, _ := coll.Snapshot()
+	defer ss.Close()
+
+	_, err = store.Persist(ss, moss.StorePersistOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFetchKeyHistory(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	// Footers 5 through 1, from the oldest
+	key := []byte("key5")
+	persistFooter(t, dir, key, []byte("val5_0"))
+	persistFooter(t, dir, key, nil)
+	persistFooter(t, dir, key, []byte("val5_1"))
+	persistFooter(t, dir, []byte("other"), []byte("val"))
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	history, err := FetchKeyHistory(store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []KeyHistoryEntry{
+		{Footer: 1, SinceFooter: 2, State: KeyPresent, Val: []byte("val5_1")},
+		{Footer: 3, SinceFooter: 3, State: KeyDeleted},
+		{Footer: 4, SinceFooter: 5, State: KeyPresent, Val: []byte("val5_0")},
+	}
+	if len(history) != len(expect) {
+		t.Fatalf("Unexpected history: %+v", history)
+	}
+	for i := range expect {
+		if history[i].Footer != expect[i].Footer ||
+			history[i].SinceFooter != expect[i].SinceFooter ||
+			history[i].State != expect[i].State ||
+			!bytes.Equal(history[i].Val, expect[i].Val) ||
+			history[i].Offset <= 0 {
+			t.Errorf("Unexpected history entry %d: %+v", i, history[i])
+		}
+	}
+	if history[0].Offset <= history[2].Offset {
+		t.Errorf("Expected newer footers at later offsets: %+v", history)
+	}
+
+	// The offsets point at the persisted footers
+	fileName, err := DataFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range history {
+		if !bytes.HasPrefix(data[entry.Offset:], moss.StoreMagicBeg) {
+			t.Errorf("Expected footer %d at offset %d", entry.Footer,
+				entry.Offset)
+		}
+	}
+
+	history, err = FetchKeyHistory(store, []byte("missing"))
+	if err != nil || len(history) != 1 || history[0].State != KeyAbsent ||
+		history[0].SinceFooter != 5 {
+		t.Errorf("Expected the key to be absent throughout: %+v, err: %v",
+			history, err)
+	}
+}
+
+func TestExplainKey(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	key := []byte("key5")
+	persistFooter(t, dir, key, nil)
+	persistFooter(t, dir, key, []byte("v"))
+	persistFooter(t, dir, []byte("other"), []byte("val"))
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	explanation, err := ExplainKey(dir, store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if explanation.Footer != 1 || explanation.NumSegments != 4 ||
+		len(explanation.Ops) != 3 {
+		t.Fatalf("Unexpected explanation: %+v", explanation)
+	}
+
+	ops := explanation.Ops
+	if ops[0].Segment != 2 || ops[0].Operation != "set" ||
+		ops[0].ValLen != 1 || !ops[0].Visible ||
+		ops[1].Segment != 1 || ops[1].Operation != "del" || ops[1].Visible ||
+		ops[2].Segment != 0 || ops[2].Operation != "set" ||
+		ops[2].ValLen != len("val5_0") || ops[2].Visible {
+		t.Errorf("Unexpected ops: %+v", ops)
+	}
+
+	// The file offsets point at the persisted key and value
+	data, err := ioutil.ReadFile(explanation.File)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := ops[0].FileOffset
+	if string(data[at:at+int64(len(key))+1]) != "key5v" {
+		t.Errorf("Unexpected data at the file offset: %q",
+			data[at:at+int64(len(key))+1])
+	}
+
+	explanation, err = ExplainKey(dir, store, []byte("missing"))
+	if err != nil || len(explanation.Ops) != 0 {
+		t.Errorf("Expected no ops, err: %v", err)
+	}
+}
+
+func TestSegmentReader(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	persistFooter(t, dir, []byte("key5"), nil)
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	fileName, err := DataFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var segments [][]segmentEntry
+	err = WalkFooters(store, false, func(id int, footer *moss.Footer) error {
+		for i := range footer.SegmentLocs {
+			r, err := newSegmentReader(f, &footer.SegmentLocs[i])
+			if err != nil {
+				return err
+			}
+
+			var entries []segmentEntry
+			for j := 0; j < r.n; j++ {
+				e, err := r.entry(j)
+				if err != nil {
+					return err
+				}
+				entries = append(entries, e)
+			}
+			segments = append(segments, entries)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(segments) != 2 || len(segments[0]) != itemCount ||
+		len(segments[1]) != 1 {
+		t.Fatalf("Unexpected segments: %+v", segments)
+	}
+	for i, e := range segments[0] {
+		if e.op != moss.OperationSet ||
+			string(e.key) != fmt.Sprintf("key%d", i) ||
+			e.valLen != len(fmt.Sprintf("val%d_0", i)) {
+			t.Errorf("Unexpected entry %d: %+v", i, e)
+		}
+	}
+	if e := segments[1][0]; e.op != moss.OperationDel ||
+		string(e.key) != "key5" || e.valLen != 0 {
+		t.Errorf("Unexpected deletion: %+v", e)
+	}
+}
+
+func TestExplainKeyMerge(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	key := []byte("key5")
+	persistFooter(t, dir, key, nil)
+	persistFooter(t, dir, key, []byte("v"))
+	persistOp(t, dir, moss.OperationMerge, key, []byte("m"))
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	explanation, err := ExplainKey(dir, store, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The merge applies to the set below it, which shadows the rest
+	var ops []string
+	for _, op := range explanation.Ops {
+		ops = append(ops, fmt.Sprintf("%s:%v", op.Operation, op.Visible))
+	}
+	if strings.Join(ops, " ") != "merge:true set:true del:false set:false" {
+		t.Errorf("Unexpected ops: %v", ops)
+	}
+}
+
+func TestFetchAccurateFragStats(t *testing.T) {
+	dir := initStore(t, 1)
+	defer os.RemoveAll(dir)
+
+	persistFooter(t, dir, []byte("key5"), nil)
+	persistFooter(t, dir, []byte("key5"), []byte("v"))
+	persistFooter(t, dir, []byte("other"), []byte("val"))
+	persistFooter(t, dir, []byte("key3"), nil)
+	persistOp(t, dir, moss.OperationMerge, []byte("key7"), []byte("m"))
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	stats, err := FetchAccurateFragStats(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each entry takes 16 bytes along with its key and value, where the
+	// merge into key7 keeps the older value of key7 live
+	expect := ReclaimStats{
+		LiveBytes: 8*(16+4+6) + (16 + 4 + 1) + (16 + 5 + 3) +
+			(16 + 4 + 1),
+		ShadowedVersions: 3,
+		ShadowedBytes:    (16 + 4) + (16 + 4 + 6) + (16 + 4 + 6),
+		Tombstones:       1,
+		TombstoneBytes:   16 + 4,
+	}
+	if stats.ReclaimStats == nil ||
+		stats.LiveBytes != expect.LiveBytes ||
+		stats.ShadowedVersions != expect.ShadowedVersions ||
+		stats.ShadowedBytes != expect.ShadowedBytes ||
+		stats.Tombstones != expect.Tombstones ||
+		stats.TombstoneBytes != expect.TombstoneBytes {
+		t.Errorf("Unexpected reclaim stats: %+v, expected: %+v",
+			stats.ReclaimStats, expect)
+	}
+
+	if stats.ReclaimableBytes == 0 || stats.ReclaimableBytes >= stats.DirSize {
+		t.Errorf("Unexpected reclaimable bytes: %+v", stats.ReclaimStats)
+	}
+}
+
+func TestFetchAccurateFragStatsCollections(t *testing.T) {
+	dir := "testCollectionsStore"
+	os.RemoveAll(dir)
+	os.Mkdir(dir, 0777)
+	defer os.RemoveAll(dir)
+
+	persistChildFooter(t, dir, "docs", []byte("key"), []byte("v0"))
+	persistChildFooter(t, dir, "docs", []byte("key"), []byte("v1"))
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	stats, err := FetchAccurateFragStats(dir, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The live version of the key in the child collection is counted
+	// along with the live and shadowed versions of the top-level one
+	if stats.ReclaimStats == nil ||
+		stats.LiveBytes != 2*(16+3+2) ||
+		stats.ShadowedVersions != 1 ||
+		stats.ShadowedBytes != 16+3+2 {
+		t.Errorf("Unexpected reclaim stats: %+v", stats.ReclaimStats)
+	}
+}
+
+// prefixCoded encodes i as a bleve prefix coded number, with a shift
+// of 0.
+func prefixCoded(i int64) []byte {
+	sortableBits := uint64(i) ^ 0x8000000000000000
+	buf := make([]byte, 11)
+	buf[0] = 0x20
+	for j := 10; j > 0; j-- {
+		buf[j] = byte(sortableBits & 0x7f)
+		sortableBits >>= 7
+	}
+	return buf
+}
+
+func TestDecodeBleveRow(t *testing.T) {
+	number := append([]byte{'n'},
+		prefixCoded(int64(math.Float64bits(5.5)))...)
+
+	tests := []struct {
+		key, val []byte
+		expect   string
+	}{
+		{[]byte("v"), []byte{7}, `{"type":"version","version":7}`},
+		{[]byte("f\x01\x00"), []byte("title\xff"),
+			`{"type":"field","index":1,"name":"title"}`},
+		{[]byte("d\x01\x00moss"), []byte{3},
+			`{"type":"dictionary","field":1,"term":"moss","count":3}`},
+		{[]byte("t\x01\x00moss\xffdoc1"),
+			[]byte{2, 0x80, 0x80, 0x80, 0xf8, 0x03, 1, 1, 0, 4, 1, 0},
+			`{"type":"term_frequency","field":1,"term":"moss",` +
+				`"doc_id":"doc1","freq":2,"norm":0.5,"vectors":` +
+				`[{"field":1,"pos":1,"start":0,"end":4,"array_positions":[0]}]}`},
+		{[]byte("t\x01\x00moss\xffdoc1"), nil,
+			`{"type":"term_frequency","field":1,"term":"moss",` +
+				`"doc_id":"doc1","freq":0,"norm":0}`},
+		{[]byte("bdoc1"),
+			[]byte("\x0a\x08\x08\x01\x12\x04moss\x12\x04\x08\x01\x10\x02"),
+			`{"type":"back_index","doc_id":"doc1",` +
+				`"terms":[{"field":1,"terms":["moss"]}],` +
+				`"stored":[{"field":1,"array_positions":[2]}]}`},
+		{[]byte("sdoc1\xff\x01\x00"), []byte("thello"),
+			`{"type":"stored","doc_id":"doc1","field":1,` +
+				`"value_type":"text","value":"hello"}`},
+		{[]byte("sdoc1\xff\x02\x00\x03"), number,
+			`{"type":"stored","doc_id":"doc1","field":2,` +
+				`"array_positions":[3],"value_type":"number","value":5.5}`},
+		{[]byte("sdoc1\xff\x03\x00"), []byte("bT"),
+			`{"type":"stored","doc_id":"doc1","field":3,` +
+				`"value_type":"boolean","value":true}`},
+		{[]byte("iname"), []byte("val"),
+			`{"type":"internal","key":"name","val":"val"}`},
+	}
+
+	for _, test := range tests {
+		row, err := DecodeBleveRow(test.key, test.val)
+		if err != nil {
+			t.Errorf("Expected %q to decode, err: %v", test.key, err)
+			continue
+		}
+		jBuf, _ := json.Marshal(row)
+		if string(jBuf) != test.expect {
+			t.Errorf("Unexpected row of %q, expected:\n%s\ngot:\n%s",
+				test.key, test.expect, jBuf)
+		}
+	}
+
+	for _, key := range []string{"", "key0", "t\x01\x00moss", "f\x01"} {
+		_, err := DecodeBleveRow([]byte(key), []byte("val"))
+		if err == nil {
+			t.Errorf("Expected %q to fail to decode", key)
+		}
+	}
+}
+
+func TestFetchBleveStats(t *testing.T) {
+	dir := "testBleveStore"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	rows := [][2]string{
+		{"v", "\x07"},
+		{"f\x00\x00", "title\xff"},
+		{"f\x01\x00", "body\xff"},
+		{"d\x00\x00moss", "\x02"},
+		{"d\x00\x00go", "\x01"},
+		{"d\x01\x00x", "\x05"},
+		{"t\x00\x00moss\xffdoc1", "\x01\x00"},
+		{"t\x00\x00moss\xffdoc2", "\x01\x00"},
+		{"t\x00\x00go\xffdoc1", "\x01\x00"},
+		{"sdoc1\xff\x00\x00", "ttext"},
+		{"bdoc1", "\x0a\x02\x08\x00"},
+		{"bdoc2", "\x0a\x02\x08\x00"},
+		{"junk", "val"},
+	}
+	recs := make([]Record, len(rows))
+	for i, row := range rows {
+		recs[i] = Record{Key: []byte(row[0]), Val: []byte(row[1])}
+	}
+	_, _, err := Import(dir, recs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	stats, err := FetchBleveStats(store, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Version != 7 || stats.Docs != 2 || stats.UndecodedRows != 1 ||
+		len(stats.Fields) != 2 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	title := stats.Fields[0]
+	if title.Name != "title" || title.Terms != 2 || title.Postings != 3 ||
+		title.StoredFields != 1 ||
+		title.StoredBytes != uint64(len(rows[9][0])+len(rows[9][1])) {
+		t.Errorf("Unexpected field stats: %+v", title)
+	}
+
+	if len(stats.LargestPostings) != 2 ||
+		stats.LargestPostings[0] != (BlevePostingList{Field: 1, Name: "body",
+			Term: "x", Count: 5}) ||
+		stats.LargestPostings[1].Term != "moss" {
+		t.Errorf("Unexpected largest postings: %+v", stats.LargestPostings)
+	}
+}
+
+func TestDecoders(t *testing.T) {
+	var gzBuf bytes.Buffer
+	gz := gzip.NewWriter(&gzBuf)
+	gz.Write([]byte(`{"a":[1,2]}`))
+	gz.Close()
+
+	tests := []struct {
+		spec   string
+		input  []byte
+		expect string
+	}{
+		{"json", []byte(`{"a": [1, 2.5]}`), `{"a":[1,2.5]}`},
+		{"raw", []byte("val"), `"val"`},
+		{"hex", []byte("val"), `"76616c"`},
+		{"base64", []byte("val"), `"dmFs"`},
+		{"snappy", snappy.Encode(nil, []byte("val")), `"val"`},
+		{"snappy+json", snappy.Encode(nil, []byte(`{"a":1}`)), `{"a":1}`},
+		{"gzip+json", gzBuf.Bytes(), `{"a":[1,2]}`},
+		// {"a": [1, -2, "x", true, nil, 1.5], 7: bin "\x00"}
+		{"msgpack", []byte("\x82\xa1a\x96\x01\xfe\xa1x\xc3\xc0" +
+			"\xcb\x3f\xf8\x00\x00\x00\x00\x00\x00\x07\xc4\x01\x00"),
+			`{"7":"AA==","a":[1,-2,"x",true,null,1.5]}`},
+		// {"a": [1, -2, "x", true, null, 1.5 (half)], 7: h'00'}, with an
+		// indefinite length array and a tagged value
+		{"cbor", []byte("\xa2\x61a\x9f\x01\x21\x61x\xf5\xf6" +
+			"\xf9\x3e\x00\xff\x07\xc1\x41\x00"),
+			`{"7":"AA==","a":[1,-2,"x",true,null,1.5]}`},
+	}
+
+	for _, test := range tests {
+		decoder, err := NewDecoder(test.spec)
+		if err != nil {
+			t.Fatalf("Expected decoder %s, err: %v", test.spec, err)
+		}
+		v, err := decoder(test.input)
+		if err != nil {
+			t.Errorf("Expected %s to decode, err: %v", test.spec, err)
+			continue
+		}
+		jBuf, _ := json.Marshal(v)
+		if string(jBuf) != test.expect {
+			t.Errorf("Unexpected %s value, expected: %s, got: %s",
+				test.spec, test.expect, jBuf)
+		}
+	}
+
+	for _, spec := range []string{"xml", "json:arg", "json:+raw",
+		"proto-descriptor"} {
+		_, err := NewDecoder(spec)
+		if err == nil {
+			t.Errorf("Expected decoder %s to be rejected", spec)
+		}
+	}
+
+	failures := []struct {
+		spec  string
+		input []byte
+	}{
+		{"json+raw", []byte("1")},
+		{"json", []byte("{")},
+		{"snappy", []byte("val")},
+		{"msgpack", []byte("\x92\x01")},
+		{"cbor", []byte("\x82\x01")},
+	}
+	for _, test := range failures {
+		decoder, _ := NewDecoder(test.spec)
+		_, err := decoder(test.input)
+		if err == nil {
+			t.Errorf("Expected %s to fail to decode %q", test.spec, test.input)
+		}
+	}
+}
+
+func TestProtoDecoder(t *testing.T) {
+	fdset := &descriptorpb.FileDescriptorSet{
+		File: []*descriptorpb.FileDescriptorProto{{
+			Name:    proto.String("doc.proto"),
+			Package: proto.String("test"),
+			Syntax:  proto.String("proto3"),
+			MessageType: []*descriptorpb.DescriptorProto{{
+				Name: proto.String("Doc"),
+				Field: []*descriptorpb.FieldDescriptorProto{{
+					Name:     proto.String("name"),
+					JsonName: proto.String("name"),
+					Number:   proto.Int32(1),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}, {
+					Name:     proto.String("count"),
+					JsonName: proto.String("count"),
+					Number:   proto.Int32(2),
+					Type:     descriptorpb.FieldDescriptorProto_TYPE_INT32.Enum(),
+					Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+				}},
+			}},
+		}},
+	}
+
+	input, err := proto.Marshal(fdset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "mossScopeProto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The ":" and "+" of the path are not taken as separators
+	fileName := filepath.Join(dir, "test:doc+1.desc")
+	err = ioutil.WriteFile(fileName, input, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := []byte("\x0a\x04moss\x10\x03")
+	tests := []struct {
+		spec  string
+		input []byte
+	}{
+		{"proto-descriptor:" + fileName, msg},
+		{"proto-descriptor:" + fileName + ":test.Doc", msg},
+		{"snappy+proto-descriptor:" + fileName, snappy.Encode(nil, msg)},
+	}
+	for _, test := range tests {
+		spec := test.spec
+		decoder, err := NewDecoder(spec)
+		if err != nil {
+			t.Fatalf("Expected decoder %s, err: %v", spec, err)
+		}
+
+		v, err := decoder(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		jBuf, _ := json.Marshal(v)
+		if string(jBuf) != `{"name":"moss","count":3}` {
+			t.Errorf("Unexpected %s value: %s", spec, jBuf)
+		}
+	}
+
+	_, err = NewDecoder("proto-descriptor:" + fileName + ":test.Missing")
+	if err == nil {
+		t.Errorf("Expected a missing message to be rejected")
+	}
+}
+
+func TestWhere(t *testing.T) {
+	val, _ := decodeJSON([]byte(`{"type": "user", "age": 31,
+		"tags": ["a", "b"], "address": {"zip code": "94043"},
+		"deleted": false, "名前": "moss", "quote": "a\"b'c"}`))
+
+	tests := []struct {
+		expr  string
+		match bool
+	}{
+		{`.名前 == "moss" && .["名前"] == 'moss'`, true},
+		{`.quote == 'a\"b\'c' && .quote == "a\"b'c"`, true},
+		{`.quote == 'a"b\'c'`, true},
+		{`.type == "user" && .age > 30`, true},
+		{`.type == 'user' && .age > 31`, false},
+		{`.age >= 31 && .age <= 31.0 && .age != 32`, true},
+		{`.tags[0] == "a" && .tags[-1] == "b" && .tags[2] == null`, true},
+		{`.address["zip code"] < "95"`, true},
+		{`.address.zip == null && .missing.field == null`, true},
+		{`!.deleted && !(.type == "admin")`, true},
+		{`.deleted || .age < 30`, false},
+		{`.type > 30 || .age > "30"`, false},
+		{`$key == "user::1"`, true},
+		{`. == null`, false},
+		{`.tags == null`, false},
+	}
+
+	for _, test := range tests {
+		w, err := CompileWhere(test.expr)
+		if err != nil {
+			t.Errorf("Expected %s to compile, err: %v", test.expr, err)
+			continue
+		}
+		if w.Match([]byte("user::1"), val) != test.match {
+			t.Errorf("Expected %s to match: %v", test.expr, test.match)
+		}
+	}
+
+	for _, expr := range []string{"", ".a ==", "(.a", "type == 1",
+		".a[x]", `.a == "b`, ".a # 1", ".a == 1 .b",
+		`.type == "user" & .age > 30`, ".a == 1 #", `.a == 1 "b`} {
+		if _, err := CompileWhere(expr); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+}
+
+func TestKeyFilter(t *testing.T) {
+	tests := []struct {
+		regex, glob string
+		invert      bool
+		prefix      string
+		match       []string
+		skip        []string
+	}{
+		{`^user::\d+$`, "", false, "user::", []string{"user::1"},
+			[]string{"user::x", "xuser::1"}},
+		{`^ab+c`, "", false, "a", []string{"abbc", "abcd"}, []string{"ac"}},
+		{`(?i)^ab`, "", false, "", []string{"AB"}, []string{"xab"}},
+		{`user`, "", false, "", []string{"xuser"}, []string{"use"}},
+		{`^user`, "", true, "", []string{"xuser"}, []string{"user"}},
+		{"", "user::*", false, "user::", []string{"user::", "user::a\nb"},
+			[]string{"users::", "xuser::"}},
+		{"", `a\*?[!x]`, false, "a*", []string{"a*by"},
+			[]string{"abby", "a*bx", "a*byz"}},
+		{"", "[]a]*", false, "", []string{"]", "ab"}, []string{"b"}},
+		{"", "*.json", true, "", []string{"a.jsonx"}, []string{"a.json"}},
+	}
+
+	for _, test := range tests {
+		var f *KeyFilter
+		var err error
+		if test.regex != "" {
+			f, err = CompileKeyRegex(test.regex, test.invert)
+		} else {
+			f, err = CompileKeyGlob(test.glob, test.invert)
+		}
+		if err != nil {
+			t.Errorf("Expected %+v to compile, err: %v", test, err)
+			continue
+		}
+		if f.Prefix("") != test.prefix {
+			t.Errorf("Expected prefix %q for %+v, got: %q",
+				test.prefix, test, f.Prefix(""))
+		}
+		for _, key := range test.match {
+			if !f.Match([]byte(key)) {
+				t.Errorf("Expected %+v to match %q", test, key)
+			}
+		}
+		for _, key := range test.skip {
+			if f.Match([]byte(key)) {
+				t.Errorf("Expected %+v to skip %q", test, key)
+			}
+		}
+	}
+
+	f, _ := CompileKeyGlob("user::1*", false)
+	if f.Prefix("user") != "user::1" || f.Prefix("user::12") != "user::12" ||
+		f.Prefix("item") != "item" {
+		t.Errorf("Unexpected prefixes combined with the glob's")
+	}
+
+	var none *KeyFilter
+	if !none.Match([]byte("k")) || none.Prefix("p") != "p" {
+		t.Errorf("Expected a nil filter to select every key")
+	}
+
+	if _, err := CompileKeyGlob("a[b", false); err == nil {
+		t.Errorf("Expected an unterminated class to be rejected")
+	}
+}
+
+func TestFetchSchema(t *testing.T) {
+	dir := "testSchemaStore"
+	os.RemoveAll(dir)
+	defer os.RemoveAll(dir)
+
+	recs := []Record{
+		{Key: []byte("item::1"), Val: []byte(`{"sku": 1}`)},
+		{Key: []byte("user::1"), Val: []byte(`{"name": "ann", "age": 31,
+			"tags": ["a", "bc"], "zip code": null}`)},
+		{Key: []byte("user::2"), Val: []byte(`{"name": "bob", "age": "n/a",
+			"tags": []}`)},
+		{Key: []byte("user::3"), Val: []byte(`not json`)},
+	}
+	_, _, err := Import(dir, recs, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	filter, _ := CompileKeyGlob("user::*", false)
+	schema, err := FetchSchema(store, SchemaOptions{Filter: filter,
+		Examples: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jBuf, _ := json.Marshal(schema)
+	expect := `{"values":2,"undecoded":1,"fields":[` +
+		`{"path":".","docs":2,"frequency":100,"types":{"object":2},` +
+		`"min_length":3,"max_length":4},` +
+		`{"path":".[\"zip code\"]","docs":1,"frequency":50,` +
+		`"types":{"null":1},"examples":[null]},` +
+		`{"path":".age","docs":2,"frequency":100,` +
+		`"types":{"number":1,"string":1},"min_length":3,"max_length":3,` +
+		`"examples":[31]},` +
+		`{"path":".name","docs":2,"frequency":100,"types":{"string":2},` +
+		`"min_length":3,"max_length":3,"examples":["ann"]},` +
+		`{"path":".tags","docs":2,"frequency":100,"types":{"array":2},` +
+		`"min_length":0,"max_length":2},` +
+		`{"path":".tags[]","docs":1,"frequency":50,"types":{"string":2},` +
+		`"min_length":1,"max_length":2,"examples":["a"]}]}`
+	if string(jBuf) != expect {
+		t.Errorf("Unexpected schema, expected:\n%s\ngot:\n%s", expect, jBuf)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	dir := initStore(t, 3)
+	defer os.RemoveAll(dir)
+
+	err := Compact(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := openStore(t, dir)
+	defer store.Close()
+
+	stats, err := FetchFooterStats(store, false)
+	if err != nil || stats[0].NumSegments != 1 {
+		t.Errorf("Expected a single segment after compaction: %+v", stats)
+	}
+}
+
+func TestFindStores(t *testing.T) {
+	root := "testScopeRoot"
+	os.RemoveAll(root)
+	defer os.RemoveAll(root)
+
+	stores := []string{
+		filepath.Join(root, "a", "store1"),
+		filepath.Join(root, "b", "store2"),
+		filepath.Join(root, "b", "store3"),
+	}
+	for _, dir := range stores {
+		os.MkdirAll(dir, 0777)
+		_, _, err := Import(dir, []Record{{Key: []byte("k"),
+			Val: []byte("v")}}, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.MkdirAll(filepath.Join(root, "c", "notAStore"), 0777)
+
+	found, err := FindStores(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(found) != fmt.Sprint(stores) {
+		t.Errorf("Unexpected stores found: %v", found)
+	}
+
+	found, err = GlobStores(filepath.Join(root, "*", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(found) != fmt.Sprint(stores) {
+		t.Errorf("Unexpected stores matched: %v", found)
+	}
+
+	if IsStore(root) || !IsStore(stores[0]) {
+		t.Errorf("Unexpected IsStore() results")
+	}
+}
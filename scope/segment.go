@@ -0,0 +1,113 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/couchbase/moss"
+)
+
+// BasicSegmentKind is the kind of the segments that moss persists,
+// which are the only ones that can be read from the data file.
+const BasicSegmentKind = "a"
+
+// The encoding of the operation, key length and value length of an
+// entry of a basic segment, which is followed by the offset of its key
+// (and value, right after the key) within the segment's buffer.
+const (
+	maskOperation = uint64(0x0F00000000000000)
+	maskKeyLength = uint64(0x00FFFFFF00000000)
+	maskValLength = uint64(0x000000000FFFFFFF)
+	entryBytes    = 16
+)
+
+// The number of entries that a segmentReader reads at once.
+const entriesPerChunk = 4096
+
+// segmentEntry is an operation on a key, as persisted in a segment.
+type segmentEntry struct {
+	op     uint64
+	key    []byte
+	keyPos int64 // Of the key, within the segment's buffer.
+	valLen int
+}
+
+// size returns the bytes that the entry occupies in the data file.
+func (e *segmentEntry) size() uint64 {
+	return uint64(entryBytes + len(e.key) + e.valLen)
+}
+
+// segmentReader reads the entries of a basic segment, which are sorted
+// by key, from the data file.
+type segmentReader struct {
+	f          *os.File
+	loc        *moss.SegmentLoc
+	n          int
+	chunk      []byte
+	chunkStart int
+}
+
+func newSegmentReader(f *os.File, loc *moss.SegmentLoc) (*segmentReader,
+	error) {
+	if loc.Kind != BasicSegmentKind {
+		return nil, fmt.Errorf("unsupported segment kind: %s", loc.Kind)
+	}
+	return &segmentReader{f: f, loc: loc,
+		n: int(loc.KvsBytes / entryBytes)}, nil
+}
+
+// entry returns the i'th entry of the segment.
+func (s *segmentReader) entry(i int) (segmentEntry, error) {
+	if s.chunk == nil || i < s.chunkStart ||
+		i >= s.chunkStart+len(s.chunk)/entryBytes {
+		s.chunkStart = i - i%entriesPerChunk
+		end := s.chunkStart + entriesPerChunk
+		if end > s.n {
+			end = s.n
+		}
+
+		s.chunk = make([]byte, (end-s.chunkStart)*entryBytes)
+		_, err := s.f.ReadAt(s.chunk,
+			int64(s.loc.KvsOffset)+int64(s.chunkStart)*entryBytes)
+		if err != nil {
+			s.chunk = nil
+			return segmentEntry{}, fmt.Errorf("File read error: %v", err)
+		}
+	}
+
+	// moss persists the entries in the byte order of the platform,
+	// which is little endian on all of its supported platforms
+	at := (i - s.chunkStart) * entryBytes
+	opKlVl := binary.LittleEndian.Uint64(s.chunk[at:])
+	keyPos := int64(binary.LittleEndian.Uint64(s.chunk[at+8:]))
+
+	key := make([]byte, (opKlVl&maskKeyLength)>>32)
+	_, err := s.f.ReadAt(key, int64(s.loc.BufOffset)+keyPos)
+	if err != nil {
+		return segmentEntry{}, fmt.Errorf("File read error: %v", err)
+	}
+
+	return segmentEntry{op: opKlVl & maskOperation, key: key,
+		keyPos: keyPos, valLen: int(opKlVl & maskValLength)}, nil
+}
+
+func operationName(op uint64) string {
+	switch op {
+	case moss.OperationSet:
+		return "set"
+	case moss.OperationDel:
+		return "del"
+	case moss.OperationMerge:
+		return "merge"
+	}
+	return fmt.Sprintf("unknown(%x)", op)
+}
@@ -0,0 +1,388 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/couchbase/ghistogram"
+	"github.com/couchbase/moss"
+)
+
+// FooterStats are the stats aggregated from all the segments of a
+// footer.
+type FooterStats struct {
+	SegmentBytes  []uint64 `json:"segment_bytes"`
+	NumSegments   int      `json:"num_segments"`
+	TotalOpsSet   uint64   `json:"total_ops_set"`
+	TotalOpsDel   uint64   `json:"total_ops_del"`
+	TotalKeyBytes uint64   `json:"total_key_bytes"`
+	TotalValBytes uint64   `json:"total_val_bytes"`
+}
+
+// GetFooterStats aggregates the stats of the segments of the footer.
+func GetFooterStats(footer *moss.Footer) FooterStats {
+	stats := FooterStats{SegmentBytes: []uint64{}}
+	if footer == nil {
+		return stats
+	}
+
+	stats.NumSegments = len(footer.SegmentLocs)
+
+	for i := range footer.SegmentLocs {
+		sloc := &footer.SegmentLocs[i]
+
+		stats.TotalOpsSet += sloc.TotOpsSet
+		stats.TotalOpsDel += sloc.TotOpsDel
+		stats.TotalKeyBytes += sloc.TotKeyByte
+		stats.TotalValBytes += sloc.TotValByte
+		stats.SegmentBytes = append(stats.SegmentBytes,
+			sloc.TotKeyByte+sloc.TotValByte)
+	}
+
+	return stats
+}
+
+// Map returns the stats keyed by their JSON names.
+func (s FooterStats) Map() map[string]interface{} {
+	return map[string]interface{}{
+		"segment_bytes":   s.SegmentBytes,
+		"num_segments":    s.NumSegments,
+		"total_ops_set":   s.TotalOpsSet,
+		"total_ops_del":   s.TotalOpsDel,
+		"total_key_bytes": s.TotalKeyBytes,
+		"total_val_bytes": s.TotalValBytes,
+	}
+}
+
+// FetchFooterStats returns the stats of the latest footer, followed by
+// those of all the older footers if all is set.
+func FetchFooterStats(store *moss.Store, all bool) ([]FooterStats, error) {
+	var stats []FooterStats
+	err := WalkFooters(store, all, func(id int, footer *moss.Footer) error {
+		stats = append(stats, GetFooterStats(footer))
+		return nil
+	})
+	return stats, err
+}
+
+// FragStats are the key-val sizes and the directory size of a store,
+// along with the estimated fragmentation.
+type FragStats struct {
+	DataBytes            uint64 `json:"data_bytes"`
+	DirSize              uint64 `json:"dir_size"`
+	FragmentationBytes   uint64 `json:"fragmentation_bytes"`
+	FragmentationPercent uint64 `json:"fragmentation_percent"`
+
+	*ReclaimStats `json:",omitempty"` // Only set by FetchAccurateFragStats.
+}
+
+// ReclaimStats account for the bytes of the segments of the latest
+// footer, and of its child collections, that a full compaction would
+// reclaim, being the versions of keys shadowed by newer versions in
+// newer segments, and the deletions (tombstones) that are visible,
+// which a full compaction drops.
+type ReclaimStats struct {
+	LiveBytes          uint64 `json:"live_bytes"`
+	ShadowedVersions   uint64 `json:"shadowed_versions"`
+	ShadowedBytes      uint64 `json:"shadowed_bytes"`
+	Tombstones         uint64 `json:"tombstones"`
+	TombstoneBytes     uint64 `json:"tombstone_bytes"`
+	ReclaimableBytes   uint64 `json:"reclaimable_bytes"`
+	ReclaimablePercent uint64 `json:"reclaimable_percent"`
+}
+
+// Map returns the stats keyed by their JSON names.
+func (s *FragStats) Map() map[string]interface{} {
+	m := map[string]interface{}{
+		"data_bytes":            s.DataBytes,
+		"dir_size":              s.DirSize,
+		"fragmentation_bytes":   s.FragmentationBytes,
+		"fragmentation_percent": s.FragmentationPercent,
+	}
+	if s.ReclaimStats != nil {
+		for name, val := range s.ReclaimStats.Map() {
+			m[name] = val
+		}
+	}
+	return m
+}
+
+// Map returns the stats keyed by their JSON names.
+func (s *ReclaimStats) Map() map[string]interface{} {
+	return map[string]interface{}{
+		"live_bytes":          s.LiveBytes,
+		"shadowed_versions":   s.ShadowedVersions,
+		"shadowed_bytes":      s.ShadowedBytes,
+		"tombstones":          s.Tombstones,
+		"tombstone_bytes":     s.TombstoneBytes,
+		"reclaimable_bytes":   s.ReclaimableBytes,
+		"reclaimable_percent": s.ReclaimablePercent,
+	}
+}
+
+// FetchFragStats estimates the fragmentation of the store, as the
+// difference between the directory size and the bytes of the
+// key-vals of the latest footer along with all the headers and
+// footers. Zero stats are returned if the store has no snapshot.
+func FetchFragStats(store *moss.Store) (*FragStats, error) {
+	stats := &FragStats{}
+
+	currSnap, err := store.Snapshot()
+	if err != nil || currSnap == nil {
+		return stats, nil
+	}
+
+	footer := currSnap.(*moss.Footer)
+
+	// Acquire key, val bytes from all segments of latest footer
+	for i := range footer.SegmentLocs {
+		sloc := &footer.SegmentLocs[i]
+
+		stats.DataBytes += sloc.TotKeyByte
+		stats.DataBytes += sloc.TotValByte
+	}
+
+	var prevSnap moss.Snapshot
+
+	for {
+		// header signature
+		stats.DataBytes += moss.HeaderLength()
+
+		// footer signature
+		footer = currSnap.(*moss.Footer)
+		stats.DataBytes += footer.Length()
+
+		prevSnap, err = store.SnapshotPrevious(currSnap)
+		currSnap.Close()
+		currSnap = prevSnap
+
+		if err != nil || currSnap == nil {
+			break
+		}
+	}
+
+	sstats, err := store.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("Store-Stats() failed!, err: %v", err)
+	}
+
+	stats.DirSize = sstats["num_bytes_used_disk"].(uint64)
+
+	stats.FragmentationBytes = stats.DirSize - stats.DataBytes
+	if stats.DirSize > 0 {
+		stats.FragmentationPercent = uint64(100 *
+			((float64(stats.FragmentationBytes)) / float64(stats.DirSize)))
+	}
+
+	return stats, nil
+}
+
+// FetchAccurateFragStats returns the fragmentation stats of the store
+// at dir along with its ReclaimStats, accounted for by reading every
+// entry of the segments of the latest footer from the data file.
+func FetchAccurateFragStats(dir string, store *moss.Store) (*FragStats,
+	error) {
+	stats, err := FetchFragStats(store)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName, err := DataFile(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("File open error: %v", err)
+	}
+	defer f.Close()
+
+	err = WalkFooters(store, false, func(id int, footer *moss.Footer) error {
+		reclaim, err := fetchReclaimStats(f, footer)
+		if err != nil {
+			return err
+		}
+		stats.ReclaimStats = reclaim
+
+		// A full compaction leaves the live entries, a header and a
+		// footer
+		kept := stats.LiveBytes + moss.HeaderLength() + footer.Length()
+		if stats.DirSize > kept {
+			stats.ReclaimableBytes = stats.DirSize - kept
+			stats.ReclaimablePercent = uint64(100 *
+				(float64(stats.ReclaimableBytes) / float64(stats.DirSize)))
+		}
+		return nil
+	})
+	if err == ErrNoSnapshot {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// fetchReclaimStats merges the entries of all the segments of the
+// footer in key order, where the entries of a key in older segments
+// are shadowed by the newest set or deletion of the key, while merges
+// need the older entries they merge with. The stats of the child
+// collections of the footer are added up.
+func fetchReclaimStats(f *os.File, footer *moss.Footer) (*ReclaimStats,
+	error) {
+	stats := &ReclaimStats{}
+
+	type cursor struct {
+		r     *segmentReader
+		i     int
+		entry segmentEntry
+	}
+
+	var cursors []*cursor // From the newest segment.
+	for i := len(footer.SegmentLocs) - 1; i >= 0; i-- {
+		r, err := newSegmentReader(f, &footer.SegmentLocs[i])
+		if err != nil {
+			return nil, fmt.Errorf("segment %d: %v", i, err)
+		}
+		if r.n == 0 {
+			continue
+		}
+
+		c := &cursor{r: r}
+		c.entry, err = r.entry(0)
+		if err != nil {
+			return nil, err
+		}
+		cursors = append(cursors, c)
+	}
+
+	for len(cursors) > 0 {
+		var key []byte
+		for _, c := range cursors {
+			if key == nil || bytes.Compare(c.entry.key, key) < 0 {
+				key = c.entry.key
+			}
+		}
+
+		resolved := false
+		remaining := cursors[:0]
+		for _, c := range cursors {
+			for c.i < c.r.n && bytes.Equal(c.entry.key, key) {
+				switch {
+				case resolved:
+					stats.ShadowedVersions++
+					stats.ShadowedBytes += c.entry.size()
+				case c.entry.op == moss.OperationDel:
+					stats.Tombstones++
+					stats.TombstoneBytes += c.entry.size()
+					resolved = true
+				default:
+					stats.LiveBytes += c.entry.size()
+					resolved = c.entry.op != moss.OperationMerge
+				}
+
+				c.i++
+				if c.i < c.r.n {
+					var err error
+					c.entry, err = c.r.entry(c.i)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+			if c.i < c.r.n {
+				remaining = append(remaining, c)
+			}
+		}
+		cursors = remaining
+	}
+
+	// The child collections are compacted along with their parent, and
+	// hold keys of their own
+	for name, child := range footer.ChildFooters {
+		childStats, err := fetchReclaimStats(f, child)
+		if err != nil {
+			return nil, fmt.Errorf("collection %s: %v", name, err)
+		}
+		stats.LiveBytes += childStats.LiveBytes
+		stats.ShadowedVersions += childStats.ShadowedVersions
+		stats.ShadowedBytes += childStats.ShadowedBytes
+		stats.Tombstones += childStats.Tombstones
+		stats.TombstoneBytes += childStats.TombstoneBytes
+	}
+
+	return stats, nil
+}
+
+// FetchDiagStats merges the stats of the latest footer with the store
+// stats.
+func FetchDiagStats(store *moss.Store) (map[string]interface{}, error) {
+	var stats map[string]interface{}
+	err := WalkFooters(store, false, func(id int, footer *moss.Footer) error {
+		stats = GetFooterStats(footer).Map()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	storeStats, err := store.Stats()
+	if err != nil {
+		return nil, fmt.Errorf("Store-Stats() failed!, err: %v", err)
+	}
+
+	for k, v := range storeStats {
+		stats[k] = v
+	}
+
+	return stats, nil
+}
+
+// Histograms are the key and value size histograms of a store.
+type Histograms struct {
+	KeySizes *ghistogram.Histogram
+	ValSizes *ghistogram.Histogram
+}
+
+// FetchHistograms builds the key and value size histograms of the
+// latest snapshot, for the keys that begin with the prefix if any, and
+// that the filter selects, if not nil.
+func FetchHistograms(store *moss.Store, prefix string,
+	filter *KeyFilter) (*Histograms, error) {
+	opts := DumpOptions{Prefix: filter.Prefix(prefix)}
+	if filter != nil {
+		opts.Filter = func(rec Record) bool {
+			return filter.Match(rec.Key)
+		}
+	}
+
+	d, err := Dump(store, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	h := &Histograms{
+		KeySizes: ghistogram.NewNamedHistogram("KeySizes(B) ", 10, 4, 4),
+		ValSizes: ghistogram.NewNamedHistogram("ValSizes(B) ", 10, 4, 4),
+	}
+
+	for d.Next() {
+		rec := d.Record()
+		h.KeySizes.Add(uint64(len(rec.Key)), 1)
+		h.ValSizes.Add(uint64(len(rec.Val)), 1)
+	}
+
+	return h, d.Err()
+}
@@ -0,0 +1,518 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Where is a compiled predicate over the decoded values of records, in
+// a jq-like expression language:
+//
+//	.type == "user" && .age > 30
+//	.tags[0] != "tmp" || !(.deleted)
+//	$key >= "user::100" && .address["zip code"] == null
+//
+// Paths start with "." (the value itself) followed by field names and
+// ["name"] or [index] subscripts, and resolve to null when missing.
+// $key is the key of the record as a string. Literals are numbers,
+// "strings" (or 'strings'), true, false and null. The operators are
+// ==, !=, <, <=, >, >=, &&, || and !, where the ordering comparisons
+// only hold between two numbers or two strings, and a path on its own
+// holds if it is neither null nor false.
+type Where struct {
+	expr whereNode
+}
+
+// CompileWhere parses the expression into a Where.
+func CompileWhere(expr string) (*Where, error) {
+	p := &whereParser{s: expr}
+	p.advance()
+
+	node, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.err != nil {
+		// The lexer stopped at an invalid token past the expression
+		return nil, p.err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+
+	return &Where{expr: node}, nil
+}
+
+// Match returns whether the decoded value of the record with the key
+// satisfies the expression.
+func (w *Where) Match(key []byte, val interface{}) bool {
+	return truthy(w.expr.eval(key, val))
+}
+
+// ---------------------------------------------------------------
+
+type whereNode interface {
+	eval(key []byte, val interface{}) interface{}
+}
+
+type literalNode struct {
+	v interface{}
+}
+
+func (n *literalNode) eval(key []byte, val interface{}) interface{} {
+	return n.v
+}
+
+type keyNode struct{}
+
+func (n *keyNode) eval(key []byte, val interface{}) interface{} {
+	return string(key)
+}
+
+// pathNode resolves a path of field names (string) and indexes (int).
+type pathNode struct {
+	steps []interface{}
+}
+
+func (n *pathNode) eval(key []byte, val interface{}) interface{} {
+	for _, step := range n.steps {
+		switch step := step.(type) {
+		case string:
+			m, ok := val.(map[string]interface{})
+			if !ok {
+				return nil
+			}
+			val = m[step]
+		case int:
+			a, ok := val.([]interface{})
+			if !ok {
+				return nil
+			}
+			if step < 0 {
+				step += len(a)
+			}
+			if step < 0 || step >= len(a) {
+				return nil
+			}
+			val = a[step]
+		}
+	}
+	return val
+}
+
+type notNode struct {
+	x whereNode
+}
+
+func (n *notNode) eval(key []byte, val interface{}) interface{} {
+	return !truthy(n.x.eval(key, val))
+}
+
+type binaryNode struct {
+	op   string
+	x, y whereNode
+}
+
+func (n *binaryNode) eval(key []byte, val interface{}) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.x.eval(key, val)) && truthy(n.y.eval(key, val))
+	case "||":
+		return truthy(n.x.eval(key, val)) || truthy(n.y.eval(key, val))
+	}
+
+	x, y := n.x.eval(key, val), n.y.eval(key, val)
+	switch n.op {
+	case "==":
+		return equal(x, y)
+	case "!=":
+		return !equal(x, y)
+	}
+
+	c, ok := compare(x, y)
+	if !ok {
+		return false
+	}
+	switch n.op {
+	case "<":
+		return c < 0
+	case "<=":
+		return c <= 0
+	case ">":
+		return c > 0
+	}
+	return c >= 0
+}
+
+func truthy(v interface{}) bool {
+	return v != nil && v != false
+}
+
+// number returns the value as a float64, if it is a number.
+func number(v interface{}) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+func equal(x, y interface{}) bool {
+	if fx, ok := number(x); ok {
+		fy, ok := number(y)
+		return ok && fx == fy
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func compare(x, y interface{}) (int, bool) {
+	if fx, ok := number(x); ok {
+		fy, ok := number(y)
+		switch {
+		case !ok:
+			return 0, false
+		case fx < fy:
+			return -1, true
+		case fx > fy:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	sx, ok := x.(string)
+	if !ok {
+		return 0, false
+	}
+	sy, ok := y.(string)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(sx, sy), true
+}
+
+// ---------------------------------------------------------------
+
+const (
+	tokEOF = iota
+	tokPunct
+	tokIdent
+	tokNumber
+	tokString
+)
+
+type whereToken struct {
+	kind int
+	text string
+	pos  int
+}
+
+type whereParser struct {
+	s   string
+	pos int
+	tok whereToken
+	err error
+}
+
+func (p *whereParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("invalid expression at %d: %s", p.tok.pos+1,
+		fmt.Sprintf(format, args...))
+}
+
+var wherePuncts = []string{"==", "!=", "<=", ">=", "&&", "||",
+	"<", ">", "!", "(", ")", "[", "]", "."}
+
+// advance scans the next token into p.tok, recording scanning errors
+// in p.err.
+func (p *whereParser) advance() {
+	for p.pos < len(p.s) && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.s) {
+		p.tok = whereToken{kind: tokEOF, pos: start}
+		return
+	}
+
+	c := p.s[p.pos]
+	r, size := utf8.DecodeRuneInString(p.s[p.pos:])
+	switch {
+	case c == '"' || c == '\'':
+		end := p.pos + 1
+		for end < len(p.s) && p.s[end] != c {
+			if p.s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(p.s) {
+			p.tok = whereToken{kind: tokEOF, pos: start}
+			p.err = fmt.Errorf("invalid expression at %d: unterminated string",
+				start+1)
+			return
+		}
+		p.pos = end + 1
+		p.tok = whereToken{kind: tokString, text: p.s[start:p.pos], pos: start}
+		return
+
+	case c == '-' || (c >= '0' && c <= '9'):
+		end := p.pos + 1
+		for ; end < len(p.s); end++ {
+			c := p.s[end]
+			if c == '+' || c == '-' {
+				// Only as the sign of an exponent
+				if p.s[end-1] != 'e' && p.s[end-1] != 'E' {
+					break
+				}
+			} else if strings.IndexByte("0123456789.eE", c) < 0 {
+				break
+			}
+		}
+		p.pos = end
+		p.tok = whereToken{kind: tokNumber, text: p.s[start:end], pos: start}
+		return
+
+	case r == '$' || r == '_' || unicode.IsLetter(r):
+		end := p.pos + size
+		for end < len(p.s) {
+			r, size := utf8.DecodeRuneInString(p.s[end:])
+			if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+				break
+			}
+			end += size
+		}
+		p.pos = end
+		p.tok = whereToken{kind: tokIdent, text: p.s[start:end], pos: start}
+		return
+	}
+
+	for _, punct := range wherePuncts {
+		if strings.HasPrefix(p.s[p.pos:], punct) {
+			p.pos += len(punct)
+			p.tok = whereToken{kind: tokPunct, text: punct, pos: start}
+			return
+		}
+	}
+
+	p.tok = whereToken{kind: tokEOF, pos: start}
+	p.err = fmt.Errorf("invalid expression at %d: unexpected %q", start+1, r)
+}
+
+func (p *whereParser) punct(text string) bool {
+	if p.tok.kind == tokPunct && p.tok.text == text {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *whereParser) or() (whereNode, error) {
+	x, err := p.and()
+	for err == nil && p.punct("||") {
+		var y whereNode
+		y, err = p.and()
+		x = &binaryNode{op: "||", x: x, y: y}
+	}
+	return x, err
+}
+
+func (p *whereParser) and() (whereNode, error) {
+	x, err := p.not()
+	for err == nil && p.punct("&&") {
+		var y whereNode
+		y, err = p.not()
+		x = &binaryNode{op: "&&", x: x, y: y}
+	}
+	return x, err
+}
+
+func (p *whereParser) not() (whereNode, error) {
+	if p.punct("!") {
+		x, err := p.not()
+		return &notNode{x: x}, err
+	}
+	return p.comparison()
+}
+
+func (p *whereParser) comparison() (whereNode, error) {
+	x, err := p.primary()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.tok.kind == tokPunct {
+		switch op := p.tok.text; op {
+		case "==", "!=", "<", "<=", ">", ">=":
+			p.advance()
+			y, err := p.primary()
+			return &binaryNode{op: op, x: x, y: y}, err
+		}
+	}
+	return x, nil
+}
+
+func (p *whereParser) primary() (whereNode, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	switch tok.kind {
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			p.advance()
+			x, err := p.or()
+			if err != nil {
+				return nil, err
+			}
+			if !p.punct(")") {
+				return nil, p.errorf("expected \")\"")
+			}
+			return x, nil
+		case ".":
+			return p.path()
+		}
+
+	case tokString:
+		p.advance()
+		s, err := unquote(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression at %d: invalid "+
+				"string %s", tok.pos+1, tok.text)
+		}
+		return &literalNode{v: s}, nil
+
+	case tokNumber:
+		p.advance()
+		f, err := strconv.ParseFloat(tok.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid expression at %d: invalid "+
+				"number %s", tok.pos+1, tok.text)
+		}
+		return &literalNode{v: f}, nil
+
+	case tokIdent:
+		p.advance()
+		switch tok.text {
+		case "true":
+			return &literalNode{v: true}, nil
+		case "false":
+			return &literalNode{v: false}, nil
+		case "null":
+			return &literalNode{v: nil}, nil
+		case "$key":
+			return &keyNode{}, nil
+		}
+		return nil, fmt.Errorf("invalid expression at %d: unknown %q "+
+			"(paths start with \".\")", tok.pos+1, tok.text)
+	}
+
+	if tok.kind == tokEOF {
+		return nil, p.errorf("unexpected end")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+// path parses the steps of a path, at its leading ".".
+func (p *whereParser) path() (whereNode, error) {
+	n := &pathNode{}
+	p.advance()
+
+	// The field name right after the leading "." is optional
+	if p.tok.kind == tokIdent && p.s[p.tok.pos-1] == '.' {
+		n.steps = append(n.steps, p.tok.text)
+		p.advance()
+	}
+
+	for p.err == nil {
+		switch {
+		case p.tok.kind == tokPunct && p.tok.text == "." &&
+			p.pos < len(p.s) && !unicode.IsSpace(rune(p.s[p.pos])):
+			p.advance()
+			if p.tok.kind != tokIdent {
+				return nil, p.errorf("expected a field name")
+			}
+			n.steps = append(n.steps, p.tok.text)
+			p.advance()
+
+		case p.punct("["):
+			tok := p.tok
+			switch tok.kind {
+			case tokString:
+				s, err := unquote(tok.text)
+				if err != nil {
+					return nil, p.errorf("invalid string %s", tok.text)
+				}
+				n.steps = append(n.steps, s)
+			case tokNumber:
+				i, err := strconv.Atoi(tok.text)
+				if err != nil {
+					return nil, p.errorf("invalid index %s", tok.text)
+				}
+				n.steps = append(n.steps, i)
+			default:
+				return nil, p.errorf("expected a string or an index")
+			}
+			p.advance()
+			if !p.punct("]") {
+				return nil, p.errorf("expected \"]\"")
+			}
+
+		default:
+			return n, nil
+		}
+	}
+	return nil, p.err
+}
+
+// unquote returns the string of a "double" or 'single' quoted literal,
+// with Go escapes, where either quote may be escaped in both.
+func unquote(s string) (string, error) {
+	// Rewrites the literal as a double quoted Go one
+	body := s[1 : len(s)-1]
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(body); i++ {
+		switch c := body[i]; {
+		case c == '\\' && i+1 < len(body):
+			i++
+			switch body[i] {
+			case '\'':
+				b.WriteByte('\'')
+			case '"':
+				b.WriteString(`\"`)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(body[i])
+			}
+		case c == '"':
+			b.WriteString(`\"`)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return strconv.Unquote(b.String())
+}
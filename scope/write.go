@@ -0,0 +1,190 @@
+// Copyright 2017-Present Couchbase, Inc.
+//
+// Use of this software is governed by the Business Source License included in
+// the file licenses/BSL-Couchbase.txt.  As of the Change Date specified in that
+// file, in accordance with the Business Source License, use of this software
+// will be governed by the Apache License, Version 2.0, included in the file
+// licenses/APL2.txt.
+
+package scope
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sync"
+
+	"github.com/couchbase/moss"
+)
+
+// Compact compacts the store at dir. It must ONLY be invoked when all
+// other processes using the store have completely stopped running, as
+// concurrent data mutations can result in data loss.
+func Compact(dir string) error {
+	store, coll, err := moss.OpenStoreCollection(dir,
+		moss.StoreOptions{}, moss.StorePersistOptions{})
+	if err != nil || store == nil {
+		return newOpenError("Moss-OpenStoreCollection()", dir, err)
+	}
+	defer store.Close()
+	defer coll.Close()
+
+	// A snapshot of a freshly opened collection should be empty.
+	emptySnap, err := coll.Snapshot()
+	if err != nil {
+		return fmt.Errorf("Moss-Snapshot failed, err: %v", err)
+	}
+
+	// Attempting to persist an empty snapshot should trigger compaction.
+	storePersistOpts := moss.StorePersistOptions{
+		CompactionConcern: moss.CompactionAllow,
+	}
+	snap, err := store.Persist(emptySnap, storePersistOpts)
+	if err != nil || snap == nil {
+		return fmt.Errorf("Store-Persist() API failed, err: %v", err)
+	}
+	snap.Close()
+
+	return nil
+}
+
+// Import sets the records into the store at dir, or deletes their keys
+// for the records marked Del, where the store is created if it does not
+// already exist, batchSize records per batch (all the records in a
+// single batch if batchSize <= 0). Records with empty keys are skipped.
+// It returns once all the records are persisted, along with the number
+// of records written and batches executed.
+func Import(dir string, recs []Record, batchSize int) (written,
+	batches int, err error) {
+	if len(recs) == 0 {
+		return 0, 0, nil
+	}
+
+	if _, err = os.Stat(dir); os.IsNotExist(err) {
+		// Create the directory (specified) if it does not already exist
+		os.Mkdir(dir, 0777)
+	}
+
+	var m sync.Mutex
+	var waitingForCleanCh chan struct{}
+
+	var store *moss.Store
+	var coll moss.Collection
+
+	co := moss.CollectionOptions{
+		OnEvent: func(event moss.Event) {
+			if event.Kind == moss.EventKindPersisterProgress {
+				stats, err := coll.Stats()
+				if err == nil && stats.CurDirtyOps <= 0 &&
+					stats.CurDirtyBytes <= 0 && stats.CurDirtySegments <= 0 {
+					m.Lock()
+					if waitingForCleanCh != nil {
+						waitingForCleanCh <- struct{}{}
+						waitingForCleanCh = nil
+					}
+					m.Unlock()
+				}
+			}
+		},
+	}
+
+	store, coll, err = moss.OpenStoreCollection(dir,
+		moss.StoreOptions{CollectionOptions: co},
+		moss.StorePersistOptions{})
+	if err != nil || store == nil {
+		return 0, 0, newOpenError("Moss-OpenStoreCollection()", dir, err)
+	}
+
+	defer store.Close()
+	defer coll.Close()
+
+	ch := make(chan struct{}, 1)
+
+	if batchSize <= 0 {
+		// All key-values in a single batch
+		batchSize = len(recs)
+	}
+
+	numBatches := int(math.Ceil(float64(len(recs)) / float64(batchSize)))
+
+	for cursor := 0; cursor < len(recs); cursor += batchSize {
+		end := cursor + batchSize
+		if end > len(recs) {
+			end = len(recs)
+		}
+
+		sizeOfBatch := 0
+		for _, rec := range recs[cursor:end] {
+			sizeOfBatch += len(rec.Key)
+			if !rec.Del {
+				sizeOfBatch += len(rec.Val)
+			}
+		}
+		if sizeOfBatch == 0 {
+			continue
+		}
+
+		batch, err := coll.NewBatch(end-cursor, sizeOfBatch)
+		if err != nil {
+			return written, batches,
+				fmt.Errorf("Collection-NewBatch() failed, err: %v", err)
+		}
+
+		var kbuf, vbuf []byte
+
+		for _, rec := range recs[cursor:end] {
+			if len(rec.Key) == 0 {
+				continue
+			}
+
+			kbuf, err = batch.Alloc(len(rec.Key))
+			if err != nil {
+				return written, batches,
+					fmt.Errorf("Batch-Alloc() failed, err: %v", err)
+			}
+			copy(kbuf, rec.Key)
+
+			if rec.Del {
+				err = batch.AllocDel(kbuf)
+				if err != nil {
+					return written, batches,
+						fmt.Errorf("Batch-AllocDel() failed, err: %v", err)
+				}
+				written++
+				continue
+			}
+
+			vbuf, err = batch.Alloc(len(rec.Val))
+			if err != nil {
+				return written, batches,
+					fmt.Errorf("Batch-Alloc() failed, err: %v", err)
+			}
+
+			copy(vbuf, rec.Val)
+
+			err = batch.AllocSet(kbuf, vbuf)
+			if err != nil {
+				return written, batches,
+					fmt.Errorf("Batch-AllocSet() failed, err: %v", err)
+			}
+			written++
+		}
+
+		m.Lock()
+		waitingForCleanCh = ch
+		m.Unlock()
+
+		err = coll.ExecuteBatch(batch, moss.WriteOptions{})
+		if err != nil {
+			return written, batches,
+				fmt.Errorf("Collection-ExecuteBatch() failed, err: %v", err)
+		}
+		batches++
+	}
+
+	if batches > 0 {
+		<-ch
+	}
+
+	return written, numBatches, nil
+}